@@ -0,0 +1,183 @@
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// maxCachedDecisions bounds the number of decisions kept by Client.
+const maxCachedDecisions = 1024
+
+// Client asks an external authorization service to check requests.  Its
+// decisions are cached for a while, so that clients repeating a request
+// don't each cost a check.
+type Client struct {
+	url     string
+	grpc    bool
+	client  *http.Client
+	timeout time.Duration
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]decision
+}
+
+// decision is a cached CheckResponse.
+type decision struct {
+	resp    *CheckResponse
+	expires time.Time
+}
+
+// NewClient returns a client for the service at rawURL, which is either a
+// grpc://host:port URL, for the gRPC service over HTTP/2 without TLS, or an
+// http:// or https:// URL that CheckRequests are POSTed to as JSON, and that
+// responds with CheckResponses as JSON.  Checks time out after timeout, and
+// decisions are cached for ttl, if it's positive.
+func NewClient(rawURL string, timeout, ttl time.Duration) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in %q", rawURL)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("timeout must be positive, got %v", timeout)
+	}
+	c := &Client{
+		url:     rawURL,
+		client:  &http.Client{},
+		timeout: timeout,
+		ttl:     ttl,
+		now:     time.Now,
+		cache:   map[[sha256.Size]byte]decision{},
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "grpc":
+		if u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("gRPC URL %q may not have a path or query", rawURL)
+		}
+		c.url = "http://" + u.Host + CheckPath
+		c.grpc = true
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		c.client.Transport = &http.Transport{Protocols: &protocols}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected grpc, http or https", u.Scheme)
+	}
+	return c, nil
+}
+
+// Check asks the service whether req is authorized, unless it was asked
+// recently.  Requests are the same if they encode alike but for their source
+// ports, which differ between a client's connections.
+func (c *Client) Check(ctx context.Context, req *CheckRequest) (*CheckResponse, error) {
+	msg := req.Marshal()
+	keyed := *req
+	keyed.Attributes.Source.Address.SocketAddress.PortValue = 0
+	key := sha256.Sum256(keyed.Marshal())
+	c.mu.Lock()
+	cached, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(cached.expires) {
+		return cached.resp, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	var resp *CheckResponse
+	var err error
+	if c.grpc {
+		resp, err = c.checkGRPC(ctx, msg)
+	} else {
+		resp, err = c.checkHTTP(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.ttl <= 0 {
+		return resp, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cache) >= maxCachedDecisions {
+		c.cache = map[[sha256.Size]byte]decision{}
+	}
+	c.cache[key] = decision{resp, c.now().Add(c.ttl)}
+	return resp, nil
+}
+
+func (c *Client) checkHTTP(ctx context.Context, req *CheckRequest) (*CheckResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(hreq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to check request: %s", resp.Status)
+	}
+	var result CheckResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxMessageSize)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse check response: %v", err)
+	}
+	return &result, nil
+}
+
+func (c *Client) checkGRPC(ctx context.Context, msg []byte) (*CheckResponse, error) {
+	hreq, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(frame(msg)))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", grpcContentType)
+	hreq.Header.Set("TE", "trailers")
+	resp, err := c.client.Do(hreq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to check request: %s", resp.Status)
+	}
+	// The body has to be read to the end for the trailers to be.
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 5+maxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check request: %v", err)
+	}
+	// Responses without a message have their status in the headers.
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return nil, fmt.Errorf("failed to check request: gRPC status %q: %s", status, message)
+	}
+	reply, err := readMessage(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	var result CheckResponse
+	if err := result.Unmarshal(reply); err != nil {
+		return nil, fmt.Errorf("failed to parse check response: %v", err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,162 @@
+// Package extauthz speaks the Envoy external authorization API,
+// envoy.service.auth.v3.Authorization, both as a client, so that metadata
+// requests can be checked by services such as OPA, and as a server, so that
+// Envoy can check requests with the proxy's policy.
+//
+// Only the parts of CheckRequest and CheckResponse that describe HTTP
+// requests are supported.  Messages are encoded either as protocol buffers,
+// for gRPC, or as JSON with the field names of the proto3 JSON mapping.
+package extauthz
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CheckRequest asks whether a request is authorized.
+type CheckRequest struct {
+	Attributes AttributeContext `json:"attributes"`
+}
+
+// AttributeContext describes a request and its peers.
+type AttributeContext struct {
+	Source      Peer    `json:"source"`
+	Destination Peer    `json:"destination"`
+	Request     Request `json:"request"`
+	// ContextExtensions holds what the proxy knows of the caller that has
+	// no place in Source.
+	ContextExtensions map[string]string `json:"contextExtensions,omitempty"`
+}
+
+// Peer is the source or destination of a request.
+type Peer struct {
+	Address   Address           `json:"address"`
+	Principal string            `json:"principal,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// Address is a socket address.
+type Address struct {
+	SocketAddress SocketAddress `json:"socketAddress"`
+}
+
+// SocketAddress is an IP address and port.
+type SocketAddress struct {
+	Address   string `json:"address"`
+	PortValue uint32 `json:"portValue"`
+}
+
+// Request is the request being checked.
+type Request struct {
+	HTTP HTTPRequest `json:"http"`
+}
+
+// HTTPRequest describes an HTTP request.  As in Envoy, Path includes the
+// query, and Headers maps lower-case names to their values, joined with ","
+// if the header is repeated.
+type HTTPRequest struct {
+	ID       string            `json:"id,omitempty"`
+	Method   string            `json:"method"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Path     string            `json:"path"`
+	Host     string            `json:"host"`
+	Scheme   string            `json:"scheme,omitempty"`
+	Query    string            `json:"query,omitempty"`
+	Fragment string            `json:"fragment,omitempty"`
+	Protocol string            `json:"protocol,omitempty"`
+}
+
+// CheckResponse is the decision on a CheckRequest.
+type CheckResponse struct {
+	// Status is the decision: a request is allowed if its code is 0, OK,
+	// and denied otherwise.
+	Status Status `json:"status"`
+	// DeniedResponse is what to respond to a denied request with.
+	DeniedResponse *DeniedHTTPResponse `json:"deniedResponse,omitempty"`
+	// OkResponse is how to change an allowed request.
+	OkResponse *OKHTTPResponse `json:"okResponse,omitempty"`
+}
+
+// Allowed returns whether the response allows the request.
+func (r *CheckResponse) Allowed() bool {
+	return r.Status.Code == 0
+}
+
+// Status is a google.rpc.Status.
+type Status struct {
+	Code    int32  `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// gRPC status codes used in CheckResponses.
+const (
+	CodeOK               = 0
+	CodePermissionDenied = 7
+)
+
+// DeniedHTTPResponse is the response to a denied request.
+type DeniedHTTPResponse struct {
+	Status  HTTPStatus          `json:"status"`
+	Headers []HeaderValueOption `json:"headers,omitempty"`
+	Body    string              `json:"body,omitempty"`
+}
+
+// OKHTTPResponse changes the headers of an allowed request.
+type OKHTTPResponse struct {
+	Headers         []HeaderValueOption `json:"headers,omitempty"`
+	HeadersToRemove []string            `json:"headersToRemove,omitempty"`
+}
+
+// HTTPStatus is an HTTP status code.
+type HTTPStatus struct {
+	Code StatusCode `json:"code"`
+}
+
+// StatusCode is an envoy.type.v3.StatusCode.  In JSON, it's either a number,
+// or the name of the code, such as "Forbidden".
+type StatusCode int32
+
+func (c *StatusCode) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		var n int32
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("invalid status code %s", b)
+		}
+		*c = StatusCode(n)
+		return nil
+	}
+	if name == "Empty" {
+		*c = 0
+		return nil
+	}
+	for code := 100; code < 600; code++ {
+		if statusName(code) == name {
+			*c = StatusCode(code)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown status code %q", name)
+}
+
+// statusName returns the name of an HTTP status code in envoy.type.v3,
+// which is its text without spaces or hyphens, or "" if it isn't known.
+func statusName(code int) string {
+	return strings.NewReplacer(" ", "", "-", "", "'", "").Replace(http.StatusText(code))
+}
+
+// HeaderValueOption is a header to add to a request or response.
+type HeaderValueOption struct {
+	Header HeaderValue `json:"header"`
+	// Append is whether the value is added to the header's values, rather
+	// than replacing them.
+	Append bool `json:"append,omitempty"`
+}
+
+// HeaderValue is a header and its value.
+type HeaderValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
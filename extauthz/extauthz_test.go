@@ -0,0 +1,351 @@
+package extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRequest = &CheckRequest{Attributes: AttributeContext{
+	Source: Peer{
+		Address:   Address{SocketAddress{Address: "10.0.0.5", PortValue: 41234}},
+		Principal: "default/web",
+		Labels:    map[string]string{"app": "web", "tier": ""},
+	},
+	Destination: Peer{Address: Address{SocketAddress{Address: "169.254.169.254", PortValue: 80}}},
+	Request: Request{HTTP: HTTPRequest{
+		Method:   "GET",
+		Headers:  map[string]string{"metadata-flavor": "Google"},
+		Path:     "/computeMetadata/v1/instance/id?alt=text",
+		Host:     "metadata.google.internal",
+		Scheme:   "http",
+		Query:    "alt=text",
+		Protocol: "HTTP/1.1",
+	}},
+	ContextExtensions: map[string]string{"namespace": "default"},
+}}
+
+func TestMarshalCheckRequest(t *testing.T) {
+	t.Parallel()
+	var got CheckRequest
+	if err := got.Unmarshal(testRequest.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, testRequest) {
+		t.Errorf("Got %+v after a round trip, expected %+v", got, testRequest)
+	}
+}
+
+func TestMarshalCheckResponse(t *testing.T) {
+	t.Parallel()
+	tests := []*CheckResponse{
+		{},
+		{Status: Status{Code: -1, Message: "negative"}},
+		{
+			Status: Status{Code: CodePermissionDenied, Message: "denied"},
+			DeniedResponse: &DeniedHTTPResponse{
+				Status:  HTTPStatus{Code: http.StatusUnauthorized},
+				Headers: []HeaderValueOption{{HeaderValue{"www-authenticate", "Bearer"}, false}, {HeaderValue{"x-reason", ""}, false}},
+				Body:    "go away",
+			},
+		},
+		{
+			OkResponse: &OKHTTPResponse{
+				Headers:         []HeaderValueOption{{HeaderValue{":path", "/computeMetadata/v1/"}, false}, {HeaderValue{"x-goog-user-project", "p"}, true}},
+				HeadersToRemove: []string{"authorization", "cookie"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		var got CheckResponse
+		if err := got.Unmarshal(tc.Marshal()); err != nil {
+			t.Errorf("Failed to unmarshal %+v: %v", tc, err)
+			continue
+		}
+		if !reflect.DeepEqual(&got, tc) {
+			t.Errorf("Got %+v after a round trip, expected %+v", got, tc)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		msg  string
+	}{
+		{"truncated tag", "\x80"},
+		{"truncated length", "\x0a\x05ab"},
+		{"field 0", "\x00\x01"},
+		{"group", "\x0b"},
+		{"varint for a message", "\x08\x01"},
+	}
+	for _, tc := range tests {
+		var r CheckResponse
+		if err := r.Unmarshal([]byte(tc.msg)); err == nil {
+			t.Errorf("%s: got no error, expected one", tc.name)
+		}
+	}
+}
+
+func TestStatusCodeJSON(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		json      string
+		expect    StatusCode
+		expectErr bool
+	}{
+		{`403`, 403, false},
+		{`"Forbidden"`, 403, false},
+		{`"TooManyRequests"`, 429, false},
+		{`"Empty"`, 0, false},
+		{`"Nope"`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, tc := range tests {
+		var got StatusCode
+		err := json.Unmarshal([]byte(tc.json), &got)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("Got error %v for %s, expected error: %v", err, tc.json, tc.expectErr)
+		}
+		if got != tc.expect {
+			t.Errorf("Got %d for %s, expected %d", got, tc.json, tc.expect)
+		}
+	}
+}
+
+// decide denies requests to paths starting with /deny, and allows the rest.
+func decide(req *CheckRequest) *CheckResponse {
+	if !strings.HasPrefix(req.Attributes.Request.HTTP.Path, "/deny") {
+		return &CheckResponse{}
+	}
+	return &CheckResponse{
+		Status: Status{Code: CodePermissionDenied},
+		DeniedResponse: &DeniedHTTPResponse{
+			Status: HTTPStatus{Code: http.StatusTeapot},
+			Body:   "denied by " + req.Attributes.Source.Principal,
+		},
+	}
+}
+
+// newGRPCServer returns a stand-in gRPC service that decides with decide.
+func newGRPCServer(t *testing.T, calls *int32) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if req.URL.Path != CheckPath || req.ProtoMajor != 2 || req.Header.Get("Content-Type") != grpcContentType {
+			t.Errorf("Got %s %s with content type %q, expected an HTTP/2 gRPC call", req.Proto, req.URL.Path, req.Header.Get("Content-Type"))
+		}
+		msg, err := readMessage(req.Body)
+		var check CheckRequest
+		if err == nil {
+			err = check.Unmarshal(msg)
+		}
+		rw.Header().Set("Content-Type", grpcContentType)
+		if err != nil || check.Attributes.Request.HTTP.Path == "/unavailable" {
+			rw.Header().Set("Grpc-Status", "14")
+			rw.Header().Set("Grpc-Message", "unavailable")
+			return
+		}
+		rw.Header().Set("Trailer", "Grpc-Status")
+		rw.Write(frame(decide(&check).Marshal()))
+		rw.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = &http.Protocols{}
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	return srv
+}
+
+// newHTTPServer returns a stand-in JSON service that decides with decide.
+func newHTTPServer(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(calls, 1)
+		var check CheckRequest
+		if err := json.NewDecoder(req.Body).Decode(&check); err != nil {
+			t.Errorf("Failed to decode check request: %v", err)
+		}
+		if check.Attributes.Request.HTTP.Path == "/unavailable" {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(rw).Encode(decide(&check))
+	}))
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+	servers := []struct {
+		name   string
+		scheme string
+		start  func(t *testing.T, calls *int32) *httptest.Server
+	}{
+		{"grpc", "grpc", newGRPCServer},
+		{"http", "http", newHTTPServer},
+	}
+	tests := []struct {
+		path       string
+		expectCode StatusCode
+		expectErr  bool
+	}{
+		{"/computeMetadata/v1/instance/id", 0, false},
+		{"/deny/this", http.StatusTeapot, false},
+		{"/unavailable", 0, true},
+	}
+	for _, s := range servers {
+		var calls int32
+		srv := s.start(t, &calls)
+		defer srv.Close()
+		c, err := NewClient(s.scheme+"://"+strings.TrimPrefix(srv.URL, "http://"), time.Second, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range tests {
+			req := *testRequest
+			req.Attributes.Request.HTTP.Path = tc.path
+			resp, err := c.Check(context.Background(), &req)
+			if (err != nil) != tc.expectErr {
+				t.Errorf("%s: got error %v for %s, expected error: %v", s.name, err, tc.path, tc.expectErr)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			if allowed := tc.expectCode == 0; resp.Allowed() != allowed {
+				t.Errorf("%s: got allowed %v for %s, expected %v", s.name, resp.Allowed(), tc.path, allowed)
+			}
+			if tc.expectCode == 0 {
+				continue
+			}
+			if resp.DeniedResponse == nil || resp.DeniedResponse.Status.Code != tc.expectCode {
+				t.Errorf("%s: got denied response %+v for %s, expected code %d", s.name, resp.DeniedResponse, tc.path, tc.expectCode)
+			} else if expect := "denied by default/web"; resp.DeniedResponse.Body != expect {
+				t.Errorf("%s: got body %q, expected %q", s.name, resp.DeniedResponse.Body, expect)
+			}
+		}
+
+		// Decisions are cached, even for other connections; failures
+		// aren't.
+		before := atomic.LoadInt32(&calls)
+		for _, tc := range tests {
+			req := *testRequest
+			req.Attributes.Request.HTTP.Path = tc.path
+			req.Attributes.Source.Address.SocketAddress.PortValue++
+			c.Check(context.Background(), &req)
+		}
+		if got := atomic.LoadInt32(&calls) - before; got != 1 {
+			t.Errorf("%s: got %d calls repeating checks, expected 1", s.name, got)
+		}
+	}
+}
+
+func TestClientCacheExpiry(t *testing.T) {
+	t.Parallel()
+	var calls int32
+	srv := newHTTPServer(t, &calls)
+	defer srv.Close()
+	c, err := NewClient(srv.URL, time.Second, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	for _, advance := range []time.Duration{0, 30 * time.Second, 31 * time.Second} {
+		now = now.Add(advance)
+		if _, err := c.Check(context.Background(), testRequest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Got %d calls, expected 2", calls)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	c, err := NewClient(srv.URL, 50*time.Millisecond, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := c.Check(context.Background(), testRequest); err == nil {
+		t.Errorf("Got no error from a hanging service, expected one")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Check took %v, expected it to time out", elapsed)
+	}
+}
+
+func TestNewClientErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		url     string
+		timeout time.Duration
+	}{
+		{"grpc://127.0.0.1:9191", 0},
+		{"127.0.0.1:9191", time.Second},
+		{"unix:///run/authz.sock", time.Second},
+		{"grpc://127.0.0.1:9191/check", time.Second},
+		{"http://", time.Second},
+	}
+	for _, tc := range tests {
+		if _, err := NewClient(tc.url, tc.timeout, 0); err == nil {
+			t.Errorf("Got no error for %q with timeout %v, expected one", tc.url, tc.timeout)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewUnstartedServer(NewHandler(func(ctx context.Context, req *CheckRequest) *CheckResponse {
+		return decide(req)
+	}))
+	srv.Config.Protocols = &http.Protocols{}
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	c, err := NewClient("grpc://"+host, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := *testRequest
+	req.Attributes.Request.HTTP.Path = "/deny"
+	resp, err := c.Check(context.Background(), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp, decide(&req)) {
+		t.Errorf("Got %+v, expected %+v", resp, decide(&req))
+	}
+
+	// Other methods are unimplemented.
+	c.url = "http://" + host + "/envoy.service.auth.v3.Authorization/Other"
+	if _, err := c.Check(context.Background(), testRequest); err == nil || !strings.Contains(err.Error(), `"12"`) {
+		t.Errorf("Got error %v calling another method, expected status 12", err)
+	}
+
+	// gRPC needs HTTP/2.
+	plain, err := http.Post(srv.URL+CheckPath, grpcContentType, strings.NewReader(string(frame(testRequest.Marshal()))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Body.Close()
+	if plain.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Errorf("Got %s over HTTP/1.1, expected %d", plain.Status, http.StatusHTTPVersionNotSupported)
+	}
+}
@@ -0,0 +1,43 @@
+package extauthz
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CheckPath is the HTTP/2 path of the Check method of the gRPC service.
+const CheckPath = "/envoy.service.auth.v3.Authorization/Check"
+
+// grpcContentType is the content type of gRPC requests and responses.
+const grpcContentType = "application/grpc"
+
+// maxMessageSize bounds the size of the messages read, and the JSON bodies.
+const maxMessageSize = 1 << 20
+
+// frame returns msg framed as a gRPC message: uncompressed, with its length.
+func frame(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// readMessage reads a gRPC message from r.
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("compressed messages aren't supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	return msg, nil
+}
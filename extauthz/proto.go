@@ -0,0 +1,437 @@
+package extauthz
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Messages are encoded in the protocol buffer wire format by hand, since
+// only a few fields of each are used.  Field numbers are those of the
+// envoy.service.auth.v3, envoy.config.core.v3, envoy.type.v3 and google.rpc
+// protos.
+
+// Wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// encoder appends fields to a message.  Fields with zero values are left out,
+// as in proto3.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) tag(field, wire int) {
+	e.b = binary.AppendUvarint(e.b, uint64(field)<<3|uint64(wire))
+}
+
+func (e *encoder) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.b = binary.AppendUvarint(e.b, v)
+}
+
+func (e *encoder) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// message appends the message encoded by fn, unless it's empty.
+func (e *encoder) message(field int, fn func(e *encoder)) {
+	var m encoder
+	fn(&m)
+	if len(m.b) == 0 {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(m.b)))
+	e.b = append(e.b, m.b...)
+}
+
+// stringMap appends a map<string, string>, in key order so that equal maps
+// are encoded alike.
+func (e *encoder) stringMap(field int, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// Entries are written even if they're empty, unlike messages.
+		e.tag(field, wireBytes)
+		var entry encoder
+		entry.string(1, k)
+		entry.string(2, m[k])
+		e.b = binary.AppendUvarint(e.b, uint64(len(entry.b)))
+		e.b = append(e.b, entry.b...)
+	}
+}
+
+// value is a decoded field: n for varints and fixed-size values, b for
+// length-delimited ones.
+type value struct {
+	wire int
+	n    uint64
+	b    []byte
+}
+
+var errTruncated = errors.New("truncated message")
+
+// walk calls fn with each field of the message b.  Fields of other wire
+// types than fn expects are an error; unknown fields are for fn to ignore.
+func walk(b []byte, fn func(field int, v value) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		field, v := int(key>>3), value{wire: int(key & 7)}
+		switch v.wire {
+		case wireVarint:
+			if v.n, n = binary.Uvarint(b); n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			v.n, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			v.n, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errTruncated
+			}
+			v.b, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", v.wire)
+		}
+		if field == 0 {
+			return errors.New("invalid field number 0")
+		}
+		if err := fn(field, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// str returns v as a string field.
+func (v value) str() (string, error) {
+	if v.wire != wireBytes {
+		return "", fmt.Errorf("wire type %d for a string", v.wire)
+	}
+	return string(v.b), nil
+}
+
+// message decodes v as a message field with fn.
+func (v value) message(fn func(field int, v value) error) error {
+	if v.wire != wireBytes {
+		return fmt.Errorf("wire type %d for a message", v.wire)
+	}
+	return walk(v.b, fn)
+}
+
+// varint returns v as a varint field.
+func (v value) varint() (uint64, error) {
+	if v.wire != wireVarint {
+		return 0, fmt.Errorf("wire type %d for a varint", v.wire)
+	}
+	return v.n, nil
+}
+
+// mapEntry decodes v as an entry of a map<string, string> into m.
+func (v value) mapEntry(m map[string]string) error {
+	var key, val string
+	err := v.message(func(field int, v value) (err error) {
+		switch field {
+		case 1:
+			key, err = v.str()
+		case 2:
+			val, err = v.str()
+		}
+		return err
+	})
+	m[key] = val
+	return err
+}
+
+// Marshal encodes the request as a protocol buffer.
+func (r *CheckRequest) Marshal() []byte {
+	var e encoder
+	e.message(1, func(e *encoder) {
+		a := &r.Attributes
+		e.message(1, a.Source.marshal)
+		e.message(2, a.Destination.marshal)
+		e.message(4, func(e *encoder) {
+			e.message(2, a.Request.HTTP.marshal)
+		})
+		e.stringMap(10, a.ContextExtensions)
+	})
+	return e.b
+}
+
+func (p *Peer) marshal(e *encoder) {
+	e.message(1, func(e *encoder) {
+		e.message(1, func(e *encoder) {
+			e.string(2, p.Address.SocketAddress.Address)
+			e.varint(3, uint64(p.Address.SocketAddress.PortValue))
+		})
+	})
+	e.stringMap(3, p.Labels)
+	e.string(4, p.Principal)
+}
+
+func (h *HTTPRequest) marshal(e *encoder) {
+	e.string(1, h.ID)
+	e.string(2, h.Method)
+	e.stringMap(3, h.Headers)
+	e.string(4, h.Path)
+	e.string(5, h.Host)
+	e.string(6, h.Scheme)
+	e.string(7, h.Query)
+	e.string(8, h.Fragment)
+	e.string(10, h.Protocol)
+}
+
+// Unmarshal decodes a request encoded as a protocol buffer into r.
+func (r *CheckRequest) Unmarshal(b []byte) error {
+	return walk(b, func(field int, v value) error {
+		if field != 1 {
+			return nil
+		}
+		a := &r.Attributes
+		return v.message(func(field int, v value) error {
+			switch field {
+			case 1:
+				return v.message(a.Source.unmarshal)
+			case 2:
+				return v.message(a.Destination.unmarshal)
+			case 4:
+				return v.message(func(field int, v value) error {
+					if field != 2 {
+						return nil
+					}
+					return v.message(a.Request.HTTP.unmarshal)
+				})
+			case 10:
+				if a.ContextExtensions == nil {
+					a.ContextExtensions = map[string]string{}
+				}
+				return v.mapEntry(a.ContextExtensions)
+			}
+			return nil
+		})
+	})
+}
+
+func (p *Peer) unmarshal(field int, v value) (err error) {
+	switch field {
+	case 1:
+		return v.message(func(field int, v value) error {
+			if field != 1 {
+				return nil
+			}
+			s := &p.Address.SocketAddress
+			return v.message(func(field int, v value) (err error) {
+				switch field {
+				case 2:
+					s.Address, err = v.str()
+				case 3:
+					var n uint64
+					n, err = v.varint()
+					s.PortValue = uint32(n)
+				}
+				return err
+			})
+		})
+	case 3:
+		if p.Labels == nil {
+			p.Labels = map[string]string{}
+		}
+		return v.mapEntry(p.Labels)
+	case 4:
+		p.Principal, err = v.str()
+	}
+	return err
+}
+
+func (h *HTTPRequest) unmarshal(field int, v value) (err error) {
+	var s *string
+	switch field {
+	case 1:
+		s = &h.ID
+	case 2:
+		s = &h.Method
+	case 3:
+		if h.Headers == nil {
+			h.Headers = map[string]string{}
+		}
+		return v.mapEntry(h.Headers)
+	case 4:
+		s = &h.Path
+	case 5:
+		s = &h.Host
+	case 6:
+		s = &h.Scheme
+	case 7:
+		s = &h.Query
+	case 8:
+		s = &h.Fragment
+	case 10:
+		s = &h.Protocol
+	default:
+		return nil
+	}
+	*s, err = v.str()
+	return err
+}
+
+// Marshal encodes the response as a protocol buffer.
+func (r *CheckResponse) Marshal() []byte {
+	var e encoder
+	e.message(1, func(e *encoder) {
+		// Codes are int32s, which are sign-extended.
+		e.varint(1, uint64(int64(r.Status.Code)))
+		e.string(2, r.Status.Message)
+	})
+	if d := r.DeniedResponse; d != nil {
+		e.message(2, func(e *encoder) {
+			e.message(1, func(e *encoder) {
+				e.varint(1, uint64(int64(d.Status.Code)))
+			})
+			marshalHeaders(e, 2, d.Headers)
+			e.string(3, d.Body)
+		})
+	}
+	if o := r.OkResponse; o != nil {
+		e.message(3, func(e *encoder) {
+			marshalHeaders(e, 2, o.Headers)
+			for _, h := range o.HeadersToRemove {
+				e.string(5, h)
+			}
+		})
+	}
+	return e.b
+}
+
+func marshalHeaders(e *encoder, field int, headers []HeaderValueOption) {
+	for _, h := range headers {
+		e.message(field, func(e *encoder) {
+			e.message(1, func(e *encoder) {
+				e.string(1, h.Header.Key)
+				e.string(2, h.Header.Value)
+			})
+			if h.Append {
+				// A google.protobuf.BoolValue.
+				e.message(2, func(e *encoder) {
+					e.varint(1, 1)
+				})
+			}
+		})
+	}
+}
+
+// Unmarshal decodes a response encoded as a protocol buffer into r.
+func (r *CheckResponse) Unmarshal(b []byte) error {
+	return walk(b, func(field int, v value) error {
+		switch field {
+		case 1:
+			return v.message(func(field int, v value) (err error) {
+				switch field {
+				case 1:
+					var n uint64
+					n, err = v.varint()
+					r.Status.Code = int32(n)
+				case 2:
+					r.Status.Message, err = v.str()
+				}
+				return err
+			})
+		case 2:
+			d := &DeniedHTTPResponse{}
+			r.DeniedResponse = d
+			return v.message(func(field int, v value) (err error) {
+				switch field {
+				case 1:
+					return v.message(func(field int, v value) error {
+						if field != 1 {
+							return nil
+						}
+						n, err := v.varint()
+						d.Status.Code = StatusCode(n)
+						return err
+					})
+				case 2:
+					return unmarshalHeader(v, &d.Headers)
+				case 3:
+					d.Body, err = v.str()
+				}
+				return err
+			})
+		case 3:
+			o := &OKHTTPResponse{}
+			r.OkResponse = o
+			return v.message(func(field int, v value) error {
+				switch field {
+				case 2:
+					return unmarshalHeader(v, &o.Headers)
+				case 5:
+					h, err := v.str()
+					o.HeadersToRemove = append(o.HeadersToRemove, h)
+					return err
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// unmarshalHeader decodes v as a HeaderValueOption, appending it to headers.
+func unmarshalHeader(v value, headers *[]HeaderValueOption) error {
+	var h HeaderValueOption
+	err := v.message(func(field int, v value) error {
+		switch field {
+		case 1:
+			return v.message(func(field int, v value) (err error) {
+				switch field {
+				case 1:
+					h.Header.Key, err = v.str()
+				case 2:
+					h.Header.Value, err = v.str()
+				}
+				return err
+			})
+		case 2:
+			return v.message(func(field int, v value) error {
+				if field != 1 {
+					return nil
+				}
+				n, err := v.varint()
+				h.Append = n != 0
+				return err
+			})
+		}
+		return nil
+	})
+	*headers = append(*headers, h)
+	return err
+}
@@ -0,0 +1,69 @@
+package extauthz
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// gRPC status codes returned by the server when it can't call its CheckFunc.
+const (
+	codeInternal      = 13
+	codeUnimplemented = 12
+)
+
+// CheckFunc decides a CheckRequest.
+type CheckFunc func(ctx context.Context, req *CheckRequest) *CheckResponse
+
+// server serves the Check method of the gRPC service.
+type server struct {
+	check CheckFunc
+}
+
+// NewHandler returns a handler serving the Check method of the gRPC service,
+// envoy.service.auth.v3.Authorization, with check.  gRPC is served over
+// HTTP/2 only, so the handler's server must speak it, such as by setting
+// http.Protocols.SetUnencryptedHTTP2.
+func NewHandler(check CheckFunc) http.Handler {
+	return server{check}
+}
+
+func (s server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" || req.ProtoMajor != 2 {
+		http.Error(rw, "Only gRPC over HTTP/2 is served", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if ct := req.Header.Get("Content-Type"); ct != grpcContentType && ct != grpcContentType+"+proto" {
+		http.Error(rw, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	rw.Header().Set("Content-Type", grpcContentType)
+	if req.URL.Path != CheckPath {
+		writeStatus(rw.Header(), codeUnimplemented, "unknown method")
+		return
+	}
+	msg, err := readMessage(req.Body)
+	var check CheckRequest
+	if err == nil {
+		err = check.Unmarshal(msg)
+	}
+	if err != nil {
+		writeStatus(rw.Header(), codeInternal, "malformed CheckRequest")
+		return
+	}
+	resp := s.check(req.Context(), &check)
+	rw.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(frame(resp.Marshal()))
+	writeStatus(rw.Header(), CodeOK, "")
+}
+
+// writeStatus sets the gRPC status in h: in the headers of a response without
+// a message, or in its trailers once the message is written.  Messages must be
+// printable ASCII, which needs no escaping.
+func writeStatus(h http.Header, code int, message string) {
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		h.Set("Grpc-Message", message)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/extauthz"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/netrules"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/proxy"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/tokens"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	addr                = flag.String("addr", "127.0.0.1:988", "Comma-separated addresses at which to listen and proxy, each optionally followed by =N to limit it to N connections instead of --max-connections; [::] listens on both IPv4 and IPv6")
+	metricsAddr         = flag.String("metrics-addr", "127.0.0.1:989", "Address at which to publish metrics")
+	maxConnections      = flag.Int("max-connections", 100, "Maximum number of simultaneous connections to serve on each listener")
+	readTimeout         = flag.Duration("read-timeout", 60*time.Second, "Maximum duration for reading an entire request")
+	writeTimeout        = flag.Duration("write-timeout", 60*time.Second, "Maximum duration for writing a response, not counting time spent waiting on ?wait_for_change")
+	maxWaitTimeout      = flag.Duration("max-wait-timeout", time.Hour, "Maximum time a ?wait_for_change request may wait for a change; missing ?timeout_sec values are set, and longer ones capped, to this before requests are forwarded")
+	maxHeaderBytes      = flag.Int("max-header-bytes", 1<<20, "Maximum size of request headers in bytes")
+	keepAlivePeriod     = flag.Duration("keepalive-period", 3*time.Minute, "TCP keep-alive period for accepted connections")
+	policyFile          = flag.String("policy-file", "", "Path to a JSON filter policy, reloaded on SIGHUP; if unset, the default policy is used")
+	policyCacheFile     = flag.String("policy-cache-file", "", "Path to keep a copy of the last good policy at, for the cache failure mode")
+	startupFailureMode  = flag.String("startup-failure-mode", string(proxy.DefaultFailureModes.Startup), "What to do if the policy can't be loaded at startup: deny requests, use the default policy, or use the cached policy")
+	reloadFailureMode   = flag.String("reload-failure-mode", string(proxy.DefaultFailureModes.Reload), "What to do if the policy can't be reloaded: deny requests, use the default policy, or keep the current policy (cache)")
+	identityFailureMode = flag.String("identity-failure-mode", string(proxy.DefaultFailureModes.Identity), "What to do if the pod resolver isn't synced: deny requests, use the top-level policy rather than the namespace's (default), or use the last known pod for the client's IP (cache)")
+	upstreamFailureMode = flag.String("upstream-failure-mode", string(proxy.DefaultFailureModes.Upstream), "What to do if the metadata server can't be reached or fails: deny requests, or serve the last good response (cache)")
+	kubeletURL          = flag.String("kubelet-url", "", "URL of the kubelet's /pods endpoint, used to apply per-namespace policies; if unset, the top-level policy applies to every request")
+	kubeletTokenFile    = flag.String("kubelet-token-file", "", "Path to a bearer token for the kubelet API")
+	kubeletCAFile       = flag.String("kubelet-ca-file", "", "Path to the CA certificates for the kubelet API")
+	podResyncInterval   = flag.Duration("pod-resync-interval", 10*time.Second, "How often to poll the kubelet for the pods on the node")
+	transparent         = flag.Bool("transparent", false, "Only serve connections redirected to --addr by netfilter whose original destination is in --transparent-destinations")
+	transparentDsts     = flag.String("transparent-destinations", "169.254.169.254:80", "Comma-separated IP addresses, with optional ports, that redirected connections may originally have been bound for")
+	manageRules         = flag.Bool("manage-rules", false, "Install iptables rules redirecting connections bound for --transparent-destinations to --addr, and keep them in place")
+	reconcileInterval   = flag.Duration("rules-reconcile-interval", 30*time.Second, "How often to check that the rules installed by --manage-rules are still in place")
+	unixSocket          = flag.String("unix-socket", "", "Path of a unix socket to also listen and proxy at, for host processes; its clients are identified by their uid and cgroup")
+	unixSocketMode      = flag.String("unix-socket-mode", "0666", "Permissions of the socket at --unix-socket, in octal")
+	resolveLoopback     = flag.Bool("resolve-loopback-clients", false, "Identify clients connecting over loopback, such as host network pods, by the uid and cgroup of the process owning their socket, found in --proc-root")
+	procRoot            = flag.String("proc-root", "/proc", "Path of the host's proc filesystem, used to identify unix socket and loopback clients")
+	apiServerURL        = flag.String("apiserver-url", "", "URL of the Kubernetes API server, used to review the service account tokens required by token rules")
+	apiServerTokenFile  = flag.String("apiserver-token-file", "", "Path to a bearer token for the API server, allowed to create TokenReviews")
+	apiServerCAFile     = flag.String("apiserver-ca-file", "", "Path to the CA certificates for the API server")
+	tokenReviewCacheTTL = flag.Duration("token-review-cache-ttl", 10*time.Second, "How long to trust a token after the API server has reviewed it")
+	tokenJWKSFile       = flag.String("token-jwks-file", "", "Path to the API server's service account signing keys, as a JSON Web Key Set, to verify tokens with locally instead of with --apiserver-url")
+	tokenIssuer         = flag.String("token-issuer", "", "Issuer that tokens verified with --token-jwks-file must have, if set")
+	tokenAudiences      = flag.String("token-audiences", "k8s-metadata-proxy", "Comma-separated audiences that service account tokens must be for")
+	extAuthzURL         = flag.String("ext-authz-url", "", "URL of an external authorization service to check requests the policy allows with: grpc://host:port for the Envoy ext_authz gRPC API, or an http(s) URL to POST its CheckRequests to as JSON")
+	extAuthzTimeout     = flag.Duration("ext-authz-timeout", time.Second, "Maximum duration of a check by the external authorization service")
+	extAuthzCacheTTL    = flag.Duration("ext-authz-cache-ttl", 10*time.Second, "How long to reuse the external authorization service's decision on a request; 0 disables caching")
+	extAuthzFailOpen    = flag.Bool("ext-authz-fail-open", false, "Allow requests the policy allows if the external authorization service can't be reached or fails, rather than refusing them")
+	serveExtAuthz       = flag.Bool("serve-ext-authz", false, "Serve the policy's decisions at --addr and --unix-socket over the Envoy ext_authz gRPC API, for an Envoy proxy to forward the allowed requests, instead of proxying them")
+	auditLog            = flag.String("audit-log", "", "Path to append audit events to as JSON, one per line, rather than logging them")
+	failClosed          = flag.Bool("fail-closed", true, "Leave the rules installed by --manage-rules in place when the proxy exits, so that the metadata server is unreachable rather than unfiltered until it's restarted")
+)
+
+func main() {
+	flag.Parse()
+
+	opts := proxy.Options{
+		MaxConnections:  *maxConnections,
+		ReadTimeout:     *readTimeout,
+		WriteTimeout:    *writeTimeout,
+		MaxWaitTimeout:  *maxWaitTimeout,
+		MaxHeaderBytes:  *maxHeaderBytes,
+		KeepAlivePeriod: *keepAlivePeriod,
+		UnixSocket:      *unixSocket,
+		ResolveLoopback: *resolveLoopback,
+		ProcRoot:        *procRoot,
+		Failure: proxy.FailureModes{
+			Startup:  proxy.FailureMode(*startupFailureMode),
+			Reload:   proxy.FailureMode(*reloadFailureMode),
+			Identity: proxy.FailureMode(*identityFailureMode),
+			Upstream: proxy.FailureMode(*upstreamFailureMode),
+		},
+	}
+	if *transparent {
+		dsts, err := proxy.ParseDestinations(*transparentDsts)
+		if err != nil {
+			log.Fatalf("Invalid transparent destinations: %v", err)
+		}
+		opts.OriginalDsts = dsts
+	}
+	mode, err := strconv.ParseUint(*unixSocketMode, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		log.Fatalf("Invalid unix socket mode %q", *unixSocketMode)
+	}
+	opts.UnixSocketMode = os.FileMode(mode)
+	if opts.Listeners, err = proxy.ParseListeners(*addr, opts.MaxConnections); err != nil {
+		log.Fatalf("Invalid listen addresses: %v", err)
+	}
+
+	opts.Failure.Export()
+
+	// Until the policy file is loaded, there's no policy in effect.
+	if *policyFile == "" {
+		opts.Policy = metadata.DefaultPolicy()
+	}
+	if *kubeletURL != "" {
+		client, err := pods.NewAPIClient(*kubeletTokenFile, *kubeletCAFile, 10*time.Second)
+		if err != nil {
+			log.Fatalf("Invalid kubelet configuration: %v", err)
+		}
+		r := pods.NewKubeletResolver(*kubeletURL, client, *podResyncInterval)
+		go r.Run(nil)
+		opts.Resolver = r
+	}
+	audiences := strings.Split(*tokenAudiences, ",")
+	switch {
+	case *apiServerURL != "" && *tokenJWKSFile != "":
+		log.Fatalf("Only one of --apiserver-url and --token-jwks-file may be set")
+	case *apiServerURL != "":
+		client, err := pods.NewAPIClient(*apiServerTokenFile, *apiServerCAFile, 10*time.Second)
+		if err != nil {
+			log.Fatalf("Invalid API server configuration: %v", err)
+		}
+		opts.Verifier = tokens.NewTokenReviewer(*apiServerURL, client, audiences, *tokenReviewCacheTTL)
+	case *tokenJWKSFile != "":
+		keySet, err := ioutil.ReadFile(*tokenJWKSFile)
+		if err != nil {
+			log.Fatalf("Failed to read token signing keys: %v", err)
+		}
+		v, err := tokens.NewJWKSVerifier(keySet, *tokenIssuer, audiences)
+		if err != nil {
+			log.Fatalf("Invalid token signing keys: %v", err)
+		}
+		opts.Verifier = v
+	}
+	if *extAuthzURL != "" {
+		c, err := extauthz.NewClient(*extAuthzURL, *extAuthzTimeout, *extAuthzCacheTTL)
+		if err != nil {
+			log.Fatalf("Invalid external authorization configuration: %v", err)
+		}
+		opts.Authorizer, opts.AuthorizerFailOpen = c, *extAuthzFailOpen
+	}
+
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		opts.Auditor = proxy.NewJSONAuditor(f)
+	}
+
+	if *serveExtAuthz && (*transparent || *manageRules) {
+		log.Fatalf("--serve-ext-authz can't be used with --transparent or --manage-rules")
+	}
+	opts.UnencryptedHTTP2 = *serveExtAuthz
+
+	h, err := proxy.NewHandler(opts)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *policyFile != "" {
+		if err := h.LoadPolicy(*policyFile, *policyCacheFile); err != nil {
+			log.Printf("Failed to load policy, failure mode %s applies: %v", opts.Failure.Startup, err)
+		}
+		go reloadOnSignal(h, *policyFile, *policyCacheFile, opts.Failure.Reload)
+	}
+
+	if *manageRules {
+		dsts, err := proxy.ParseDestinations(*transparentDsts)
+		if err != nil {
+			log.Fatalf("Invalid transparent destinations: %v", err)
+		}
+		managers, err := newRuleManagers(dsts, opts.Listeners, *failClosed)
+		if err != nil {
+			log.Fatalf("Invalid redirect rules: %v", err)
+		}
+		for _, m := range managers {
+			if _, err := m.Reconcile(); err != nil {
+				log.Fatalf("Failed to install redirect rules: %v", err)
+			}
+			go m.Run(*reconcileInterval, nil)
+		}
+		go closeOnSignal(managers)
+	}
+
+	go func() {
+		err := http.ListenAndServe(*metricsAddr, promhttp.Handler())
+		log.Fatalf("Failed to start metrics: %v", err)
+	}()
+	var handler http.Handler = h
+	if *serveExtAuthz {
+		handler = proxy.NewAuthzHandler(h)
+	}
+	log.Fatal(proxy.NewServer(opts, handler).Run(context.Background()))
+}
+
+// reloadOnSignal reloads the policy file whenever the proxy gets SIGHUP.
+func reloadOnSignal(h *proxy.Handler, path, cachePath string, mode proxy.FailureMode) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := h.ReloadPolicy(path, cachePath); err != nil {
+			log.Printf("Failed to reload policy, failure mode %s applies: %v", mode, err)
+		} else {
+			log.Printf("Reloaded policy")
+		}
+	}
+}
+
+// newRuleManagers returns rule managers that redirect connections bound for
+// dsts to the proxy: one for IPv4 destinations and one for IPv6 ones, as
+// needed.  Each family's connections are redirected to the first listener
+// with a specific address in that family.  IPv6 connections can't be
+// redirected to a loopback address, since the kernel drops packets for ::1
+// arriving on other interfaces, and IPv6 has no route_localnet.
+func newRuleManagers(dsts []*net.TCPAddr, listeners []proxy.Listener, failClosed bool) ([]*netrules.Manager, error) {
+	targets := map[bool]*net.TCPAddr{}
+	for _, l := range listeners {
+		to, err := net.ResolveTCPAddr("tcp", l.Addr)
+		if err != nil || to.IP == nil || to.IP.IsUnspecified() {
+			continue
+		}
+		ipv6 := to.IP.To4() == nil
+		if ipv6 && to.IP.IsLoopback() {
+			continue
+		}
+		if targets[ipv6] == nil {
+			targets[ipv6] = to
+		}
+	}
+	managers := map[bool]*netrules.Manager{}
+	var ordered []*netrules.Manager
+	for _, d := range dsts {
+		ipv6 := d.IP.To4() == nil
+		to := targets[ipv6]
+		if to == nil {
+			return nil, fmt.Errorf("can't redirect %v: no listener has a specific address in its family, other than an IPv6 loopback address", d)
+		}
+		m := managers[ipv6]
+		if m == nil {
+			m = &netrules.Manager{Backend: netrules.NewIPTables(ipv6), FailClosed: failClosed}
+			managers[ipv6] = m
+			ordered = append(ordered, m)
+		}
+		m.Rules = append(m.Rules, netrules.Rule{Destination: d, RedirectTo: to})
+	}
+	return ordered, nil
+}
+
+// closeOnSignal closes the rule managers and exits when the proxy is asked
+// to stop.
+func closeOnSignal(managers []*netrules.Manager) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Stopping on %v", <-sig)
+	for _, m := range managers {
+		if err := m.Close(); err != nil {
+			log.Fatalf("Failed to remove redirect rules: %v", err)
+		}
+	}
+	os.Exit(0)
+}
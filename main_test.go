@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/proxy"
+)
+
+func TestNewRuleManagers(t *testing.T) {
+	t.Parallel()
+	dsts, err := proxy.ParseDestinations("169.254.169.254:80,[fd20:ce::254]:80,169.254.169.254:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := proxy.ParseListeners("[::]:988,127.0.0.1:988,[::1]:988,[fd00::1]:988,10.0.0.1:988", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managers, err := newRuleManagers(dsts, listeners, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var got []string
+	for _, m := range managers {
+		if !m.FailClosed {
+			t.Errorf("Got manager that doesn't fail closed, expected it to")
+		}
+		for _, r := range m.Rules {
+			got = append(got, r.String())
+		}
+		got = append(got, "|")
+	}
+	expect := []string{
+		"169.254.169.254:80 -> 127.0.0.1:988", "169.254.169.254:8080 -> 127.0.0.1:988", "|",
+		"[fd20:ce::254]:80 -> [fd00::1]:988", "|",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got rules %q, expected %q", got, expect)
+	}
+
+	for _, addrs := range []string{":988", "0.0.0.0:988", "[::]:988", "127.0.0.1:988", "127.0.0.1:988,[::1]:988"} {
+		listeners, err := proxy.ParseListeners(addrs, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newRuleManagers(dsts, listeners, true); err == nil {
+			t.Errorf("Got nil error redirecting to %q, expected an error", addrs)
+		}
+	}
+}
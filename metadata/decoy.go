@@ -0,0 +1,202 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Decoy serves fake content from an endpoint to the requests that would be
+// refused as concealed, or by a token rule or rule, so that callers probing
+// for credentials aren't told they've been noticed.  Its content should hold
+// canary credentials, whose use can be traced back to the caller.
+type Decoy struct {
+	// Path is a glob, as understood by path.Match, matched against the
+	// cleaned request path.
+	Path string `json:"path"`
+	// Template is a text/template for the content, executed with a
+	// DecoyData.  Builtin names a built-in template instead: "kube-env" or
+	// "identity".
+	Template string `json:"template,omitempty"`
+	Builtin  string `json:"builtin,omitempty"`
+	// ContentType is the Content-Type of the content, "application/text"
+	// by default, as the metadata server's.
+	ContentType string `json:"contentType,omitempty"`
+
+	tmpl *template.Template
+}
+
+// DecoyData is what a decoy's template is executed with.
+type DecoyData struct {
+	// Path is the cleaned path, and Query the first value of each query
+	// parameter.
+	Path  string
+	Query map[string]string
+	// Namespace, Pod and ServiceAccount describe the calling pod, if it's
+	// known.
+	Namespace      string
+	Pod            string
+	ServiceAccount string
+	// Canary identifies the content served, and is the same for every
+	// request from a caller to an endpoint.  The functions that make fake
+	// credentials derive them from it.
+	Canary string
+	Now    time.Time
+}
+
+// builtinDecoys are the built-in templates: a GKE node's kube-env with fake
+// certificates, and a Google-signed identity token with a fake signature.
+var builtinDecoys = map[string]string{
+	"kube-env": `ALLOCATE_NODE_CIDRS: "true"
+CA_CERT: {{b64 (pem "CERTIFICATE" (print "ca-" .Canary))}}
+CLUSTER_IP_RANGE: 10.4.0.0/14
+DNS_DOMAIN: cluster.local
+DNS_SERVER_IP: 10.8.0.10
+ENABLE_CLUSTER_DNS: "true"
+ENABLE_NODE_PROBLEM_DETECTOR: standalone
+KUBELET_CERT: {{b64 (pem "CERTIFICATE" (print "cert-" .Canary))}}
+KUBELET_KEY: {{b64 (pem "RSA PRIVATE KEY" (print "key-" .Canary))}}
+KUBERNETES_MASTER_NAME: 10.128.0.2
+NETWORK_PROVIDER: kubenet
+SERVICE_CLUSTER_IP_RANGE: 10.8.0.0/20
+`,
+	"identity": `{{jwt .Canary (dict "aud" (index .Query "audience") "azp" (digits .Canary 21) "exp" (add (unix .Now) 3600) "iat" (unix .Now) "iss" "https://accounts.google.com" "sub" (digits .Canary 21))}}`,
+}
+
+// decoyFuncs are the functions decoy templates can call.
+var decoyFuncs = template.FuncMap{
+	"b64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"pem": func(blockType, seed string) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: fakeBytes(seed, 600)}))
+	},
+	"jwt": func(seed string, claims map[string]interface{}) (string, error) {
+		header := map[string]string{
+			"alg": "RS256",
+			"kid": fmt.Sprintf("%x", fakeBytes("kid-"+seed, 20)),
+			"typ": "JWT",
+		}
+		var parts []string
+		for _, v := range []interface{}{header, claims} {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, base64.RawURLEncoding.EncodeToString(b))
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(fakeBytes("sig-"+seed, 256)))
+		return strings.Join(parts, "."), nil
+	},
+	"digits": func(seed string, n int) string {
+		b := fakeBytes("digits-"+seed, n)
+		for i := range b {
+			b[i] = '0' + b[i]%10
+		}
+		if b[0] == '0' {
+			b[0] = '1'
+		}
+		return string(b)
+	},
+	"dict": func(kv ...interface{}) (map[string]interface{}, error) {
+		if len(kv)%2 != 0 {
+			return nil, fmt.Errorf("dict needs pairs of keys and values")
+		}
+		m := map[string]interface{}{}
+		for i := 0; i < len(kv); i += 2 {
+			k, ok := kv[i].(string)
+			if !ok {
+				return nil, fmt.Errorf("dict key %v isn't a string", kv[i])
+			}
+			m[k] = kv[i+1]
+		}
+		return m, nil
+	},
+	"unix": func(t time.Time) int64 {
+		return t.Unix()
+	},
+	"add": func(a, b int64) int64 {
+		return a + b
+	},
+}
+
+// fakeBytes returns n bytes that look random, derived from seed.
+func fakeBytes(seed string, n int) []byte {
+	b := make([]byte, 0, n+sha256.Size)
+	var counter [8]byte
+	for i := uint64(0); len(b) < n; i++ {
+		binary.BigEndian.PutUint64(counter[:], i)
+		sum := sha256.Sum256(append([]byte(seed), counter[:]...))
+		b = append(b, sum[:]...)
+	}
+	return b[:n]
+}
+
+// parse parses the decoy's template.
+func (d *Decoy) parse() (*template.Template, error) {
+	src := d.Template
+	if d.Builtin != "" {
+		if d.Template != "" {
+			return nil, fmt.Errorf("only one of template and builtin may be set")
+		}
+		var ok bool
+		if src, ok = builtinDecoys[d.Builtin]; !ok {
+			return nil, fmt.Errorf("unknown builtin %q", d.Builtin)
+		}
+	} else if src == "" {
+		return nil, fmt.Errorf("one of template and builtin must be set")
+	}
+	return template.New(d.Path).Funcs(decoyFuncs).Option("missingkey=zero").Parse(src)
+}
+
+// Render returns the decoy's content for a request.
+func (d *Decoy) Render(data *DecoyData) ([]byte, error) {
+	// Decoys in policies that weren't loaded aren't parsed yet.
+	t := d.tmpl
+	if t == nil {
+		var err error
+		if t, err = d.parse(); err != nil {
+			return nil, err
+		}
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// validateDecoys returns an error if any decoy is malformed.
+func (p *Policy) validateDecoys() error {
+	for i := range p.Decoys {
+		d := &p.Decoys[i]
+		if _, err := path.Match(d.Path, ""); err != nil || d.Path == "" {
+			return fmt.Errorf("bad decoy path %q", d.Path)
+		}
+		t, err := d.parse()
+		if err != nil {
+			return fmt.Errorf("bad decoy for %q: %v", d.Path, err)
+		}
+		d.tmpl = t
+	}
+	return nil
+}
+
+// Decoy returns the first decoy matching the endpoint, or nil if there's
+// none.
+func (p *Policy) Decoy(cleanedPath string) *Decoy {
+	for i, d := range p.Decoys {
+		if ok, _ := path.Match(d.Path, cleanedPath); ok {
+			return &p.Decoys[i]
+		}
+	}
+	return nil
+}
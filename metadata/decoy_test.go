@@ -0,0 +1,140 @@
+package metadata_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+func TestParsePolicyDecoys(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		policy    string
+		expectErr bool
+	}{
+		{"builtin", `{"decoys": [{"path": "/computeMetadata/v1/instance/attributes/kube-env", "builtin": "kube-env"}]}`, false},
+		{"template", `{"decoys": [{"path": "/computeMetadata/v1/instance/attributes/*", "template": "{{.Canary}}"}]}`, false},
+		{"no path", `{"decoys": [{"builtin": "kube-env"}]}`, true},
+		{"bad path", `{"decoys": [{"path": "[", "builtin": "kube-env"}]}`, true},
+		{"unknown builtin", `{"decoys": [{"path": "/a", "builtin": "kubeconfig"}]}`, true},
+		{"both", `{"decoys": [{"path": "/a", "builtin": "kube-env", "template": "x"}]}`, true},
+		{"neither", `{"decoys": [{"path": "/a"}]}`, true},
+		{"bad template", `{"decoys": [{"path": "/a", "template": "{{.Canary"}]}`, true},
+		{"unknown function", `{"decoys": [{"path": "/a", "template": "{{secret .Canary}}"}]}`, true},
+		{"bad namespace decoy", `{"namespaces": {"ci": {"decoys": [{"path": "/a"}]}}}`, true},
+	}
+	for _, tc := range tests {
+		_, err := metadata.ParsePolicy([]byte(tc.policy))
+		if (err != nil) != tc.expectErr {
+			t.Errorf("%s: got error %v, expected error %v", tc.name, err, tc.expectErr)
+		}
+	}
+}
+
+func TestDecoyRender(t *testing.T) {
+	t.Parallel()
+	policy, err := metadata.ParsePolicy([]byte(`{
+		"decoys": [
+			{"path": "/computeMetadata/v1/instance/attributes/kube-env", "builtin": "kube-env"},
+			{"path": "/computeMetadata/v1/instance/service-accounts/*/identity", "builtin": "identity"},
+			{"path": "/computeMetadata/v1/instance/attributes/*", "template": "{{.Namespace}}/{{.Pod}} {{index .Query \"alt\"}} {{.Canary}}"}
+		],
+		"namespaces": {"ci": {}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &metadata.DecoyData{
+		Path:      "/computeMetadata/v1/instance/attributes/kube-env",
+		Query:     map[string]string{"audience": "https://example.com", "alt": "text"},
+		Namespace: "ci",
+		Pod:       "runner-1",
+		Canary:    "0123abcd",
+		Now:       time.Unix(1700000000, 0),
+	}
+
+	if d := policy.Decoy("/computeMetadata/v1/instance/id"); d != nil {
+		t.Errorf("Got decoy %+v for instance/id, expected none", d)
+	}
+
+	kubeEnv := policy.Decoy(data.Path)
+	if kubeEnv == nil || kubeEnv.Builtin != "kube-env" {
+		t.Fatalf("Got decoy %+v for kube-env, expected the kube-env builtin", kubeEnv)
+	}
+	b, err := kubeEnv.Render(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		kv := strings.SplitN(line, ": ", 2)
+		if len(kv) != 2 {
+			t.Fatalf("Got kube-env line %q, expected key: value", line)
+		}
+		if strings.HasPrefix(kv[0], "KUBELET_") || kv[0] == "CA_CERT" {
+			certs[kv[0]] = kv[1]
+		}
+	}
+	if len(certs) != 3 {
+		t.Errorf("Got certificates %q, expected CA_CERT, KUBELET_CERT and KUBELET_KEY", certs)
+	}
+	for k, v := range certs {
+		p, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			t.Errorf("%s: %v", k, err)
+			continue
+		}
+		if block, _ := pem.Decode(p); block == nil {
+			t.Errorf("%s: got %q, expected a PEM block", k, p)
+		}
+	}
+	if again, _ := kubeEnv.Render(data); string(again) != string(b) {
+		t.Errorf("Got kube-env %q, then %q, expected the same for the same canary", b, again)
+	}
+
+	identity := policy.Decoy("/computeMetadata/v1/instance/service-accounts/default/identity")
+	if identity == nil {
+		t.Fatal("Got no decoy for identity, expected the identity builtin")
+	}
+	b, err = identity.Render(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(string(b), ".")
+	if len(parts) != 3 {
+		t.Fatalf("Got identity %q, expected a JWT", b)
+	}
+	p, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+	}
+	if err := json.Unmarshal(p, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Aud != "https://example.com" || claims.Exp != 1700003600 {
+		t.Errorf("Got claims %+v, expected the audience requested, expiring in an hour", claims)
+	}
+
+	// Namespace policies are derived from the top-level policy.
+	custom := policy.ForNamespace("ci").Decoy("/computeMetadata/v1/instance/attributes/cluster-name")
+	if custom == nil {
+		t.Fatal("Got no decoy for cluster-name in ci, expected the template")
+	}
+	b, err = custom.Render(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "ci/runner-1 text 0123abcd"; string(b) != expect {
+		t.Errorf("Got %q, expected %q", b, expect)
+	}
+}
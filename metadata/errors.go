@@ -0,0 +1,64 @@
+package metadata
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Reasons given by FilterError for rejecting a request.
+const (
+	ReasonForwardedFor           = "x_forwarded_for"
+	ReasonUnparseable            = "unparseable"
+	ReasonHostNotAllowed         = "host_not_allowed"
+	ReasonAmbiguousEncoding      = "ambiguous_encoding"
+	ReasonMissingMetadataFlavor  = "missing_metadata_flavor"
+	ReasonLegacyHeader           = "legacy_header"
+	ReasonMethodNotAllowed       = "method_not_allowed"
+	ReasonBodyNotAllowed         = "body_not_allowed"
+	ReasonUnknownQueryParameter  = "unknown_query_parameter"
+	ReasonRepeatedQueryParameter = "repeated_query_parameter"
+	ReasonInvalidQueryValue      = "invalid_query_value"
+	ReasonRecursive              = "recursive"
+	ReasonConcealed              = "concealed"
+	ReasonUnknownAPI             = "unknown_api"
+	ReasonRuleDenied             = "rule_denied"
+	ReasonRuleError              = "rule_error"
+)
+
+// FilterError is the error returned by Filter when it rejects a request.
+type FilterError struct {
+	// Code is the HTTP status code to respond with.
+	Code int
+	// Reason is a short, fixed identifier for why the request was
+	// rejected, suitable for use as a metric label.
+	Reason string
+	// Allow lists the methods allowed on the endpoint, for 405 Method Not
+	// Allowed responses.
+	Allow []string
+	// Path is the cleaned path of requests refused as concealed.
+	Path string
+	// BlockedResponse is the blocked response of the rule that refused the
+	// request, if it has one.
+	BlockedResponse string
+
+	msg string
+}
+
+func (e *FilterError) Error() string {
+	return e.msg
+}
+
+// reject returns a FilterError with the given code, reason and formatted
+// message.
+func reject(code int, reason, format string, a ...interface{}) *FilterError {
+	return &FilterError{
+		Code:   code,
+		Reason: reason,
+		msg:    fmt.Sprintf(format, a...),
+	}
+}
+
+// forbidden returns a FilterError for a 403 Forbidden response.
+func forbidden(reason, format string, a ...interface{}) *FilterError {
+	return reject(http.StatusForbidden, reason, format, a...)
+}
@@ -0,0 +1,100 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// kubeEnvKeyPattern matches the keys of kube-env entries, which start lines
+// as "KEY:".
+var kubeEnvKeyPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_.-]*):(?: |$)`)
+
+// isKubeEnv returns whether the cleaned path is the kube-env instance
+// attribute, ignoring case as Concealed does.
+func isKubeEnv(cleanedPath string) bool {
+	name, ok := attributeName(instanceAttributeDirs, cleanedPath)
+	return ok && strings.EqualFold(name, "kube-env") && strings.HasSuffix(strings.ToLower(cleanedPath), "/kube-env")
+}
+
+// NeedsKubeEnvFilter returns whether the cleaned path is the kube-env
+// instance attribute and the policy allows some of its keys, so that the
+// response has to be passed through FilterKubeEnv.  Such requests aren't
+// refused as concealed.
+func (p *Policy) NeedsKubeEnvFilter(cleanedPath string) bool {
+	return len(p.AllowedKubeEnvKeys.Globs)+len(p.AllowedKubeEnvKeys.Regexps) > 0 && isKubeEnv(cleanedPath)
+}
+
+// FilterKubeEnv removes the entries whose keys the policy doesn't allow from
+// body, the kube-env instance attribute, and returns what's left in the same
+// format.  The attribute is a YAML map from keys to scalars, served as is for
+// alt "text" and as a JSON string for alt "json".
+//
+// Rather than being decoded, the YAML is split into entries at the lines
+// starting with "KEY:", with the indented and blank lines that follow each
+// one, so the entries kept are returned unchanged.  Anything else, such as a
+// document marker or a top-level list, is an error, since it can't be split
+// safely.
+func (p *Policy) FilterKubeEnv(body []byte, alt string) ([]byte, error) {
+	switch alt {
+	case "text":
+		return p.filterKubeEnv(body)
+	case "json":
+		var s string
+		if err := json.Unmarshal(body, &s); err != nil {
+			return nil, fmt.Errorf("failed to parse kube-env: %v", err)
+		}
+		kept, err := p.filterKubeEnv([]byte(s))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(string(kept)); err != nil {
+			return nil, err
+		}
+		buf.Truncate(buf.Len() - 1)
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown response format %q", alt)
+	}
+}
+
+// filterKubeEnv filters the YAML of kube-env.
+func (p *Policy) filterKubeEnv(body []byte) ([]byte, error) {
+	var kept bytes.Buffer
+	seen := map[string]bool{}
+	keep := false
+	for i, line := range strings.SplitAfter(string(body), "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			continue
+		case trimmed == "" || trimmed[0] == ' ':
+			// Blank and indented lines continue the entry before.
+			if i == 0 {
+				return nil, fmt.Errorf("failed to parse kube-env: line 1 is indented")
+			}
+		case trimmed[0] == '#':
+			keep = false
+			continue
+		default:
+			m := kubeEnvKeyPattern.FindStringSubmatch(trimmed)
+			if m == nil {
+				return nil, fmt.Errorf("failed to parse kube-env: line %d isn't a key", i+1)
+			}
+			if seen[m[1]] {
+				return nil, fmt.Errorf("failed to parse kube-env: duplicate key %q", m[1])
+			}
+			seen[m[1]] = true
+			keep = p.AllowedKubeEnvKeys.matches(m[1])
+		}
+		if keep {
+			kept.WriteString(line)
+		}
+	}
+	return kept.Bytes(), nil
+}
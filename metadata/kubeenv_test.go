@@ -0,0 +1,124 @@
+package metadata_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+const kubeEnv = `ALLOCATE_NODE_CIDRS: "true"
+CA_CERT: LS0tLS1CRUdJTi...
+# Cluster
+CLUSTER_NAME: prod
+KUBELET_ARGS: >-
+  --v=2
+  --cloud-provider=gce
+
+KUBERNETES_MASTER_NAME: 10.128.0.2
+`
+
+func TestFilterKubeEnv(t *testing.T) {
+	t.Parallel()
+	p := metadata.DefaultPolicy()
+	p.AllowedKubeEnvKeys = metadata.NameMatcher{Globs: []string{"CLUSTER_NAME", "KUBELET_*"}, Regexps: []string{"kubernetes_master_.*"}}
+
+	tests := []struct {
+		name       string
+		body       string
+		alt        string
+		expectBody string
+		expectErr  bool
+	}{
+		{"text", kubeEnv, "text", "CLUSTER_NAME: prod\nKUBELET_ARGS: >-\n  --v=2\n  --cloud-provider=gce\n\nKUBERNETES_MASTER_NAME: 10.128.0.2\n", false},
+		{"json", `"CA_CERT: x\nCLUSTER_NAME: <prod>\n"`, "json", `"CLUSTER_NAME: <prod>\n"`, false},
+		{"crlf", "CA_CERT: x\r\nCLUSTER_NAME: prod\r\n", "text", "CLUSTER_NAME: prod\r\n", false},
+		{"no newline", "CLUSTER_NAME: prod", "text", "CLUSTER_NAME: prod", false},
+		{"empty", "", "text", "", false},
+		{"indented first line", "  CLUSTER_NAME: prod\n", "text", "", true},
+		{"document marker", "---\nCLUSTER_NAME: prod\n", "text", "", true},
+		{"list", "- CLUSTER_NAME: prod\n", "text", "", true},
+		{"quoted key", "\"CLUSTER_NAME\": prod\n", "text", "", true},
+		{"no space", "CLUSTER_NAME:prod\n", "text", "", true},
+		{"tab indent", "KUBELET_ARGS: >-\n\t--v=2\n", "text", "", true},
+		{"duplicate", "CLUSTER_NAME: prod\nCLUSTER_NAME: dev\n", "text", "", true},
+		{"bad json", `CLUSTER_NAME: prod`, "json", "", true},
+		{"unknown alt", kubeEnv, "yaml", "", true},
+	}
+	for _, tc := range tests {
+		got, err := p.FilterKubeEnv([]byte(tc.body), tc.alt)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("%s: got error %v, expected error %v", tc.name, err, tc.expectErr)
+			continue
+		}
+		if string(got) != tc.expectBody {
+			t.Errorf("%s: got %q, expected %q", tc.name, got, tc.expectBody)
+		}
+	}
+}
+
+func TestFilterKubeEnvRequests(t *testing.T) {
+	t.Parallel()
+	allowed := metadata.DefaultPolicy()
+	allowed.AllowedKubeEnvKeys.Globs = []string{"CLUSTER_NAME"}
+	allowed.RecursiveMode = metadata.RecursiveRedact
+
+	tests := []struct {
+		name         string
+		policy       *metadata.Policy
+		url          string
+		expectFilter bool
+		expectReason string
+	}{
+		{"concealed", metadata.DefaultPolicy(), "/computeMetadata/v1/instance/attributes/kube-env", false, metadata.ReasonConcealed},
+		{"allowed", allowed, "/computeMetadata/v1/instance/attributes/kube-env", true, ""},
+		{"v1beta1", allowed, "/computeMetadata/v1beta1/instance/attributes/kube-env", true, ""},
+		{"case", allowed, "/computeMetadata/v1/instance/attributes/Kube-Env", true, ""},
+		{"0.1", allowed, "/0.1/meta-data/attributes/kube-env", true, ""},
+		{"recursive", allowed, "/computeMetadata/v1/instance/attributes/kube-env?recursive=true", true, metadata.ReasonConcealed},
+		{"subpath", allowed, "/computeMetadata/v1/instance/attributes/kube-env/x", false, metadata.ReasonConcealed},
+		{"project attribute", allowed, "/computeMetadata/v1/project/attributes/kube-env", false, ""},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", "http://metadata.google.internal"+tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		cleanedPath, err := tc.policy.Filter(req)
+		reason := ""
+		if err != nil {
+			reason = err.(*metadata.FilterError).Reason
+		}
+		if reason != tc.expectReason {
+			t.Errorf("%s: got reason %q, expected %q", tc.name, reason, tc.expectReason)
+		}
+		if got := tc.policy.NeedsKubeEnvFilter(req.URL.Path); got != tc.expectFilter {
+			t.Errorf("%s: got NeedsKubeEnvFilter %v, expected %v", tc.name, got, tc.expectFilter)
+		}
+		if err == nil && cleanedPath != req.URL.Path {
+			t.Errorf("%s: got cleaned path %q, expected %q", tc.name, cleanedPath, req.URL.Path)
+		}
+	}
+}
+
+func TestParsePolicyAllowedKubeEnvKeys(t *testing.T) {
+	t.Parallel()
+	p, err := metadata.ParsePolicy([]byte(`{
+		"allowedKubeEnvKeys": {"globs": ["CLUSTER_NAME"]},
+		"namespaces": {"locked": {"allowedKubeEnvKeys": {"globs": []}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const path = "/computeMetadata/v1/instance/attributes/kube-env"
+	if !p.NeedsKubeEnvFilter(path) {
+		t.Errorf("Got kube-env unfiltered, expected it filtered")
+	}
+	if p.ForNamespace("locked").NeedsKubeEnvFilter(path) {
+		t.Errorf("Got kube-env filtered in locked, expected it concealed")
+	}
+	if _, err := metadata.ParsePolicy([]byte(`{"allowedKubeEnvKeys": {"regexps": ["("]}}`)); err == nil {
+		t.Errorf("Got nil error parsing a bad regexp, expected an error")
+	}
+}
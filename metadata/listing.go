@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// NeedsListingFilter returns whether the response to an allowed request for
+// the cleaned path with the given query is a directory listing that has to be
+// passed through FilterListing.
+//
+// Directories are recognized by their trailing slash; the metadata server
+// redirects requests for directories without one.  Listings in unknown API
+// versions aren't filtered, since nothing in them is concealed.
+func (p *Policy) NeedsListingFilter(cleanedPath string, query url.Values) bool {
+	if query["recursive"] != nil || !strings.HasSuffix(cleanedPath, "/") {
+		return false
+	}
+	for _, prefix := range knownPrefixes {
+		if strings.HasPrefix(cleanedPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterListing removes the concealed entries from body, a listing of the
+// directory at the cleaned path, and returns what's left in the same format.
+// Listings are newline-separated names for alt "text", and for alt "json"
+// either an array of names or an object keyed by name.  The names of
+// subdirectories end in a slash.
+func (p *Policy) FilterListing(cleanedPath string, body []byte, alt string) ([]byte, error) {
+	switch alt {
+	case "text":
+		var kept []string
+		for _, entry := range strings.SplitAfter(string(body), "\n") {
+			if entry == "" || p.Concealed(cleanedPath+strings.TrimSuffix(entry, "\n")) {
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		return []byte(strings.Join(kept, "")), nil
+	case "json":
+		var listing interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&listing); err != nil {
+			return nil, fmt.Errorf("failed to parse directory listing: %v", err)
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, fmt.Errorf("failed to parse directory listing: trailing data")
+		}
+		var kept interface{}
+		switch listing := listing.(type) {
+		case []interface{}:
+			entries := []interface{}{}
+			for _, entry := range listing {
+				name, ok := entry.(string)
+				if !ok {
+					return nil, fmt.Errorf("failed to parse directory listing: entry %v isn't a name", entry)
+				}
+				if !p.Concealed(cleanedPath + name) {
+					entries = append(entries, name)
+				}
+			}
+			kept = entries
+		case map[string]interface{}:
+			for name := range listing {
+				if p.Concealed(cleanedPath+name) || p.Concealed(cleanedPath+name+"/") {
+					delete(listing, name)
+				}
+			}
+			kept = listing
+		default:
+			return nil, fmt.Errorf("failed to parse directory listing: unexpected %T", listing)
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(kept); err != nil {
+			return nil, err
+		}
+		buf.Truncate(buf.Len() - 1)
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown response format %q", alt)
+	}
+}
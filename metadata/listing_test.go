@@ -0,0 +1,78 @@
+package metadata_test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+func TestNeedsListingFilter(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		path   string
+		query  url.Values
+		expect bool
+	}{
+		{"/computeMetadata/v1/instance/attributes/", url.Values{}, true},
+		{"/computeMetadata/v1/project/attributes/", url.Values{"alt": {"json"}}, true},
+		{"/0.1/meta-data/attributes/", url.Values{}, true},
+		{"/computeMetadata/v1/instance/attributes/", url.Values{"recursive": {"true"}}, false},
+		{"/computeMetadata/v1/instance/attributes/cluster-name", url.Values{}, false},
+		{"/computeMetadata/v1/instance/", url.Values{}, true},
+		{"/computeMetadata/v1/instance/service-accounts/default/", url.Values{"wait_for_change": {"true"}}, true},
+		{"/computeMetadata/v1/instance", url.Values{}, false},
+		{"/computeMetadata/v2/instance/", url.Values{}, false},
+		{"/computeMetadata/", url.Values{}, false},
+	}
+	p := metadata.DefaultPolicy()
+	for _, tc := range tests {
+		if got := p.NeedsListingFilter(tc.path, tc.query); got != tc.expect {
+			t.Errorf("%s?%s: got %t, expected %t", tc.path, tc.query.Encode(), got, tc.expect)
+		}
+	}
+}
+
+func TestFilterListing(t *testing.T) {
+	t.Parallel()
+	p := metadata.DefaultPolicy()
+	p.ConcealedInstanceAttributes.Globs = append(p.ConcealedInstanceAttributes.Globs, "ssh-keys")
+	p.ConcealedProjectAttributes.Globs = []string{"secret-*"}
+
+	tests := []struct {
+		path   string
+		body   string
+		alt    string
+		expect string
+	}{
+		{"/computeMetadata/v1/instance/attributes/", "cluster-name\nkube-env\nssh-keys\n", "text", "cluster-name\n"},
+		{"/computeMetadata/v1/instance/attributes/", "kube-env\ncluster-name", "text", "cluster-name"},
+		{"/computeMetadata/v1/instance/attributes/", "kube-env\n", "text", ""},
+		{"/0.1/meta-data/attributes/", "kube-env\nfoo\n", "text", "foo\n"},
+		{"/computeMetadata/v1/project/attributes/", "secret-a\nkube-env\n", "text", "kube-env\n"},
+		{"/computeMetadata/v1/instance/attributes/", `["cluster-name","kube-env","ssh-keys"]`, "json", `["cluster-name"]`},
+		{"/computeMetadata/v1/instance/attributes/", `["kube-env"]`, "json", `[]`},
+		{"/computeMetadata/v1/instance/attributes/", `{"cluster-name":"c","kube-env":"secret"}`, "json", `{"cluster-name":"c"}`},
+		// Service account identities.
+		{"/computeMetadata/v1/instance/service-accounts/default/", "aliases\nemail\nidentity\nscopes\ntoken\n", "text", "aliases\nemail\nscopes\ntoken\n"},
+		{"/computeMetadata/v1beta1/instance/service-accounts/default/", `["aliases","identity","token"]`, "json", `["aliases","token"]`},
+		{"/0.1/meta-data/service-accounts/default/", "identity\nacquire\n", "text", "acquire\n"},
+		// Subdirectories.
+		{"/computeMetadata/v1/instance/", "attributes/\nhostname\nservice-accounts/\n", "text", "attributes/\nhostname\nservice-accounts/\n"},
+		{"/computeMetadata/v1/instance/service-accounts/default/", "identity/\nemail\n", "text", "email\n"},
+	}
+	for _, tc := range tests {
+		got, err := p.FilterListing(tc.path, []byte(tc.body), tc.alt)
+		if err != nil {
+			t.Errorf("%s %q: unexpected error %v", tc.path, tc.body, err)
+		} else if string(got) != tc.expect {
+			t.Errorf("%s %q: got %q, expected %q", tc.path, tc.body, got, tc.expect)
+		}
+	}
+
+	for _, body := range []string{"kube-env\n", `"kube-env"`, `[1, "kube-env"]`, `[] ["kube-env"]`} {
+		if got, err := p.FilterListing("/computeMetadata/v1/instance/attributes/", []byte(body), "json"); err == nil {
+			t.Errorf("Got %q for unparseable JSON listing %q, expected an error", got, body)
+		}
+	}
+}
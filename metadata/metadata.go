@@ -1,24 +1,30 @@
 package metadata
 
 import (
-	"errors"
-	"fmt"
 	"net/http"
+	"net/url"
 	"path"
 	"regexp"
 	"strings"
 )
 
 var (
-	concealedEndpoints = []string{
-		"/0.1/meta-data/attributes/kube-env",
-		"/computeMetadata/v1beta1/instance/attributes/kube-env",
-		"/computeMetadata/v1/instance/attributes/kube-env",
+	// instanceAttributeDirs and projectAttributeDirs are the directories
+	// holding instance and project attributes in known API versions.
+	instanceAttributeDirs = []string{
+		"/0.1/meta-data/attributes/",
+		"/computeMetadata/v1beta1/instance/attributes/",
+		"/computeMetadata/v1/instance/attributes/",
+	}
+	projectAttributeDirs = []string{
+		"/0.1/meta-data/project/attributes/",
+		"/computeMetadata/v1beta1/project/attributes/",
+		"/computeMetadata/v1/project/attributes/",
 	}
 	concealedPatterns = []*regexp.Regexp{
-		regexp.MustCompile("/0.1/meta-data/service-accounts/.+/identity"),
-		regexp.MustCompile("/computeMetadata/v1beta1/instance/service-accounts/.+/identity"),
-		regexp.MustCompile("/computeMetadata/v1/instance/service-accounts/.+/identity"),
+		regexp.MustCompile("(?i)/0.1/meta-data/service-accounts/.+/identity"),
+		regexp.MustCompile("(?i)/computeMetadata/v1beta1/instance/service-accounts/.+/identity"),
+		regexp.MustCompile("(?i)/computeMetadata/v1/instance/service-accounts/.+/identity"),
 	}
 	recursiveWhitelistPatterns = []*regexp.Regexp{
 		// ?recursive=true on the instance service account metadata returns
@@ -45,24 +51,6 @@ var (
 		"/computeMetadata/v1beta1/",
 		"/computeMetadata/v1/",
 	}
-	knownQueryParameterKey = map[string]bool{
-		// Common metadata retrieval params.
-		"recursive":       true,
-		"alt":             true,
-		"wait_for_change": true,
-		"timeout_sec":     true,
-		"last_etag":       true,
-
-		// Legacy auth token requests.
-		"service_account": true,
-		"scope":           true,
-		"scopes":          true,
-
-		// Identity Signing, blocked via path.
-		"audience": true,
-		"licenses": true,
-		"format":   true,
-	}
 )
 
 // whitelistedRecursiveEndpoint returns whether or not the given path
@@ -76,19 +64,107 @@ func whitelistedRecursiveEndpoint(path string) bool {
 	return false
 }
 
-// Filter returns a cleaned path if the request ought to be allowed, or an
-// error if not.
+// Concealed returns whether the given cleaned path is concealed.
+//
+// Attributes named by the policy and vm identity endpoints are concealed for
+// known API versions.  Unknown API versions aren't, since we don't know if
+// they have the same paths.  Paths are compared case-insensitively, in case
+// the metadata server treats them that way.
+func (p *Policy) Concealed(cleanedPath string) bool {
+	if name, ok := attributeName(instanceAttributeDirs, cleanedPath); ok && p.ConcealedInstanceAttributes.matches(name) {
+		return true
+	}
+	if name, ok := attributeName(projectAttributeDirs, cleanedPath); ok && p.ConcealedProjectAttributes.matches(name) {
+		return true
+	}
+	for _, pattern := range concealedPatterns {
+		if pattern.MatchString(cleanedPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// attributeName returns the name of the attribute at the cleaned path, if
+// it's in one of the given attribute directories, ignoring case.
+func attributeName(dirs []string, cleanedPath string) (string, bool) {
+	for _, dir := range dirs {
+		if len(cleanedPath) >= len(dir) && strings.EqualFold(cleanedPath[:len(dir)], dir) {
+			name := strings.SplitN(cleanedPath[len(dir):], "/", 2)[0]
+			return name, name != ""
+		}
+	}
+	return "", false
+}
+
+// ambiguousPathEscapes are escapes that decode to characters with special
+// meaning in paths, or that are themselves escaped.  Servers differ on
+// whether, and how many times, they decode these before routing.
+var ambiguousPathEscapes = []string{
+	"%2f", // /
+	"%2e", // .
+	"%5c", // \
+	"%25", // %
+	"%3b", // ;
+}
+
+// ambiguousPath returns whether u's path might be interpreted differently by
+// the metadata server than by Filter.  The path Filter checks is then
+// forwarded with RawPath cleared, so it's re-escaped canonically.
+func ambiguousPath(u *url.URL) bool {
+	escaped := strings.ToLower(u.EscapedPath())
+	for _, e := range ambiguousPathEscapes {
+		if strings.Contains(escaped, e) {
+			return true
+		}
+	}
+	if u.RawPath != "" {
+		if unescaped, err := url.PathUnescape(u.RawPath); err != nil || unescaped != u.Path {
+			return true
+		}
+	}
+	for _, c := range []byte(u.Path) {
+		// Semicolons start path parameters on some servers, and
+		// backslashes are separators on others.
+		if c == ';' || c == '\\' || c == '%' || c < 0x20 || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPolicy is the policy used by Filter.
+var defaultPolicy = DefaultPolicy()
+
+// Filter returns a cleaned path if the request ought to be allowed by the
+// default policy, or an error if not.
 func Filter(req *http.Request) (string, error) {
+	return defaultPolicy.Filter(req)
+}
+
+// Filter returns a cleaned path if the request ought to be allowed by the
+// policy, or an error if not.
+func (p *Policy) Filter(req *http.Request) (string, error) {
 	// Since we're stripping the X-Forwarded-For header that's added by
 	// httputil.ReverseProxy.ServeHTTP, check for the header here and
 	// refuse to serve if it's present.
 	if _, ok := req.Header["X-Forwarded-For"]; ok {
-		return "", errors.New("Calls with X-Forwarded-For header are not allowed by the metadata proxy")
+		return "", forbidden(ReasonForwardedFor, "Calls with X-Forwarded-For header are not allowed by the metadata proxy")
 	}
 
 	// Check that the request doesn't have any opaque parts.
 	if req.URL.Opaque != "" {
-		return "", errors.New("Metadata proxy could not safely parse request")
+		return "", forbidden(ReasonUnparseable, "Metadata proxy could not safely parse request")
+	}
+
+	if err := p.checkHost(req.Host); err != nil {
+		return "", err
+	}
+
+	// Check that the path means the same thing to us as to the metadata
+	// server, however it decodes it.
+	if ambiguousPath(req.URL) {
+		return "", forbidden(ReasonAmbiguousEncoding, "Metadata proxy could not unambiguously parse request path")
 	}
 
 	cleanedPath := path.Clean(req.URL.Path)
@@ -104,29 +180,42 @@ func Filter(req *http.Request) (string, error) {
 		cleanedPath += "/"
 	}
 
-	for key := range req.URL.Query() {
-		if !knownQueryParameterKey[key] {
-			return "", fmt.Errorf("Unrecognized query parameter key: %#q", key)
-		}
+	if err := p.checkHeaders(req.Header, cleanedPath); err != nil {
+		return "", err
+	}
+	if err := p.checkMethod(req, cleanedPath); err != nil {
+		return "", err
+	}
+
+	query, err := ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return "", forbidden(ReasonUnparseable, "Metadata proxy could not safely parse request")
+	}
+	if err := p.checkQueryKeys(query); err != nil {
+		return "", err
 	}
 
 	// Check that the request isn't a recursive one, or has been whitelisted.
-	if req.URL.Query()["recursive"] != nil && !whitelistedRecursiveEndpoint(cleanedPath) {
-		return "", errors.New("This metadata endpoint is concealed for ?recursive calls")
+	// Recursive responses that get redacted are safe anywhere.
+	if query["recursive"] != nil && p.RecursiveMode != RecursiveRedact && !whitelistedRecursiveEndpoint(cleanedPath) {
+		return "", forbidden(ReasonRecursive, "This metadata endpoint is concealed for ?recursive calls")
 	}
 
-	// Conceal kube-env and vm identity endpoints for known API versions.
-	// Don't block unknown API versions, since we don't know if they have
-	// the same paths.
-	for _, e := range concealedEndpoints {
-		if cleanedPath == e {
-			return "", errors.New("This metadata endpoint is concealed")
-		}
+	// The kube-env keys the policy allows are served even if it's
+	// concealed, but not to ?recursive calls, whose responses aren't
+	// filtered by key.
+	concealed := p.Concealed(cleanedPath)
+	if p.NeedsKubeEnvFilter(cleanedPath) {
+		concealed = query["recursive"] != nil
+	}
+	if concealed {
+		err := forbidden(ReasonConcealed, "This metadata endpoint is concealed")
+		err.Path = cleanedPath
+		return "", err
 	}
-	for _, p := range concealedPatterns {
-		if p.MatchString(cleanedPath) {
-			return "", errors.New("This metadata endpoint is concealed")
-		}
+
+	if err := p.checkQueryValues(query); err != nil {
+		return "", err
 	}
 
 	// Allow known discovery endpoints.
@@ -146,5 +235,5 @@ func Filter(req *http.Request) (string, error) {
 
 	// If none of the above checks match, this is an unknown API, so block
 	// it.
-	return "", errors.New("This metadata API is not allowed by the metadata proxy")
+	return "", forbidden(ReasonUnknownAPI, "This metadata API is not allowed by the metadata proxy")
 }
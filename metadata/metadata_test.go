@@ -3,7 +3,10 @@ package metadata_test
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
@@ -91,6 +94,8 @@ func TestFilterURL(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Unexpected error creating request: %q", err)
 			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			req.Host = "metadata.google.internal"
 			cleanedPath, err := metadata.Filter(req)
 			if cleanedPath != tc.expectCleaned {
 				t.Errorf("Got cleaned path %q, expected %q", cleanedPath, tc.expectCleaned)
@@ -135,6 +140,7 @@ func TestFilterHeader(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Unexpected error creating request: %q", err)
 			}
+			req.Host = "metadata.google.internal"
 			for k, v := range tc.headers {
 				req.Header.Add(k, v)
 			}
@@ -151,3 +157,164 @@ func TestFilterHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestFilterMethod(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		method      string
+		url         string
+		body        string
+		expectCode  int
+		expectAllow []string
+	}{
+		{"GET", "/computeMetadata/v1/instance/id", "", 0, nil},
+		{"HEAD", "/computeMetadata/v1/instance/id", "", 0, nil},
+		{"PUT", "/computeMetadata/v1/instance/id", "", http.StatusMethodNotAllowed, []string{"GET", "HEAD"}},
+		{"POST", "/computeMetadata/v1/instance/id", "x", http.StatusMethodNotAllowed, []string{"GET", "HEAD"}},
+		{"DELETE", "/computeMetadata/v1/instance/attributes/foo", "", http.StatusMethodNotAllowed, []string{"GET", "HEAD"}},
+		{"GET", "/computeMetadata/v1/instance/id", "x", http.StatusBadRequest, nil},
+		// Legacy token acquisition.
+		{"POST", "/0.1/meta-data/service-accounts/default/acquire", "x", 0, nil},
+		{"PUT", "/0.1/meta-data/service-accounts/default/acquire", "", http.StatusMethodNotAllowed, []string{"GET", "HEAD", "POST"}},
+		{"POST", "/0.1/meta-data/service-accounts/default/nested/acquire", "", http.StatusMethodNotAllowed, []string{"GET", "HEAD"}},
+	}
+
+	for _, tc := range tests {
+		tc := tc // capture range variable
+		t.Run(tc.method+" "+tc.url, func(t *testing.T) {
+			t.Parallel()
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			req, err := http.NewRequest(tc.method, tc.url, body)
+			if err != nil {
+				t.Fatalf("Unexpected error creating request: %q", err)
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			req.Host = "metadata.google.internal"
+			_, err = metadata.Filter(req)
+			if tc.expectCode == 0 {
+				if err != nil {
+					t.Errorf("Got %q, expected nil error", err)
+				}
+				return
+			}
+			ferr, ok := err.(*metadata.FilterError)
+			if !ok {
+				t.Fatalf("Got %#v, expected a *metadata.FilterError", err)
+			}
+			if ferr.Code != tc.expectCode {
+				t.Errorf("Got code %d, expected %d", ferr.Code, tc.expectCode)
+			}
+			if !reflect.DeepEqual(ferr.Allow, tc.expectAllow) {
+				t.Errorf("Got allowed methods %v, expected %v", ferr.Allow, tc.expectAllow)
+			}
+		})
+	}
+}
+
+func TestFilterConcealedAttributes(t *testing.T) {
+	t.Parallel()
+	p := metadata.DefaultPolicy()
+	p.ConcealedInstanceAttributes = metadata.NameMatcher{
+		Globs:   []string{"kube-env", "startup-script*", "user-data"},
+		Regexps: []string{"ssh-?keys"},
+	}
+	p.ConcealedProjectAttributes = metadata.NameMatcher{
+		Globs: []string{"*"},
+	}
+
+	tests := []struct {
+		url       string
+		expectErr error
+	}{
+		{"/computeMetadata/v1/instance/attributes/kube-env", concealedErr},
+		{"/computeMetadata/v1/instance/attributes/startup-script", concealedErr},
+		{"/computeMetadata/v1/instance/attributes/startup-script-url", concealedErr},
+		{"/computeMetadata/v1beta1/instance/attributes/user-data", concealedErr},
+		{"/0.1/meta-data/attributes/user-data", concealedErr},
+		{"/computeMetadata/v1/instance/attributes/ssh-keys", concealedErr},
+		{"/computeMetadata/v1/instance/attributes/sshKeys", concealedErr},
+		{"/computeMetadata/v1/instance/attributes/sshkeys", concealedErr},
+		{"/computeMetadata/v1/instance/attributes/my-ssh-keys", nil},
+		{"/computeMetadata/v1/instance/attributes/cluster-name", nil},
+		{"/computeMetadata/v1/instance/attributes/", nil},
+		{"/computeMetadata/v1/instance/attributes/user-data/", concealedErr},
+		{"/computeMetadata/v1/project/attributes/anything", concealedErr},
+		{"/computeMetadata/v1beta1/project/attributes/anything", concealedErr},
+		{"/computeMetadata/v1/project/attributes/", nil},
+		{"/computeMetadata/v1/project/project-id", nil},
+		// Unknown API versions are rejected outright.
+		{"/computeMetadata/v2/instance/attributes/user-data", apiNotAllowedErr},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error creating request: %q", err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		_, err = p.Filter(req)
+		if err == nil {
+			if tc.expectErr != nil {
+				t.Errorf("%s: got nil error, expected %q", tc.url, tc.expectErr)
+			}
+		} else if tc.expectErr == nil {
+			t.Errorf("%s: got %q, expected nil error", tc.url, err)
+		} else if err.Error() != tc.expectErr.Error() {
+			t.Errorf("%s: got %q, expected %q", tc.url, err, tc.expectErr)
+		}
+	}
+}
+
+func TestFilterAmbiguousPath(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		url          string
+		expectReason string
+	}{
+		{"/computeMetadata/v1/instance/attributes%2Fkube-env", metadata.ReasonAmbiguousEncoding},
+		{"/computeMetadata/v1/instance/attributes%2fkube-env", metadata.ReasonAmbiguousEncoding},
+		{"/computeMetadata/v1/instance/attributes/%2E%2E/attributes/kube-env", metadata.ReasonAmbiguousEncoding},
+		{"/computeMetadata/v1/instance/attributes/%2e/kube-env", metadata.ReasonAmbiguousEncoding},
+		{"/computeMetadata/v1/instance/attributes/kube%252Denv", metadata.ReasonAmbiguousEncoding},
+		{"/computeMetadata/v1/instance/attributes/kube-env;x=y", metadata.ReasonAmbiguousEncoding},
+		{"/computeMetadata/v1/instance/attributes/kube-env%3Bx=y", metadata.ReasonAmbiguousEncoding},
+		{"/computeMetadata/v1/instance/attributes\\kube-env", metadata.ReasonAmbiguousEncoding},
+		{"/computeMetadata/v1/instance/attributes%5Ckube-env", metadata.ReasonAmbiguousEncoding},
+		{"/computeMetadata/v1/instance/attributes/kube-env%00", metadata.ReasonAmbiguousEncoding},
+		{"/computeMetadata/v1/instance/attributes/kube-env%0A", metadata.ReasonAmbiguousEncoding},
+		// Case variations are concealed.
+		{"/computeMetadata/v1/instance/attributes/KUBE-ENV", metadata.ReasonConcealed},
+		{"/computeMetadata/v1/Instance/Attributes/kube-env", metadata.ReasonConcealed},
+		{"/computeMetadata/v1/instance/service-accounts/default/Identity", metadata.ReasonConcealed},
+		// Unambiguous escapes are fine.
+		{"/computeMetadata/v1/instance/attributes/%6Bube-env", metadata.ReasonConcealed},
+		{"/computeMetadata/v1/instance/attributes/my%20attribute", ""},
+		{"/computeMetadata/v1/instance/service-accounts/default%40example.com/token", ""},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error creating request: %q", err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		_, err = metadata.Filter(req)
+		if tc.expectReason == "" {
+			if err != nil {
+				t.Errorf("%s: got %q, expected nil error", tc.url, err)
+			}
+			continue
+		}
+		ferr, ok := err.(*metadata.FilterError)
+		if !ok {
+			t.Errorf("%s: got %#v, expected a *metadata.FilterError", tc.url, err)
+		} else if ferr.Reason != tc.expectReason {
+			t.Errorf("%s: got reason %q, expected %q", tc.url, ferr.Reason, tc.expectReason)
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// hopByHopHeaders are headers that apply to a single connection and are never
+// forwarded, regardless of policy.  See RFC 7230, section 6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Policy configures the checks Filter makes on a request, and how requests
+// are rewritten before being forwarded to the metadata server.
+//
+// Policies are read from JSON; fields missing from the JSON keep the values
+// from DefaultPolicy.
+type Policy struct {
+	// RequireMetadataFlavor rejects calls to /computeMetadata/ endpoints
+	// that don't carry exactly one "Metadata-Flavor: Google" header.
+	RequireMetadataFlavor bool `json:"requireMetadataFlavor"`
+	// RejectLegacyMetadataRequestHeader rejects calls carrying the legacy
+	// X-Google-Metadata-Request header.
+	RejectLegacyMetadataRequestHeader bool `json:"rejectLegacyMetadataRequestHeader"`
+	// AllowedHosts lists the Host header values accepted, with or without a
+	// port.  Checking the Host defends against DNS rebinding, where a page in
+	// a browser on the node is tricked into sending requests to the proxy.
+	AllowedHosts []string `json:"allowedHosts"`
+	// AllowedHeaders lists the request headers that are forwarded to the
+	// metadata server.  Any other header, and any hop-by-hop header, is
+	// stripped.
+	AllowedHeaders []string `json:"allowedHeaders"`
+	// AllowedMethods lists the HTTP methods allowed on every endpoint.
+	AllowedMethods []string `json:"allowedMethods"`
+	// MethodRules allow additional methods on specific endpoints.
+	MethodRules []MethodRule `json:"methodRules"`
+	// TokenRules require a Kubernetes service account token for specific
+	// endpoints.  The proxy checks the token, since Filter can't.
+	TokenRules []TokenRule `json:"tokenRules"`
+	// Rules require requests to the endpoints they match to satisfy
+	// expressions over the request and the pod it comes from.  The proxy
+	// checks them with CheckRules, since Filter doesn't know the pod.
+	Rules []Rule `json:"rules"`
+	// RuleCostLimit bounds the cost of evaluating a rule for a request.
+	// Rules that exceed it deny the request.
+	RuleCostLimit int `json:"ruleCostLimit"`
+	// Decoys serve fake content to requests that would be refused as
+	// concealed, or by a token rule or rule.
+	Decoys []Decoy `json:"decoys"`
+	// QueryParameters maps each allowed query parameter key to the schema
+	// its value must match.  Keys in the JSON are added to, or replace, the
+	// default schemas.
+	QueryParameters map[string]QueryParameter `json:"queryParameters"`
+	// RecursiveMode is how ?recursive calls outside the recursive whitelist
+	// are handled: RecursiveBlock or RecursiveRedact.
+	RecursiveMode string `json:"recursiveMode"`
+	// BlockedResponse is how requests refused as concealed, unknown, or by
+	// a token rule or rule are responded to: BlockedMessage,
+	// BlockedNotFound, BlockedForbidden or BlockedJSON.  Token rules and
+	// rules can override it for the requests they refuse.
+	BlockedResponse string `json:"blockedResponse"`
+	// ConcealedInstanceAttributes and ConcealedProjectAttributes name the
+	// instance and project attributes that are concealed in every known API
+	// version, and hidden from listings of the attributes directories.
+	ConcealedInstanceAttributes NameMatcher `json:"concealedInstanceAttributes"`
+	ConcealedProjectAttributes  NameMatcher `json:"concealedProjectAttributes"`
+	// AllowedKubeEnvKeys name the keys of the kube-env instance attribute
+	// returned to requests for it.  If any are named, kube-env isn't
+	// concealed, but has every other key removed.  See FilterKubeEnv.
+	AllowedKubeEnvKeys NameMatcher `json:"allowedKubeEnvKeys"`
+	// Namespaces maps Kubernetes namespaces to the policies applied to
+	// requests from their pods, in place of this one.  In the JSON, each
+	// namespace's policy starts from this one rather than from
+	// DefaultPolicy, and can't have namespaces of its own.
+	Namespaces map[string]*Policy `json:"-"`
+	// Cgroups and UIDs map the cgroups, as path globs, and the user IDs of
+	// host processes to their policies, in the same way.  See ForCaller.
+	Cgroups map[string]*Policy `json:"-"`
+	UIDs    map[string]*Policy `json:"-"`
+}
+
+// Caller identifies where a request comes from, as far as it's known.
+type Caller struct {
+	// Namespace is the namespace of the calling pod, or "" if the caller
+	// isn't known to be in a pod.
+	Namespace string
+	// Cgroup is the cgroup of the calling process, or "" if it's unknown.
+	Cgroup string
+	// UID is the user ID of the calling process, if HasUID.
+	UID    uint32
+	HasUID bool
+	// PodName, ServiceAccount and Labels describe the calling pod, if
+	// it's known.
+	PodName        string
+	ServiceAccount string
+	Labels         map[string]string
+}
+
+// NameMatcher matches names against lists of globs and regular expressions.
+type NameMatcher struct {
+	// Globs are matched with path.Match.
+	Globs []string `json:"globs,omitempty"`
+	// Regexps must match the whole name.
+	Regexps []string `json:"regexps,omitempty"`
+}
+
+// compiledRegexps caches the compiled form of NameMatcher.Regexps, keyed by
+// expression.
+var compiledRegexps sync.Map
+
+// compileAnchored compiles expr so that it must match the whole of a name,
+// ignoring case.
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	if re, ok := compiledRegexps.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile("(?i)^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+	compiledRegexps.Store(expr, re)
+	return re, nil
+}
+
+// validate returns an error if any glob or regular expression is malformed.
+func (m NameMatcher) validate() error {
+	for _, g := range m.Globs {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("bad glob %q: %v", g, err)
+		}
+	}
+	for _, expr := range m.Regexps {
+		if _, err := compileAnchored(expr); err != nil {
+			return fmt.Errorf("bad regexp %q: %v", expr, err)
+		}
+	}
+	return nil
+}
+
+// matches returns whether name matches any glob or regular expression,
+// ignoring case.  Malformed ones never match; validate catches them when the
+// policy is loaded.
+func (m NameMatcher) matches(name string) bool {
+	for _, g := range m.Globs {
+		if ok, _ := path.Match(strings.ToLower(g), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	for _, expr := range m.Regexps {
+		if re, err := compileAnchored(expr); err == nil && re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// RecursiveBlock rejects ?recursive calls outside the recursive
+	// whitelist.
+	RecursiveBlock = "block"
+	// RecursiveRedact allows ?recursive calls anywhere, and removes concealed
+	// subtrees from the responses.  See Policy.Redact.
+	RecursiveRedact = "redact"
+)
+
+const (
+	// BlockedMessage responds to blocked requests with 403 Forbidden and
+	// why they're refused.
+	BlockedMessage = "message"
+	// BlockedNotFound responds to blocked requests as the metadata server
+	// does to requests for endpoints that don't exist.
+	BlockedNotFound = "notFound"
+	// BlockedForbidden responds to blocked requests with a bare 403
+	// Forbidden.
+	BlockedForbidden = "forbidden"
+	// BlockedJSON responds to blocked requests with 403 Forbidden and a
+	// JSON error holding the reason and a request ID.
+	BlockedJSON = "json"
+)
+
+// validBlockedResponse returns an error if s isn't a blocked response, or
+// empty when that's allowed.
+func validBlockedResponse(s string, allowEmpty bool) error {
+	switch s {
+	case BlockedMessage, BlockedNotFound, BlockedForbidden, BlockedJSON:
+		return nil
+	case "":
+		if allowEmpty {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown blocked response %q", s)
+}
+
+// MethodRule allows extra HTTP methods on the endpoints matching a path glob.
+type MethodRule struct {
+	// Path is a glob, as understood by path.Match, matched against the
+	// cleaned request path.
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+}
+
+// TokenRule requires requests to the endpoints matching a path glob to carry
+// a token for one of a list of Kubernetes service accounts.
+type TokenRule struct {
+	// Path is a glob, as understood by path.Match, matched against the
+	// cleaned request path.
+	Path string `json:"path"`
+	// ServiceAccounts are "namespace/name", where name may be "*" for any
+	// service account in the namespace.
+	ServiceAccounts []string `json:"serviceAccounts"`
+	// BlockedResponse, if set, overrides the policy's for the requests the
+	// rule refuses.
+	BlockedResponse string `json:"blockedResponse,omitempty"`
+}
+
+// Allows returns whether the rule allows tokens for the service account.
+func (r *TokenRule) Allows(namespace, name string) bool {
+	for _, sa := range r.ServiceAccounts {
+		if sa == namespace+"/"+name || sa == namespace+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenRule returns the first token rule matching the endpoint, or nil if
+// the endpoint doesn't require a token.
+func (p *Policy) TokenRule(cleanedPath string) *TokenRule {
+	for i, r := range p.TokenRules {
+		if ok, _ := path.Match(r.Path, cleanedPath); ok {
+			return &p.TokenRules[i]
+		}
+	}
+	return nil
+}
+
+// DefaultPolicy returns the policy used when none is configured.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		AllowedHosts: []string{
+			"169.254.169.254",
+			"fd20:ce::254",
+			"metadata.google.internal",
+			"metadata",
+		},
+		RequireMetadataFlavor:             true,
+		RejectLegacyMetadataRequestHeader: false,
+		AllowedHeaders: []string{
+			"Accept",
+			"Accept-Encoding",
+			"Metadata-Flavor",
+			"User-Agent",
+			"X-Google-Metadata-Request",
+		},
+		AllowedMethods: []string{"GET", "HEAD"},
+		MethodRules: []MethodRule{
+			// Legacy access token requests.
+			{Path: "/0.1/meta-data/service-accounts/*/acquire", Methods: []string{"POST"}},
+		},
+		QueryParameters: defaultQueryParameters(),
+		RuleCostLimit:   1000,
+		RecursiveMode:   RecursiveBlock,
+		BlockedResponse: BlockedMessage,
+		ConcealedInstanceAttributes: NameMatcher{
+			Globs: []string{"kube-env"},
+		},
+	}
+}
+
+// ParsePolicy parses a JSON-encoded policy.  Unknown fields are an error, so
+// that typos don't silently fall back to the defaults.
+func ParsePolicy(data []byte) (*Policy, error) {
+	p := DefaultPolicy()
+	var namespaces, cgroups, uids map[string]json.RawMessage
+	if err := decodePolicy(data, &struct {
+		*Policy
+		Namespaces *map[string]json.RawMessage `json:"namespaces"`
+		Cgroups    *map[string]json.RawMessage `json:"cgroups"`
+		UIDs       *map[string]json.RawMessage `json:"uids"`
+	}{p, &namespaces, &cgroups, &uids}); err != nil {
+		return nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	var err error
+	if p.Namespaces, err = p.derivePolicies("namespace", namespaces); err != nil {
+		return nil, err
+	}
+	if p.Cgroups, err = p.derivePolicies("cgroup", cgroups); err != nil {
+		return nil, err
+	}
+	for glob := range p.Cgroups {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("bad cgroup glob %q: %v", glob, err)
+		}
+	}
+	if p.UIDs, err = p.derivePolicies("uid", uids); err != nil {
+		return nil, err
+	}
+	for uid := range p.UIDs {
+		if _, err := strconv.ParseUint(uid, 10, 32); err != nil {
+			return nil, fmt.Errorf("bad uid %q", uid)
+		}
+	}
+	return p, nil
+}
+
+// derivePolicies parses the JSON-encoded policies for the callers of a kind,
+// each starting from p.
+func (p *Policy) derivePolicies(kind string, raws map[string]json.RawMessage) (map[string]*Policy, error) {
+	if len(raws) == 0 {
+		return nil, nil
+	}
+	// Each policy starts from a deep copy of p, since decoding merges
+	// into its maps.
+	base, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	policies := map[string]*Policy{}
+	for key, raw := range raws {
+		derived := &Policy{}
+		if err := json.Unmarshal(base, derived); err != nil {
+			return nil, err
+		}
+		if err := decodePolicy(raw, derived); err != nil {
+			return nil, fmt.Errorf("%s %q: %v", kind, key, err)
+		}
+		if err := derived.validate(); err != nil {
+			return nil, fmt.Errorf("invalid policy for %s %q: %v", kind, key, err)
+		}
+		policies[key] = derived
+	}
+	return policies, nil
+}
+
+// decodePolicy decodes JSON data into v, rejecting unknown fields.
+func decodePolicy(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("failed to parse policy: %v", err)
+	}
+	return nil
+}
+
+// ForNamespace returns the policy for requests from pods in the namespace.
+func (p *Policy) ForNamespace(namespace string) *Policy {
+	if np, ok := p.Namespaces[namespace]; ok {
+		return np
+	}
+	return p
+}
+
+// ForCaller returns the policy for requests from the caller.  The policy for
+// the caller's namespace takes precedence, then the first cgroup glob in
+// lexical order that matches its cgroup, then the policy for its UID.
+// Callers that match none get p.
+func (p *Policy) ForCaller(c Caller) *Policy {
+	if c.Namespace != "" {
+		if np, ok := p.Namespaces[c.Namespace]; ok {
+			return np
+		}
+	}
+	if c.Cgroup != "" {
+		globs := make([]string, 0, len(p.Cgroups))
+		for glob := range p.Cgroups {
+			globs = append(globs, glob)
+		}
+		sort.Strings(globs)
+		for _, glob := range globs {
+			if ok, _ := path.Match(glob, c.Cgroup); ok {
+				return p.Cgroups[glob]
+			}
+		}
+	}
+	if c.HasUID {
+		if up, ok := p.UIDs[strconv.FormatUint(uint64(c.UID), 10)]; ok {
+			return up
+		}
+	}
+	return p
+}
+
+// validate returns an error if the policy is malformed.
+func (p *Policy) validate() error {
+	for _, r := range p.MethodRules {
+		if _, err := path.Match(r.Path, ""); err != nil {
+			return fmt.Errorf("bad method rule path %q: %v", r.Path, err)
+		}
+	}
+	for _, r := range p.TokenRules {
+		if _, err := path.Match(r.Path, ""); err != nil {
+			return fmt.Errorf("bad token rule path %q: %v", r.Path, err)
+		}
+		for _, sa := range r.ServiceAccounts {
+			if parts := strings.Split(sa, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return fmt.Errorf("bad service account %q in token rule for %q, expected namespace/name", sa, r.Path)
+			}
+		}
+		if err := validBlockedResponse(r.BlockedResponse, true); err != nil {
+			return fmt.Errorf("bad token rule for %q: %v", r.Path, err)
+		}
+	}
+	if err := p.validateRules(); err != nil {
+		return err
+	}
+	if err := p.validateDecoys(); err != nil {
+		return err
+	}
+	if p.RecursiveMode != RecursiveBlock && p.RecursiveMode != RecursiveRedact {
+		return fmt.Errorf("unknown recursive mode %q", p.RecursiveMode)
+	}
+	if err := validBlockedResponse(p.BlockedResponse, false); err != nil {
+		return err
+	}
+	if err := p.ConcealedInstanceAttributes.validate(); err != nil {
+		return fmt.Errorf("bad concealed instance attributes: %v", err)
+	}
+	if err := p.ConcealedProjectAttributes.validate(); err != nil {
+		return fmt.Errorf("bad concealed project attributes: %v", err)
+	}
+	if err := p.AllowedKubeEnvKeys.validate(); err != nil {
+		return fmt.Errorf("bad allowed kube-env keys: %v", err)
+	}
+	for key, q := range p.QueryParameters {
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("bad schema for query parameter %q: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// LoadPolicy reads and parses the JSON-encoded policy at path.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %v", err)
+	}
+	return ParsePolicy(data)
+}
+
+// SanitizeHeader removes every header from h that the policy doesn't allow to
+// be forwarded, as well as all hop-by-hop headers.
+func (p *Policy) SanitizeHeader(h http.Header) {
+	// Headers named in Connection are hop-by-hop as well.
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+	for name := range h {
+		if !p.allowedHeader(name) {
+			delete(h, name)
+		}
+	}
+}
+
+// allowedHeader returns whether the canonical header name may be forwarded.
+func (p *Policy) allowedHeader(name string) bool {
+	for _, a := range p.AllowedHeaders {
+		if http.CanonicalHeaderKey(a) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost returns an error if host, the request's Host, isn't allowed.
+func (p *Policy) checkHost(host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		// A bracketed IPv6 address without a port.
+		host = host[1 : len(host)-1]
+	}
+	host = strings.TrimSuffix(host, ".")
+	for _, a := range p.AllowedHosts {
+		if host != "" && strings.EqualFold(host, a) {
+			return nil
+		}
+	}
+	return forbidden(ReasonHostNotAllowed, "Calls with Host %q are not allowed by the metadata proxy", host)
+}
+
+// checkHeaders returns an error if the request headers don't satisfy the
+// policy for the given cleaned path.
+func (p *Policy) checkHeaders(h http.Header, cleanedPath string) error {
+	if _, ok := h["X-Google-Metadata-Request"]; ok && p.RejectLegacyMetadataRequestHeader {
+		return forbidden(ReasonLegacyHeader, "Calls with X-Google-Metadata-Request header are not allowed by the metadata proxy")
+	}
+	if p.RequireMetadataFlavor && (cleanedPath == "/computeMetadata" || strings.HasPrefix(cleanedPath, "/computeMetadata/")) {
+		if v := h["Metadata-Flavor"]; len(v) != 1 || v[0] != "Google" {
+			return forbidden(ReasonMissingMetadataFlavor, "Calls to /computeMetadata without a Metadata-Flavor: Google header are not allowed by the metadata proxy")
+		}
+	}
+	return nil
+}
+
+// allowedMethods returns the HTTP methods allowed on the given cleaned path.
+func (p *Policy) allowedMethods(cleanedPath string) []string {
+	methods := p.AllowedMethods
+	for _, r := range p.MethodRules {
+		if ok, _ := path.Match(r.Path, cleanedPath); ok {
+			methods = append(methods[:len(methods):len(methods)], r.Methods...)
+		}
+	}
+	return methods
+}
+
+// checkMethod returns an error if the request method isn't allowed on the
+// given cleaned path, or if it's a read that carries a body.
+func (p *Policy) checkMethod(req *http.Request, cleanedPath string) error {
+	allowed := p.allowedMethods(cleanedPath)
+	found := false
+	for _, m := range allowed {
+		if m == req.Method {
+			found = true
+			break
+		}
+	}
+	if !found {
+		err := reject(http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method %s is not allowed on this metadata endpoint", req.Method)
+		err.Allow = allowed
+		return err
+	}
+	if (req.Method == "GET" || req.Method == "HEAD") && req.ContentLength != 0 {
+		return reject(http.StatusBadRequest, ReasonBodyNotAllowed, "Request bodies are not allowed on metadata reads")
+	}
+	return nil
+}
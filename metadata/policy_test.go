@@ -0,0 +1,316 @@
+package metadata_test
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+var (
+	flavorErr       = errors.New("Calls to /computeMetadata without a Metadata-Flavor: Google header are not allowed by the metadata proxy")
+	legacyHeaderErr = errors.New("Calls with X-Google-Metadata-Request header are not allowed by the metadata proxy")
+)
+
+func TestFilterMetadataHeaders(t *testing.T) {
+	t.Parallel()
+	rejectLegacy := metadata.DefaultPolicy()
+	rejectLegacy.RejectLegacyMetadataRequestHeader = true
+	noFlavor := metadata.DefaultPolicy()
+	noFlavor.RequireMetadataFlavor = false
+
+	tests := []struct {
+		name      string
+		policy    *metadata.Policy
+		url       string
+		headers   http.Header
+		expectErr error
+	}{
+		{"flavor", metadata.DefaultPolicy(), "/computeMetadata/v1/instance/id", http.Header{"Metadata-Flavor": {"Google"}}, nil},
+		{"no flavor", metadata.DefaultPolicy(), "/computeMetadata/v1/instance/id", http.Header{}, flavorErr},
+		{"no flavor on discovery", metadata.DefaultPolicy(), "/computeMetadata/", http.Header{}, flavorErr},
+		{"wrong flavor", metadata.DefaultPolicy(), "/computeMetadata/v1/instance/id", http.Header{"Metadata-Flavor": {"google"}}, flavorErr},
+		{"two flavors", metadata.DefaultPolicy(), "/computeMetadata/v1/instance/id", http.Header{"Metadata-Flavor": {"Google", "Google"}}, flavorErr},
+		{"no flavor on 0.1", metadata.DefaultPolicy(), "/0.1/meta-data/project-id", http.Header{}, nil},
+		{"flavor not required", noFlavor, "/computeMetadata/v1/instance/id", http.Header{}, nil},
+		{"legacy header", metadata.DefaultPolicy(), "/computeMetadata/v1/instance/id", http.Header{"Metadata-Flavor": {"Google"}, "X-Google-Metadata-Request": {"True"}}, nil},
+		{"legacy header rejected", rejectLegacy, "/computeMetadata/v1/instance/id", http.Header{"Metadata-Flavor": {"Google"}, "X-Google-Metadata-Request": {"True"}}, legacyHeaderErr},
+		{"legacy header rejected on 0.1", rejectLegacy, "/0.1/meta-data/project-id", http.Header{"X-Google-Metadata-Request": {"True"}}, legacyHeaderErr},
+	}
+
+	for _, tc := range tests {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			req, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error creating request: %q", err)
+			}
+			req.Header = tc.headers
+			req.Host = "metadata.google.internal"
+			_, err = tc.policy.Filter(req)
+			if err == nil {
+				if tc.expectErr != nil {
+					t.Errorf("Got nil error, expected %q", tc.expectErr)
+				}
+			} else if tc.expectErr == nil {
+				t.Errorf("Got %q, expected nil error", err)
+			} else if err.Error() != tc.expectErr.Error() {
+				t.Errorf("Got %q, expected %q", err, tc.expectErr)
+			}
+		})
+	}
+}
+
+func TestSanitizeHeader(t *testing.T) {
+	t.Parallel()
+	p := metadata.DefaultPolicy()
+	p.AllowedHeaders = append(p.AllowedHeaders, "x-custom", "Connection", "X-Hop")
+	h := http.Header{
+		"Metadata-Flavor":   {"Google"},
+		"User-Agent":        {"test"},
+		"X-Custom":          {"kept"},
+		"Authorization":     {"Bearer secret"},
+		"Cookie":            {"a=b"},
+		"Connection":        {"keep-alive, X-Hop"},
+		"X-Hop":             {"dropped"},
+		"Transfer-Encoding": {"chunked"},
+		"Upgrade":           {"h2c"},
+	}
+	p.SanitizeHeader(h)
+	expect := http.Header{
+		"Metadata-Flavor": {"Google"},
+		"User-Agent":      {"test"},
+		"X-Custom":        {"kept"},
+	}
+	if !reflect.DeepEqual(h, expect) {
+		t.Errorf("Got headers %v, expected %v", h, expect)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	t.Parallel()
+	p, err := metadata.ParsePolicy([]byte(`{"rejectLegacyMetadataRequestHeader": true, "allowedHeaders": ["Metadata-Flavor"]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing policy: %v", err)
+	}
+	expect := metadata.DefaultPolicy()
+	expect.RejectLegacyMetadataRequestHeader = true
+	expect.AllowedHeaders = []string{"Metadata-Flavor"}
+	if !reflect.DeepEqual(p, expect) {
+		t.Errorf("Got policy %+v, expected %+v", p, expect)
+	}
+
+	for _, bad := range []string{
+		`{"requireMetadataFlavour": false}`,
+		`{"allowedHeaders": "Metadata-Flavor"}`,
+		`not json`,
+		`{"methodRules": [{"path": "/0.1/meta-data/[", "methods": ["POST"]}]}`,
+		`{"queryParameters": {"alt": {"type": "yaml"}}}`,
+		`{"queryParameters": {"alt": {"type": "enum"}}}`,
+		`{"queryParameters": {"timeout_sec": {"type": "integer", "min": 10, "max": 1}}}`,
+		`{"blockedResponse": "teapot"}`,
+		`{"blockedResponse": ""}`,
+		`{"tokenRules": [{"path": "/a", "serviceAccounts": ["ns/sa"], "blockedResponse": "404"}]}`,
+	} {
+		if _, err := metadata.ParsePolicy([]byte(bad)); err == nil {
+			t.Errorf("Got nil error parsing %s, expected an error", bad)
+		}
+	}
+}
+
+func TestFilterHost(t *testing.T) {
+	t.Parallel()
+	custom := metadata.DefaultPolicy()
+	custom.AllowedHosts = []string{"metadata.internal.example.com"}
+
+	tests := []struct {
+		policy *metadata.Policy
+		host   string
+		allow  bool
+	}{
+		{metadata.DefaultPolicy(), "169.254.169.254", true},
+		{metadata.DefaultPolicy(), "169.254.169.254:80", true},
+		{metadata.DefaultPolicy(), "metadata.google.internal", true},
+		{metadata.DefaultPolicy(), "Metadata.Google.Internal.", true},
+		{metadata.DefaultPolicy(), "metadata", true},
+		{metadata.DefaultPolicy(), "metadata:988", true},
+		{metadata.DefaultPolicy(), "[fd20:ce::254]", true},
+		{metadata.DefaultPolicy(), "[fd20:ce::254]:80", true},
+		{metadata.DefaultPolicy(), "[fd20:ce::255]:80", false},
+		{metadata.DefaultPolicy(), "", false},
+		{metadata.DefaultPolicy(), "attacker.example.com", false},
+		{metadata.DefaultPolicy(), "metadata.google.internal.attacker.example.com", false},
+		{metadata.DefaultPolicy(), "127.0.0.1:988", false},
+		{custom, "metadata.internal.example.com", true},
+		{custom, "metadata.google.internal", false},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", "/computeMetadata/v1/instance/id", nil)
+		if err != nil {
+			t.Fatalf("Unexpected error creating request: %q", err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = tc.host
+		_, err = tc.policy.Filter(req)
+		if tc.allow {
+			if err != nil {
+				t.Errorf("Host %q: got %q, expected nil error", tc.host, err)
+			}
+			continue
+		}
+		if ferr, ok := err.(*metadata.FilterError); !ok || ferr.Reason != metadata.ReasonHostNotAllowed {
+			t.Errorf("Host %q: got %v, expected reason %q", tc.host, err, metadata.ReasonHostNotAllowed)
+		}
+	}
+}
+
+func TestParsePolicyNamespaces(t *testing.T) {
+	t.Parallel()
+	p, err := metadata.ParsePolicy([]byte(`{
+		"recursiveMode": "redact",
+		"queryParameters": {"custom": {"type": "boolean"}},
+		"namespaces": {
+			"kube-system": {"concealedInstanceAttributes": {"globs": []}},
+			"untrusted": {"queryParameters": {"extra": {"type": "string"}}, "allowedMethods": ["GET"]}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing policy: %v", err)
+	}
+	if got := p.ForNamespace("default"); got != p {
+		t.Errorf("Got %+v for namespace without a policy, expected the top-level policy", got)
+	}
+
+	system := p.ForNamespace("kube-system")
+	if system.RecursiveMode != metadata.RecursiveRedact {
+		t.Errorf("Got recursive mode %q for kube-system, expected it inherited", system.RecursiveMode)
+	}
+	if system.Concealed("/computeMetadata/v1/instance/attributes/kube-env") {
+		t.Errorf("Got kube-env concealed for kube-system, expected it revealed")
+	}
+	if !p.Concealed("/computeMetadata/v1/instance/attributes/kube-env") {
+		t.Errorf("Got kube-env revealed by the top-level policy, expected it concealed")
+	}
+
+	untrusted := p.ForNamespace("untrusted")
+	if _, ok := untrusted.QueryParameters["custom"]; !ok {
+		t.Errorf("Got no custom query parameter for untrusted, expected it inherited")
+	}
+	if _, ok := untrusted.QueryParameters["extra"]; !ok {
+		t.Errorf("Got no extra query parameter for untrusted, expected it added")
+	}
+	if _, ok := p.QueryParameters["extra"]; ok {
+		t.Errorf("Got extra query parameter in the top-level policy, expected it only in untrusted")
+	}
+	if !reflect.DeepEqual(untrusted.AllowedMethods, []string{"GET"}) {
+		t.Errorf("Got allowed methods %v for untrusted, expected [GET]", untrusted.AllowedMethods)
+	}
+
+	for _, bad := range []string{
+		`{"namespaces": {"a": {"recursiveMode": "sometimes"}}}`,
+		`{"namespaces": {"a": {"namespaces": {}}}}`,
+		`{"namespaces": {"a": {"allowedHeader": []}}}`,
+		`{"namespaces": []}`,
+	} {
+		if _, err := metadata.ParsePolicy([]byte(bad)); err == nil {
+			t.Errorf("Got nil error parsing %s, expected an error", bad)
+		}
+	}
+}
+
+func TestForCaller(t *testing.T) {
+	t.Parallel()
+	p, err := metadata.ParsePolicy([]byte(`{
+		"namespaces": {"kube-system": {"allowedMethods": ["GET"]}},
+		"cgroups": {
+			"/system.slice/*.service": {"allowedMethods": ["HEAD"]},
+			"/system.slice/node-agent.service": {"allowedMethods": ["GET", "HEAD"]}
+		},
+		"uids": {"0": {"allowedMethods": ["POST"]}}
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing policy: %v", err)
+	}
+	tests := []struct {
+		name   string
+		caller metadata.Caller
+		expect []string
+	}{
+		{"unknown", metadata.Caller{}, p.AllowedMethods},
+		{"namespace", metadata.Caller{Namespace: "kube-system", Cgroup: "/system.slice/a.service", UID: 0, HasUID: true}, []string{"GET"}},
+		{"other namespace", metadata.Caller{Namespace: "default", UID: 1000, HasUID: true}, p.AllowedMethods},
+		{"cgroup", metadata.Caller{Cgroup: "/system.slice/a.service", UID: 0, HasUID: true}, []string{"HEAD"}},
+		{"first cgroup glob", metadata.Caller{Cgroup: "/system.slice/node-agent.service"}, []string{"HEAD"}},
+		{"uid", metadata.Caller{Cgroup: "/user.slice", UID: 0, HasUID: true}, []string{"POST"}},
+		{"other uid", metadata.Caller{UID: 1000, HasUID: true}, p.AllowedMethods},
+		{"no uid", metadata.Caller{}, p.AllowedMethods},
+	}
+	for _, tc := range tests {
+		if got := p.ForCaller(tc.caller).AllowedMethods; !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("%s: got allowed methods %v, expected %v", tc.name, got, tc.expect)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"uids": {"root": {}}}`,
+		`{"uids": {"-1": {}}}`,
+		`{"cgroups": {"[": {}}}`,
+		`{"cgroups": {"/a": {"uids": {}}}}`,
+	} {
+		if _, err := metadata.ParsePolicy([]byte(bad)); err == nil {
+			t.Errorf("Got nil error parsing %s, expected an error", bad)
+		}
+	}
+}
+
+func TestTokenRules(t *testing.T) {
+	t.Parallel()
+	p, err := metadata.ParsePolicy([]byte(`{"tokenRules": [
+		{"path": "/computeMetadata/v1/instance/attributes/kube-env", "serviceAccounts": ["kube-system/node-agent"]},
+		{"path": "/computeMetadata/v1/instance/service-accounts/*/token", "serviceAccounts": ["kube-system/*", "default/web"]}
+	]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing policy: %v", err)
+	}
+	tests := []struct {
+		path      string
+		namespace string
+		name      string
+		expect    bool
+	}{
+		{"/computeMetadata/v1/instance/attributes/kube-env", "kube-system", "node-agent", true},
+		{"/computeMetadata/v1/instance/attributes/kube-env", "kube-system", "other", false},
+		{"/computeMetadata/v1/instance/attributes/kube-env", "default", "node-agent", false},
+		{"/computeMetadata/v1/instance/service-accounts/default/token", "kube-system", "any", true},
+		{"/computeMetadata/v1/instance/service-accounts/default/token", "default", "web", true},
+		{"/computeMetadata/v1/instance/service-accounts/default/token", "default", "db", false},
+	}
+	for _, tc := range tests {
+		r := p.TokenRule(tc.path)
+		if r == nil {
+			t.Errorf("Got no token rule for %s, expected one", tc.path)
+			continue
+		}
+		if got := r.Allows(tc.namespace, tc.name); got != tc.expect {
+			t.Errorf("Got %t for %s/%s on %s, expected %t", got, tc.namespace, tc.name, tc.path, tc.expect)
+		}
+	}
+	if r := p.TokenRule("/computeMetadata/v1/instance/id"); r != nil {
+		t.Errorf("Got token rule %+v for instance/id, expected none", r)
+	}
+
+	for _, bad := range []string{
+		`{"tokenRules": [{"path": "[", "serviceAccounts": ["a/b"]}]}`,
+		`{"tokenRules": [{"path": "/a", "serviceAccounts": ["b"]}]}`,
+		`{"tokenRules": [{"path": "/a", "serviceAccounts": ["a/b/c"]}]}`,
+		`{"tokenRules": [{"path": "/a", "serviceAccounts": ["/b"]}]}`,
+	} {
+		if _, err := metadata.ParsePolicy([]byte(bad)); err == nil {
+			t.Errorf("Got nil error parsing %s, expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxQueryValueLength bounds query parameter values whose schema
+// doesn't set MaxLength.
+const defaultMaxQueryValueLength = 256
+
+// etagPattern matches the hex etags returned by the metadata server.
+var etagPattern = regexp.MustCompile("^[0-9a-fA-F]{1,64}$")
+
+// QueryParameter is the schema for the values of a query parameter.
+type QueryParameter struct {
+	// Type is one of "string", "enum", "integer", "boolean", "etag" or "url".
+	Type string `json:"type"`
+	// Enum lists the allowed values of "enum" parameters.
+	Enum []string `json:"enum,omitempty"`
+	// Min and Max bound "integer" parameters, inclusive.  A Max of zero
+	// leaves them unbounded above.
+	Min int64 `json:"min,omitempty"`
+	Max int64 `json:"max,omitempty"`
+	// MaxLength bounds the length of the value in bytes.  Zero means
+	// defaultMaxQueryValueLength.
+	MaxLength int `json:"maxLength,omitempty"`
+}
+
+// defaultQueryParameters returns the schemas of the query parameters the
+// metadata server understands.
+func defaultQueryParameters() map[string]QueryParameter {
+	return map[string]QueryParameter{
+		// Common metadata retrieval params.
+		"recursive":       {Type: "boolean"},
+		"alt":             {Type: "enum", Enum: []string{"json", "text"}},
+		"wait_for_change": {Type: "boolean"},
+		"timeout_sec":     {Type: "integer", Min: 0}, // Capped by the proxy to its maximum wait.
+		"last_etag":       {Type: "etag"},
+
+		// Legacy auth token requests.
+		"service_account": {Type: "string"},
+		"scope":           {Type: "string", MaxLength: 4096},
+		"scopes":          {Type: "string", MaxLength: 4096},
+
+		// Identity Signing, blocked via path.
+		"audience": {Type: "url", MaxLength: 2048},
+		"licenses": {Type: "boolean"},
+		"format":   {Type: "enum", Enum: []string{"standard", "full"}},
+	}
+}
+
+// validate returns an error if the schema is malformed.
+func (q QueryParameter) validate() error {
+	switch q.Type {
+	case "string", "boolean", "etag", "url":
+	case "enum":
+		if len(q.Enum) == 0 {
+			return errors.New("enum parameter has no values")
+		}
+	case "integer":
+		if q.Max != 0 && q.Min > q.Max {
+			return fmt.Errorf("integer parameter has min %d above max %d", q.Min, q.Max)
+		}
+	default:
+		return fmt.Errorf("unknown parameter type %q", q.Type)
+	}
+	if q.MaxLength < 0 {
+		return fmt.Errorf("negative max length %d", q.MaxLength)
+	}
+	return nil
+}
+
+// check returns whether value satisfies the schema.
+func (q QueryParameter) check(value string) bool {
+	maxLength := q.MaxLength
+	if maxLength == 0 {
+		maxLength = defaultMaxQueryValueLength
+	}
+	if len(value) > maxLength {
+		return false
+	}
+	switch q.Type {
+	case "string":
+		return true
+	case "enum":
+		for _, e := range q.Enum {
+			if value == e {
+				return true
+			}
+		}
+		return false
+	case "integer":
+		n, err := strconv.ParseInt(value, 10, 64)
+		return err == nil && n >= q.Min && (q.Max == 0 || n <= q.Max)
+	case "boolean":
+		_, err := strconv.ParseBool(value)
+		return err == nil
+	case "etag":
+		return etagPattern.MatchString(value)
+	case "url":
+		u, err := url.Parse(value)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil
+	}
+	return false
+}
+
+// ParseQuery parses a raw query string as Filter does.  Unlike
+// url.ParseQuery, it treats semicolons as separators, the way some servers
+// still do, so that a parameter hidden behind one can't slip past the filter;
+// and it fails rather than dropping pairs it can't decode.  Anything that
+// decides on the query of a filtered request should parse it with ParseQuery,
+// so that it sees what's forwarded.
+func ParseQuery(rawQuery string) (url.Values, error) {
+	values := url.Values{}
+	for _, pair := range strings.FieldsFunc(rawQuery, func(r rune) bool { return r == '&' || r == ';' }) {
+		key, value := pair, ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			key, value = pair[:i], pair[i+1:]
+		}
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = append(values[key], value)
+	}
+	return values, nil
+}
+
+// CanonicalQuery returns the canonical encoding of a raw query string that
+// Filter has allowed: pairs sorted by key and consistently escaped, with
+// semicolons replaced by ampersands.  The canonical form is what should be
+// forwarded, so that the metadata server sees exactly what was filtered.
+func CanonicalQuery(rawQuery string) (string, error) {
+	values, err := ParseQuery(rawQuery)
+	if err != nil {
+		return "", err
+	}
+	return values.Encode(), nil
+}
+
+// sortedKeys returns the keys of values in order.
+func sortedKeys(values url.Values) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkQueryKeys returns an error if the query has unknown or repeated keys.
+func (p *Policy) checkQueryKeys(values url.Values) error {
+	for _, key := range sortedKeys(values) {
+		if _, ok := p.QueryParameters[key]; !ok {
+			return forbidden(ReasonUnknownQueryParameter, "Unrecognized query parameter key: %#q", key)
+		}
+		if len(values[key]) > 1 {
+			return forbidden(ReasonRepeatedQueryParameter, "Repeated query parameter key: %#q", key)
+		}
+	}
+	return nil
+}
+
+// checkQueryValues returns an error if any query value doesn't match its
+// schema.
+func (p *Policy) checkQueryValues(values url.Values) error {
+	for _, key := range sortedKeys(values) {
+		if !p.QueryParameters[key].check(values.Get(key)) {
+			return forbidden(ReasonInvalidQueryValue, "Invalid value for query parameter key: %#q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// NeedsRedaction returns whether the response to an allowed request with the
+// given query has to be passed through Redact before it's returned.
+func (p *Policy) NeedsRedaction(query url.Values) bool {
+	return p.RecursiveMode == RecursiveRedact && query["recursive"] != nil
+}
+
+// Redact removes every concealed subtree from body, the JSON response to a
+// ?recursive call for the cleaned path, and returns the result encoded as
+// alt, "json" or "text".
+//
+// Whether a subtree is concealed is decided by the same rules as Filter uses
+// for paths.  JSON keys are mapped back to the paths they're served at:
+// camelCase keys become kebab-case path segments (serviceAccounts becomes
+// service-accounts), except for the names of attributes, which are kept
+// as-is.  The text encoding is the metadata server's: one line per leaf,
+// giving its path relative to the cleaned path and its value.
+func (p *Policy) Redact(cleanedPath string, body []byte, alt string) ([]byte, error) {
+	var tree interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&tree); err != nil {
+		return nil, fmt.Errorf("failed to parse recursive response: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("failed to parse recursive response: trailing data")
+	}
+
+	dir := cleanedPath
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	tree = p.redact(dir, tree)
+
+	var buf bytes.Buffer
+	switch alt {
+	case "json":
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(tree); err != nil {
+			return nil, err
+		}
+		// Encode terminates the value with a newline, which the metadata
+		// server doesn't.
+		buf.Truncate(buf.Len() - 1)
+	case "text":
+		writeText(&buf, dir, "", tree)
+	default:
+		return nil, fmt.Errorf("unknown response format %q", alt)
+	}
+	return buf.Bytes(), nil
+}
+
+// redact removes the concealed children of v, which is served at dir, and
+// returns what's left.
+func (p *Policy) redact(dir string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			childPath := dir + pathSegment(dir, key)
+			if p.Concealed(childPath) || p.Concealed(childPath+"/") {
+				delete(v, key)
+				continue
+			}
+			v[key] = p.redact(childPath+"/", child)
+		}
+		return v
+	case []interface{}:
+		kept := v[:0]
+		for i, child := range v {
+			childPath := dir + strconv.Itoa(i)
+			if p.Concealed(childPath) || p.Concealed(childPath+"/") {
+				continue
+			}
+			kept = append(kept, p.redact(childPath+"/", child))
+		}
+		return kept
+	default:
+		return v
+	}
+}
+
+// writeText writes v, which is served at dir, in the metadata server's text
+// format.  Each leaf is written on its own line, prefixed by its path
+// relative to the requested directory, rel.
+func writeText(buf *bytes.Buffer, dir, rel string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			seg := pathSegment(dir, key)
+			writeText(buf, dir+seg+"/", rel+seg+"/", v[key])
+		}
+	case []interface{}:
+		for i, child := range v {
+			seg := strconv.Itoa(i)
+			writeText(buf, dir+seg+"/", rel+seg+"/", child)
+		}
+	case nil:
+		fmt.Fprintf(buf, "%s \n", strings.TrimSuffix(rel, "/"))
+	default:
+		fmt.Fprintf(buf, "%s %v\n", strings.TrimSuffix(rel, "/"), v)
+	}
+}
+
+// pathSegment returns the path segment under dir for the JSON key.
+func pathSegment(dir, key string) string {
+	if strings.HasSuffix(dir, "/attributes/") {
+		return key
+	}
+	var b strings.Builder
+	for _, r := range key {
+		if unicode.IsUpper(r) {
+			b.WriteByte('-')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,128 @@
+package metadata_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+const instanceJSON = `{
+  "attributes": {"cluster-name": "test", "kube-env": "KUBELET_CERT: secret\nKUBELET_KEY: secret\n"},
+  "hostname": "node-1",
+  "serviceAccounts": {
+    "default": {"aliases": ["default"], "email": "sa@example.com", "identity": "jwt", "scopes": ["a", "b"]}
+  },
+  "tags": ["x<y"]
+}`
+
+func redactPolicy() *metadata.Policy {
+	p := metadata.DefaultPolicy()
+	p.RecursiveMode = metadata.RecursiveRedact
+	return p
+}
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		path   string
+		body   string
+		alt    string
+		expect string
+	}{
+		{
+			"/computeMetadata/v1/instance/", instanceJSON, "json",
+			`{"attributes":{"cluster-name":"test"},"hostname":"node-1","serviceAccounts":{"default":{"aliases":["default"],"email":"sa@example.com","scopes":["a","b"]}},"tags":["x<y"]}`,
+		},
+		{
+			"/computeMetadata/v1/instance/", instanceJSON, "text",
+			"attributes/cluster-name test\n" +
+				"hostname node-1\n" +
+				"service-accounts/default/aliases/0 default\n" +
+				"service-accounts/default/email sa@example.com\n" +
+				"service-accounts/default/scopes/0 a\n" +
+				"service-accounts/default/scopes/1 b\n" +
+				"tags/0 x<y\n",
+		},
+		{
+			"/computeMetadata/v1/instance/attributes/", `{"kube-env": "secret", "kubeEnv": "not secret"}`, "json",
+			`{"kubeEnv":"not secret"}`,
+		},
+		{
+			"/computeMetadata/v1beta1/instance", `{"attributes": {"kube-env": "secret"}, "id": 12345678901234567890}`, "json",
+			`{"attributes":{},"id":12345678901234567890}`,
+		},
+		{
+			"/computeMetadata/v1/", `{"instance": {"attributes": {"kube-env": "secret"}}, "project": {"projectId": "p"}}`, "text",
+			"project/project-id p\n",
+		},
+		// Unknown API versions aren't concealed.
+		{
+			"/computeMetadata/v2/instance/", `{"attributes": {"kube-env": "x"}}`, "json",
+			`{"attributes":{"kube-env":"x"}}`,
+		},
+	}
+
+	p := redactPolicy()
+	for _, tc := range tests {
+		got, err := p.Redact(tc.path, []byte(tc.body), tc.alt)
+		if err != nil {
+			t.Errorf("%s (%s): unexpected error %v", tc.path, tc.alt, err)
+		} else if string(got) != tc.expect {
+			t.Errorf("%s (%s): got\n%s\nexpected\n%s", tc.path, tc.alt, got, tc.expect)
+		}
+	}
+}
+
+func TestRedactFailsClosed(t *testing.T) {
+	t.Parallel()
+	p := redactPolicy()
+	for _, body := range []string{"", "kube-env secret", `{"a": 1} {"b": 2}`, `{"a": `} {
+		if got, err := p.Redact("/computeMetadata/v1/instance/", []byte(body), "json"); err == nil {
+			t.Errorf("Body %q: got %q, expected an error", body, got)
+		}
+	}
+	if _, err := p.Redact("/computeMetadata/v1/instance/", []byte("{}"), "yaml"); err == nil {
+		t.Errorf("Got nil error for unknown format, expected an error")
+	}
+}
+
+func TestFilterRecursiveRedactMode(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		url             string
+		expectErr       error
+		expectRedaction bool
+	}{
+		{"/computeMetadata/v1/instance/?recursive=true", nil, true},
+		{"/computeMetadata/v1/?recursive=true&alt=text", nil, true},
+		{"/computeMetadata/v1/instance/service-accounts/default/?recursive=true", nil, true},
+		{"/computeMetadata/v1/instance/attributes/kube-env?recursive=true", concealedErr, true},
+		{"/computeMetadata/v1/instance/", nil, false},
+	}
+
+	p := redactPolicy()
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error creating request: %q", err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		_, err = p.Filter(req)
+		if err == nil {
+			if tc.expectErr != nil {
+				t.Errorf("%s: got nil error, expected %q", tc.url, tc.expectErr)
+			}
+		} else if tc.expectErr == nil {
+			t.Errorf("%s: got %q, expected nil error", tc.url, err)
+		} else if err.Error() != tc.expectErr.Error() {
+			t.Errorf("%s: got %q, expected %q", tc.url, err, tc.expectErr)
+		}
+		query, _ := url.ParseQuery(req.URL.RawQuery)
+		if got := p.NeedsRedaction(query); got != tc.expectRedaction {
+			t.Errorf("%s: got needs redaction %t, expected %t", tc.url, got, tc.expectRedaction)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package metadata
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+)
+
+// Rule requires requests to the endpoints matching a path glob to satisfy an
+// expression, such as:
+//
+//	request.query.scopes.split(',').all(s, s in ['https://www.googleapis.com/auth/cloud-platform'])
+//	    && pod.labels.tier == 'prod'
+//
+// Expressions are written in CEL (https://github.com/google/cel-spec), with
+// its string extensions, over the variables request and pod, which have the
+// fields of RuleRequest and RulePod, named as in their JSON.  They're compiled
+// and type-checked when the policy is loaded, or by CompileRules.
+type Rule struct {
+	// Name identifies the rule in responses to the requests it denies.
+	Name string `json:"name"`
+	// Path is a glob, as understood by path.Match, matched against the
+	// cleaned request path.  If it's empty, the rule applies to every
+	// endpoint.
+	Path string `json:"path,omitempty"`
+	// Expression must evaluate to true for requests to be allowed.
+	Expression string `json:"expression"`
+	// Tests are example requests that the rule must allow, or deny, for
+	// the policy to load.
+	Tests []RuleTest `json:"tests,omitempty"`
+	// BlockedResponse, if set, overrides the policy's for the requests the
+	// rule denies.
+	BlockedResponse string `json:"blockedResponse,omitempty"`
+
+	program cel.Program
+}
+
+// RuleRequest is the request a rule's expression is evaluated for.
+type RuleRequest struct {
+	Method string `json:"method"`
+	// Path is the cleaned path.  Expressions also get its non-empty parts
+	// as request.segments.
+	Path string `json:"path"`
+	// Query holds the first value of each query parameter.
+	Query map[string]string `json:"query"`
+	// Headers maps lower-case header names to their values, joined with
+	// ", " if the header is repeated.
+	Headers map[string]string `json:"headers"`
+	Host    string            `json:"host"`
+}
+
+// RulePod is the pod a request comes from.  Its fields are empty if the pod
+// isn't known.
+type RulePod struct {
+	Namespace      string            `json:"namespace"`
+	Name           string            `json:"name"`
+	ServiceAccount string            `json:"serviceAccount"`
+	Labels         map[string]string `json:"labels"`
+}
+
+// RuleTest is an example request for a rule.
+type RuleTest struct {
+	Request RuleRequest `json:"request"`
+	Pod     RulePod     `json:"pod"`
+	// Allow is whether the rule must allow the request.
+	Allow bool `json:"allow"`
+}
+
+// ruleRequest is request in rule expressions: a RuleRequest, with the parts
+// of its path.
+type ruleRequest struct {
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Segments []string          `json:"segments"`
+	Query    map[string]string `json:"query"`
+	Headers  map[string]string `json:"headers"`
+	Host     string            `json:"host"`
+}
+
+// ruleEnv declares the variables of rule expressions, as the native types
+// ruleRequest and RulePod, with fields named by their JSON tags.
+var ruleEnv = newRuleEnv()
+
+func newRuleEnv() *cel.Env {
+	env, err := cel.NewEnv(
+		ext.NativeTypes(reflect.TypeOf(&ruleRequest{}), reflect.TypeOf(&RulePod{}), ext.ParseStructTag("json")),
+		cel.Variable("request", cel.ObjectType("metadata.ruleRequest")),
+		cel.Variable("pod", cel.ObjectType("metadata.RulePod")),
+		ext.Strings(),
+	)
+	if err != nil {
+		panic(fmt.Sprintf("failed to declare rule variables: %v", err))
+	}
+	return env
+}
+
+// ruleVars returns the variables of rule expressions for a request from pod.
+func ruleVars(req *RuleRequest, pod *RulePod) map[string]interface{} {
+	segments := strings.FieldsFunc(req.Path, func(r rune) bool { return r == '/' })
+	headers := make(map[string]string, len(req.Headers))
+	for k, v := range req.Headers {
+		headers[strings.ToLower(k)] = v
+	}
+	return map[string]interface{}{
+		"request": &ruleRequest{
+			Method:   req.Method,
+			Path:     req.Path,
+			Segments: segments,
+			Query:    req.Query,
+			Headers:  headers,
+			Host:     req.Host,
+		},
+		"pod": pod,
+	}
+}
+
+// newRuleRequest returns the RuleRequest for req, whose path cleans to
+// cleanedPath.
+func newRuleRequest(req *http.Request, cleanedPath string) *RuleRequest {
+	r := &RuleRequest{
+		Method:  req.Method,
+		Path:    cleanedPath,
+		Query:   map[string]string{},
+		Headers: map[string]string{},
+		Host:    req.Host,
+	}
+	// Filter has already parsed the query, so this can't fail.
+	query, _ := ParseQuery(req.URL.RawQuery)
+	for k, v := range query {
+		r.Query[k] = v[0]
+	}
+	for k, v := range req.Header {
+		r.Headers[strings.ToLower(k)] = strings.Join(v, ", ")
+	}
+	return r
+}
+
+// compile compiles the rule's expression, to be evaluated at no more than
+// costLimit, and runs its tests.
+func (r *Rule) compile(costLimit int) error {
+	ast, issues := ruleEnv.Compile(r.Expression)
+	if err := issues.Err(); err != nil {
+		return err
+	}
+	if t := ast.OutputType(); !t.IsExactType(cel.BoolType) {
+		return fmt.Errorf("expression must be a bool, got %s", t)
+	}
+	p, err := ruleEnv.Program(ast, cel.CostLimit(uint64(costLimit)))
+	if err != nil {
+		return err
+	}
+	r.program = p
+	for i, t := range r.Tests {
+		allowed, err := r.allows(ruleVars(&t.Request, &t.Pod), t.Request.Path)
+		if err != nil {
+			return fmt.Errorf("test %d failed: %v", i+1, err)
+		}
+		if allowed != t.Allow {
+			return fmt.Errorf("test %d failed: got allowed %v, expected %v", i+1, allowed, t.Allow)
+		}
+	}
+	return nil
+}
+
+// allows returns whether the rule allows a request to the cleaned path, with
+// the variables vars.
+func (r *Rule) allows(vars map[string]interface{}, cleanedPath string) (bool, error) {
+	if r.Path != "" {
+		if ok, _ := path.Match(r.Path, cleanedPath); !ok {
+			return true, nil
+		}
+	}
+	// Expressions are never compiled here, for every request.
+	if r.program == nil {
+		return false, fmt.Errorf("expression isn't compiled")
+	}
+	v, _, err := r.program.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	allowed, ok := v.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression isn't a bool")
+	}
+	return allowed, nil
+}
+
+// validateRules returns an error if any rule is malformed, or fails its
+// tests.
+func (p *Policy) validateRules() error {
+	if p.RuleCostLimit <= 0 {
+		return fmt.Errorf("rule cost limit must be positive, got %d", p.RuleCostLimit)
+	}
+	names := map[string]bool{}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			return fmt.Errorf("rule %d has no name", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate rule %q", r.Name)
+		}
+		names[r.Name] = true
+		if _, err := path.Match(r.Path, ""); err != nil {
+			return fmt.Errorf("bad path %q in rule %q: %v", r.Path, r.Name, err)
+		}
+		if err := validBlockedResponse(r.BlockedResponse, true); err != nil {
+			return fmt.Errorf("bad rule %q: %v", r.Name, err)
+		}
+		if err := r.compile(p.RuleCostLimit); err != nil {
+			return fmt.Errorf("bad rule %q: %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// CompileRules compiles the expressions of the rules of the policy, and of
+// the policies for its callers, that aren't compiled yet, and runs their
+// tests.  ParsePolicy compiles them all; policies made otherwise must be
+// compiled before they're used, since rules that aren't deny every request.
+func (p *Policy) CompileRules() error {
+	policies := []*Policy{p}
+	for _, derived := range []map[string]*Policy{p.Namespaces, p.Cgroups, p.UIDs} {
+		for _, dp := range derived {
+			policies = append(policies, dp)
+		}
+	}
+	for _, policy := range policies {
+		for i := range policy.Rules {
+			r := &policy.Rules[i]
+			if r.program != nil {
+				continue
+			}
+			if err := r.compile(policy.RuleCostLimit); err != nil {
+				return fmt.Errorf("bad rule %q: %v", r.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckRules returns an error if a rule for the cleaned path denies req from
+// the caller, or can't be evaluated.  It's separate from Filter, since only
+// the proxy knows the caller.
+func (p *Policy) CheckRules(req *http.Request, cleanedPath string, c Caller) error {
+	if len(p.Rules) == 0 {
+		return nil
+	}
+	pod := &RulePod{
+		Namespace:      c.Namespace,
+		Name:           c.PodName,
+		ServiceAccount: c.ServiceAccount,
+		Labels:         c.Labels,
+	}
+	vars := ruleVars(newRuleRequest(req, cleanedPath), pod)
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		allowed, err := r.allows(vars, cleanedPath)
+		var fe *FilterError
+		if err != nil {
+			fe = forbidden(ReasonRuleError, "Metadata proxy could not evaluate rule %q: %v", r.Name, err)
+		} else if !allowed {
+			fe = forbidden(ReasonRuleDenied, "This metadata request is denied by rule %q of the metadata proxy", r.Name)
+		}
+		if fe != nil {
+			fe.BlockedResponse = r.BlockedResponse
+			return fe
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package metadata_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+const tokenRulePolicy = `{
+	"rules": [{
+		"name": "prod-token",
+		"path": "/computeMetadata/v1/instance/service-accounts/*/token",
+		"expression": "(!has(request.query.scopes) || request.query.scopes.split(',').all(s, s in ['https://www.googleapis.com/auth/cloud-platform'])) && 'tier' in pod.labels && pod.labels.tier == 'prod'",
+		"tests": [
+			{"request": {"path": "/computeMetadata/v1/instance/service-accounts/default/token"}, "pod": {"labels": {"tier": "prod"}}, "allow": true},
+			{"request": {"path": "/computeMetadata/v1/instance/service-accounts/default/token", "query": {"scopes": "email"}}, "pod": {"labels": {"tier": "prod"}}, "allow": false},
+			{"request": {"path": "/computeMetadata/v1/instance/service-accounts/default/token"}, "allow": false},
+			{"request": {"path": "/computeMetadata/v1/instance/id"}, "allow": true}
+		]
+	}, {
+		"name": "no-user-agent-curl",
+		"expression": "!('user-agent' in request.headers) || !request.headers['user-agent'].startsWith('curl/')"
+	}]
+}`
+
+func TestParseRules(t *testing.T) {
+	t.Parallel()
+	if _, err := metadata.ParsePolicy([]byte(tokenRulePolicy)); err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	tests := []struct {
+		name      string
+		json      string
+		expectErr string
+	}{
+		{"no name", `{"rules": [{"expression": "true"}]}`, "rule 1 has no name"},
+		{"duplicate", `{"rules": [{"name": "a", "expression": "true"}, {"name": "a", "expression": "false"}]}`, `duplicate rule "a"`},
+		{"bad path", `{"rules": [{"name": "a", "path": "[", "expression": "true"}]}`, `bad path "["`},
+		{"syntax", `{"rules": [{"name": "a", "expression": "request.path =="}]}`, `bad rule "a": ERROR: <input>:1:16: Syntax error`},
+		{"type", `{"rules": [{"name": "a", "expression": "request.bogus"}]}`, "undefined field 'bogus'"},
+		{"not bool", `{"rules": [{"name": "a", "expression": "request.path"}]}`, "expression must be a bool, got string"},
+		{"failed test", `{"rules": [{"name": "a", "expression": "request.method == 'GET'", "tests": [{"request": {"method": "POST"}, "allow": true}]}]}`, "test 1 failed: got allowed false, expected true"},
+		{"test error", `{"rules": [{"name": "a", "expression": "request.query.x == 'y'", "tests": [{"request": {}, "allow": false}]}]}`, "test 1 failed: no such key: x"},
+		{"blocked response", `{"rules": [{"name": "a", "expression": "true", "blockedResponse": "teapot"}]}`, `bad rule "a": unknown blocked response "teapot"`},
+		{"cost limit", `{"ruleCostLimit": 0}`, "rule cost limit must be positive"},
+		{"namespace", `{"namespaces": {"prod": {"rules": [{"name": "a", "expression": "pod.bogus"}]}}}`, "undefined field 'bogus'"},
+	}
+	for _, tc := range tests {
+		_, err := metadata.ParsePolicy([]byte(tc.json))
+		if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+			t.Errorf("%s: got error %v, expected %q", tc.name, err, tc.expectErr)
+		}
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	t.Parallel()
+	p, err := metadata.ParsePolicy([]byte(tokenRulePolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rules in policies built in code work too, once they're compiled.
+	uncompiled := metadata.DefaultPolicy()
+	uncompiled.Rules = []metadata.Rule{{Name: "get-only", Expression: "request.method == 'GET'"}}
+	built := metadata.DefaultPolicy()
+	built.Rules = []metadata.Rule{{Name: "get-only", Expression: "request.method == 'GET'"}}
+	costly := metadata.DefaultPolicy()
+	costly.RuleCostLimit = 5
+	costly.Rules = []metadata.Rule{{Name: "costly", Expression: "request.segments.all(s, s.size() > 0)"}}
+	for _, p := range []*metadata.Policy{built, costly} {
+		if err := p.CompileRules(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prod := metadata.Caller{Namespace: "web", PodName: "web-1", Labels: map[string]string{"tier": "prod"}}
+	dev := metadata.Caller{Namespace: "web", PodName: "web-2", Labels: map[string]string{"tier": "dev"}}
+	const token = "/computeMetadata/v1/instance/service-accounts/default/token"
+	tests := []struct {
+		name         string
+		policy       *metadata.Policy
+		method       string
+		url          string
+		header       http.Header
+		caller       metadata.Caller
+		expectReason string
+	}{
+		{"prod token", p, "GET", token, nil, prod, ""},
+		{"prod token with scopes", p, "GET", token + "?scopes=https://www.googleapis.com/auth/cloud-platform", nil, prod, ""},
+		{"prod token with other scopes", p, "GET", token + "?scopes=https://www.googleapis.com/auth/cloud-platform,email", nil, prod, metadata.ReasonRuleDenied},
+		{"prod token with scopes after a semicolon", p, "GET", token + "?alt=json;scopes=https://www.googleapis.com/auth/admin", nil, prod, metadata.ReasonRuleDenied},
+		{"dev token", p, "GET", token, nil, dev, metadata.ReasonRuleDenied},
+		{"unknown pod token", p, "GET", token, nil, metadata.Caller{}, metadata.ReasonRuleDenied},
+		{"dev other endpoint", p, "GET", "/computeMetadata/v1/instance/id", nil, dev, ""},
+		{"curl", p, "GET", "/computeMetadata/v1/instance/id", http.Header{"User-Agent": {"curl/8.0"}}, prod, metadata.ReasonRuleDenied},
+		{"built allowed", built, "GET", "/computeMetadata/v1/instance/id", nil, prod, ""},
+		{"built denied", built, "HEAD", "/computeMetadata/v1/instance/id", nil, prod, metadata.ReasonRuleDenied},
+		{"uncompiled", uncompiled, "GET", "/computeMetadata/v1/instance/id", nil, prod, metadata.ReasonRuleError},
+		{"over cost limit", costly, "GET", "/computeMetadata/v1/instance/id", nil, prod, metadata.ReasonRuleError},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.header != nil {
+			req.Header = tc.header
+		}
+		err = tc.policy.CheckRules(req, req.URL.Path, tc.caller)
+		reason := ""
+		if err != nil {
+			fe, ok := err.(*metadata.FilterError)
+			if !ok {
+				t.Errorf("%s: got %T error, expected *metadata.FilterError", tc.name, err)
+				continue
+			}
+			reason = fe.Reason
+		}
+		if reason != tc.expectReason {
+			t.Errorf("%s: got reason %q (%v), expected %q", tc.name, reason, err, tc.expectReason)
+		}
+	}
+}
+
+func TestCompileRules(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		rules     []metadata.Rule
+		namespace []metadata.Rule
+		expectErr bool
+	}{
+		{"none", nil, nil, false},
+		{"good", []metadata.Rule{{Name: "get-only", Expression: "request.method == 'GET'"}}, nil, false},
+		{"syntax error", []metadata.Rule{{Name: "bad", Expression: "request.method =="}}, nil, true},
+		{"not a bool", []metadata.Rule{{Name: "bad", Expression: "request.method"}}, nil, true},
+		{"failed test", []metadata.Rule{{Name: "bad", Expression: "false", Tests: []metadata.RuleTest{{Allow: true}}}}, nil, true},
+		{"namespace", nil, []metadata.Rule{{Name: "bad", Expression: "request.method =="}}, true},
+	}
+	for _, tc := range tests {
+		p := metadata.DefaultPolicy()
+		p.Rules = tc.rules
+		np := metadata.DefaultPolicy()
+		np.Rules = tc.namespace
+		p.Namespaces = map[string]*metadata.Policy{"web": np}
+		if err := p.CompileRules(); (err != nil) != tc.expectErr {
+			t.Errorf("%s: got error %v, expected error %v", tc.name, err, tc.expectErr)
+		}
+	}
+}
@@ -12,8 +12,92 @@ var (
 		},
 		[]string{"filter_result", "code"},
 	)
+	FilterRejectCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "filter_reject_count",
+			Help: "Number of metadata proxy requests rejected by the filter broken down by reason.",
+		},
+		[]string{"reason"},
+	)
+	HostRejectCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "host_reject_count",
+			Help: "Number of metadata proxy requests rejected for having a Host header that isn't allowed, such as DNS rebinding attempts.",
+		},
+	)
+	OriginalDstRejectCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "original_dst_reject_count",
+			Help: "Number of connections refused in transparent mode because their original destination wasn't allowed or couldn't be found.",
+		},
+	)
+	PeerCredRejectCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "peer_cred_reject_count",
+			Help: "Number of unix socket connections refused because their peer's credentials couldn't be read.",
+		},
+	)
+	RuleReconcileCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rule_reconcile_count",
+			Help: "Number of reconciliations of the redirect rules broken down by result: unchanged, updated or failed.",
+		},
+		[]string{"result"},
+	)
+	FailureModeGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "failure_mode",
+			Help: "Set to 1 for the mode configured for each kind of failure, and 0 for the other modes.",
+		},
+		[]string{"failure", "mode"},
+	)
+	FailureFallbackCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "failure_fallback_count",
+			Help: "Number of times the failure mode was applied broken down by kind of failure and mode.",
+		},
+		[]string{"failure", "mode"},
+	)
+	AuditEventCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "audit_event_count",
+			Help: "Number of audit events recorded broken down by event and priority.",
+		},
+		[]string{"event", "priority"},
+	)
+	BufferPoolGetCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buffer_pool_get_count",
+			Help: "Number of buffers taken from the proxy buffer pool broken down by size class in bytes.",
+		},
+		[]string{"size_class"},
+	)
+	BufferPoolAllocCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buffer_pool_alloc_count",
+			Help: "Number of buffers allocated because the proxy buffer pool was empty broken down by size class in bytes.",
+		},
+		[]string{"size_class"},
+	)
+	BufferPoolSizeHint = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buffer_pool_size_hint_bytes",
+			Help: "Moving average of proxied response sizes used to pick buffer size classes.",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(RequestCounter)
+	prometheus.MustRegister(FilterRejectCounter)
+	prometheus.MustRegister(HostRejectCounter)
+	prometheus.MustRegister(OriginalDstRejectCounter)
+	prometheus.MustRegister(PeerCredRejectCounter)
+	prometheus.MustRegister(RuleReconcileCounter)
+	prometheus.MustRegister(FailureModeGauge)
+	prometheus.MustRegister(FailureFallbackCounter)
+	prometheus.MustRegister(AuditEventCounter)
+	prometheus.MustRegister(BufferPoolGetCounter)
+	prometheus.MustRegister(BufferPoolAllocCounter)
+	prometheus.MustRegister(BufferPoolSizeHint)
 }
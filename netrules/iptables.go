@@ -0,0 +1,221 @@
+package netrules
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Chain is the nat chain holding the redirect rules.  It's jumped to from the
+// start of PREROUTING, so that it takes precedence over other rules for pod
+// traffic, but not from OUTPUT, so that the proxy's own requests to the
+// metadata server aren't redirected back to it.
+const Chain = "METADATA-PROXY"
+
+// jumpRule is the PREROUTING rule that sends traffic through Chain, as
+// listed by iptables-save.
+const jumpRule = "-A PREROUTING -j " + Chain
+
+// runner runs a command with the given standard input and returns its
+// standard output.
+type runner func(stdin string, name string, arg ...string) (string, error)
+
+// execRunner runs commands with os/exec.
+func execRunner(stdin string, name string, arg ...string) (string, error) {
+	cmd := exec.Command(name, arg...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// IPTables is a Backend that installs DNAT rules with iptables-restore.
+// Rules are replaced in a single transaction, so traffic is never left
+// unredirected while they're updated.
+type IPTables struct {
+	save    string
+	restore string
+	run     runner
+}
+
+// NewIPTables returns an IPTables backend for IPv4 rules, or for IPv6 rules
+// if ipv6 is set.
+func NewIPTables(ipv6 bool) *IPTables {
+	if ipv6 {
+		return &IPTables{"ip6tables-save", "ip6tables-restore", execRunner}
+	}
+	return &IPTables{"iptables-save", "iptables-restore", execRunner}
+}
+
+// natState is what iptables-save reports about Chain.
+type natState struct {
+	chain bool
+	// jumps counts the jumps to Chain in PREROUTING, and first is whether
+	// one is its first rule.
+	jumps int
+	first bool
+	rules []string
+}
+
+// inEffect returns whether Chain's rules take precedence: PREROUTING jumps
+// to it first, and only then.
+func (s natState) inEffect() bool {
+	return s.first && s.jumps == 1
+}
+
+func (b *IPTables) state() (natState, error) {
+	out, err := b.run("", b.save, "-t", "nat")
+	if err != nil {
+		return natState{}, err
+	}
+	var s natState
+	prerouting := 0
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "-A PREROUTING ") {
+			prerouting++
+		}
+		switch {
+		case strings.HasPrefix(line, ":"+Chain+" "):
+			s.chain = true
+		case line == jumpRule:
+			s.jumps++
+			s.first = s.first || prerouting == 1
+		case strings.HasPrefix(line, "-A "+Chain+" "):
+			s.rules = append(s.rules, line)
+		}
+	}
+	return s, nil
+}
+
+// Installed returns the rules in Chain, or none if Chain isn't jumped to by
+// the first rule of PREROUTING alone, such as when other rules were inserted
+// before the jump, so that it's moved back on reconciliation.  Rules that
+// weren't installed by IPTables are returned as the zero Rule, so that
+// they're replaced on reconciliation.
+func (b *IPTables) Installed() ([]Rule, error) {
+	s, err := b.state()
+	if err != nil {
+		return nil, err
+	}
+	if !s.inEffect() {
+		return nil, nil
+	}
+	rules := make([]Rule, 0, len(s.rules))
+	for _, line := range s.rules {
+		r, _ := parseRule(line)
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Install replaces the rules in Chain, creating it and the jump to it if
+// needed, and moving the jump to the start of PREROUTING if it isn't there.
+func (b *IPTables) Install(rules []Rule) error {
+	s, err := b.state()
+	if err != nil {
+		return err
+	}
+	var script bytes.Buffer
+	script.WriteString("*nat\n")
+	// Declaring an existing chain flushes it.
+	fmt.Fprintf(&script, ":%s - [0:0]\n", Chain)
+	for _, r := range rules {
+		line, err := formatRule(r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(&script, line)
+	}
+	if !s.inEffect() {
+		for i := 0; i < s.jumps; i++ {
+			fmt.Fprintf(&script, "-D PREROUTING -j %s\n", Chain)
+		}
+		fmt.Fprintf(&script, "-I PREROUTING -j %s\n", Chain)
+	}
+	script.WriteString("COMMIT\n")
+	_, err = b.run(script.String(), b.restore, "--noflush", "--wait")
+	return err
+}
+
+// Uninstall removes the jump to Chain and Chain itself.
+func (b *IPTables) Uninstall() error {
+	s, err := b.state()
+	if err != nil {
+		return err
+	}
+	if !s.chain && s.jumps == 0 {
+		return nil
+	}
+	var script bytes.Buffer
+	script.WriteString("*nat\n")
+	for i := 0; i < s.jumps; i++ {
+		fmt.Fprintf(&script, "-D PREROUTING -j %s\n", Chain)
+	}
+	if s.chain {
+		fmt.Fprintf(&script, ":%s - [0:0]\n-X %s\n", Chain, Chain)
+	}
+	script.WriteString("COMMIT\n")
+	_, err = b.run(script.String(), b.restore, "--noflush", "--wait")
+	return err
+}
+
+// formatRule returns r as an iptables rule in Chain, in the form
+// iptables-save lists it.
+func formatRule(r Rule) (string, error) {
+	if r.Destination == nil || r.RedirectTo == nil || r.RedirectTo.Port == 0 {
+		return "", fmt.Errorf("incomplete rule %v", r)
+	}
+	if (r.Destination.IP.To4() == nil) != (r.RedirectTo.IP.To4() == nil) {
+		return "", fmt.Errorf("rule %v mixes address families", r)
+	}
+	bits := 128
+	if r.Destination.IP.To4() != nil {
+		bits = 32
+	}
+	line := fmt.Sprintf("-A %s -d %s/%d -p tcp", Chain, r.Destination.IP, bits)
+	if r.Destination.Port != 0 {
+		line += fmt.Sprintf(" -m tcp --dport %d", r.Destination.Port)
+	}
+	return line + " -j DNAT --to-destination " + r.RedirectTo.String(), nil
+}
+
+// parseRule parses a rule in the form returned by formatRule.
+func parseRule(line string) (Rule, error) {
+	f := strings.Fields(line)
+	if len(f) < 10 || f[0] != "-A" || f[1] != Chain || f[2] != "-d" || f[4] != "-p" || f[5] != "tcp" {
+		return Rule{}, fmt.Errorf("unrecognized rule %q", line)
+	}
+	ip, ipnet, err := net.ParseCIDR(f[3])
+	if err != nil {
+		return Rule{}, fmt.Errorf("unrecognized rule %q", line)
+	}
+	if ones, bits := ipnet.Mask.Size(); ones != bits {
+		return Rule{}, fmt.Errorf("unrecognized rule %q", line)
+	}
+	dst := &net.TCPAddr{IP: ip}
+	f = f[6:]
+	if len(f) == 8 && f[0] == "-m" && f[1] == "tcp" && f[2] == "--dport" {
+		port, err := strconv.ParseUint(f[3], 10, 16)
+		if err != nil || port == 0 {
+			return Rule{}, fmt.Errorf("unrecognized rule %q", line)
+		}
+		dst.Port = int(port)
+		f = f[4:]
+	}
+	if len(f) != 4 || f[0] != "-j" || f[1] != "DNAT" || f[2] != "--to-destination" {
+		return Rule{}, fmt.Errorf("unrecognized rule %q", line)
+	}
+	to, err := net.ResolveTCPAddr("tcp", f[3])
+	if err != nil || to.IP == nil || to.Port == 0 {
+		return Rule{}, fmt.Errorf("unrecognized rule %q", line)
+	}
+	return Rule{Destination: dst, RedirectTo: to}, nil
+}
@@ -0,0 +1,213 @@
+package netrules
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeNAT is an in-memory nat table that understands the subset of
+// iptables-save and iptables-restore used by IPTables.  PREROUTING jumps to
+// the chains in prerouting, in order.
+type fakeNAT struct {
+	chain      bool
+	prerouting []string
+	rules      []string
+}
+
+// jumps returns how many times PREROUTING jumps to Chain.
+func (f *fakeNAT) jumps() int {
+	n := 0
+	for _, c := range f.prerouting {
+		if c == Chain {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeNAT) run(stdin string, name string, arg ...string) (string, error) {
+	switch name {
+	case "iptables-save":
+		var out strings.Builder
+		out.WriteString("*nat\n:PREROUTING ACCEPT [0:0]\n:KUBE-SERVICES - [0:0]\n")
+		if f.chain {
+			fmt.Fprintf(&out, ":%s - [0:0]\n", Chain)
+		}
+		for _, c := range f.prerouting {
+			fmt.Fprintf(&out, "-A PREROUTING -j %s\n", c)
+		}
+		for _, r := range f.rules {
+			out.WriteString(r + "\n")
+		}
+		out.WriteString("COMMIT\n")
+		return out.String(), nil
+	case "iptables-restore":
+		if !reflect.DeepEqual(arg, []string{"--noflush", "--wait"}) {
+			return "", fmt.Errorf("unexpected arguments %v", arg)
+		}
+		// Apply the transaction to a copy, so that it's all or nothing.
+		next := *f
+		next.prerouting = append([]string{}, f.prerouting...)
+		for _, line := range strings.Split(strings.TrimSpace(stdin), "\n") {
+			switch {
+			case line == "*nat" || line == "COMMIT":
+			case line == ":"+Chain+" - [0:0]":
+				next.chain, next.rules = true, nil
+			case strings.HasPrefix(line, "-A "+Chain+" "):
+				if !next.chain {
+					return "", fmt.Errorf("no chain %s", Chain)
+				}
+				next.rules = append(next.rules, line)
+			case line == "-I PREROUTING -j "+Chain:
+				next.prerouting = append([]string{Chain}, next.prerouting...)
+			case line == "-D PREROUTING -j "+Chain:
+				i := 0
+				for i < len(next.prerouting) && next.prerouting[i] != Chain {
+					i++
+				}
+				if i == len(next.prerouting) {
+					return "", fmt.Errorf("no such rule")
+				}
+				next.prerouting = append(next.prerouting[:i:i], next.prerouting[i+1:]...)
+			case line == "-X "+Chain:
+				if next.jumps() > 0 || len(next.rules) > 0 {
+					return "", fmt.Errorf("chain %s in use", Chain)
+				}
+				next.chain = false
+			default:
+				return "", fmt.Errorf("unexpected line %q", line)
+			}
+		}
+		*f = next
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected command %s", name)
+}
+
+func testRule(dst, to string) Rule {
+	d, err := net.ResolveTCPAddr("tcp", dst)
+	if err != nil {
+		panic(err)
+	}
+	t, err := net.ResolveTCPAddr("tcp", to)
+	if err != nil {
+		panic(err)
+	}
+	return Rule{Destination: d, RedirectTo: t}
+}
+
+func TestFormatRule(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		rule   Rule
+		expect string
+	}{
+		{testRule("169.254.169.254:80", "127.0.0.1:988"), "-A METADATA-PROXY -d 169.254.169.254/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 127.0.0.1:988"},
+		{testRule("169.254.169.254:0", "10.0.0.2:988"), "-A METADATA-PROXY -d 169.254.169.254/32 -p tcp -j DNAT --to-destination 10.0.0.2:988"},
+		{testRule("[fd00:ec2::254]:80", "[fd00::2]:988"), "-A METADATA-PROXY -d fd00:ec2::254/128 -p tcp -m tcp --dport 80 -j DNAT --to-destination [fd00::2]:988"},
+	}
+	for _, tc := range tests {
+		line, err := formatRule(tc.rule)
+		if err != nil {
+			t.Errorf("Unexpected error formatting %v: %v", tc.rule, err)
+			continue
+		}
+		if line != tc.expect {
+			t.Errorf("Got %q, expected %q", line, tc.expect)
+		}
+		if r, err := parseRule(line); err != nil || !equalRules([]Rule{r}, []Rule{tc.rule}) {
+			t.Errorf("Got %v, %v parsing %q, expected %v", r, err, line, tc.rule)
+		}
+	}
+
+	for _, bad := range []Rule{
+		{},
+		testRule("169.254.169.254:80", "127.0.0.1:0"),
+		testRule("169.254.169.254:80", "[::1]:988"),
+	} {
+		if _, err := formatRule(bad); err == nil {
+			t.Errorf("Got nil error formatting %v, expected an error", bad)
+		}
+	}
+	for _, bad := range []string{
+		"-A METADATA-PROXY -d 169.254.169.254/32 -p tcp -m tcp --dport 80 -j ACCEPT",
+		"-A METADATA-PROXY -d 169.254.0.0/16 -p tcp -j DNAT --to-destination 127.0.0.1:988",
+		"-A METADATA-PROXY -s 10.0.0.0/8 -d 169.254.169.254/32 -p tcp -j DNAT --to-destination 127.0.0.1:988",
+	} {
+		if _, err := parseRule(bad); err == nil {
+			t.Errorf("Got nil error parsing %q, expected an error", bad)
+		}
+	}
+}
+
+func TestIPTables(t *testing.T) {
+	t.Parallel()
+	nat := &fakeNAT{prerouting: []string{"KUBE-SERVICES"}}
+	b := &IPTables{"iptables-save", "iptables-restore", nat.run}
+	rules := []Rule{
+		testRule("169.254.169.254:80", "127.0.0.1:988"),
+		testRule("169.254.169.254:8080", "127.0.0.1:988"),
+	}
+
+	if installed, err := b.Installed(); err != nil || installed != nil {
+		t.Fatalf("Got %v, %v from empty table, expected no rules", installed, err)
+	}
+	if err := b.Install(rules); err != nil {
+		t.Fatalf("Unexpected error installing: %v", err)
+	}
+	installed, err := b.Installed()
+	if err != nil || !equalRules(installed, rules) {
+		t.Errorf("Got %v, %v, expected %v", installed, err, rules)
+	}
+
+	// Reinstalling replaces the rules without adding a second jump.
+	if err := b.Install(rules[:1]); err != nil {
+		t.Fatalf("Unexpected error reinstalling: %v", err)
+	}
+	if installed, err := b.Installed(); err != nil || !equalRules(installed, rules[:1]) {
+		t.Errorf("Got %v, %v, expected %v", installed, err, rules[:1])
+	}
+
+	// Foreign rules in the chain show up as zero rules.
+	nat.rules = append(nat.rules, "-A METADATA-PROXY -j ACCEPT")
+	if installed, err := b.Installed(); err != nil || equalRules(installed, rules[:1]) {
+		t.Errorf("Got %v, %v with a foreign rule, expected it to differ from %v", installed, err, rules[:1])
+	}
+
+	// Without the jump, the chain's rules aren't in effect.
+	nat.prerouting = []string{"KUBE-SERVICES"}
+	if installed, err := b.Installed(); err != nil || installed != nil {
+		t.Errorf("Got %v, %v without a jump, expected no rules", installed, err)
+	}
+
+	// Nor are they, taking precedence, if other rules come first, or if
+	// the jump is repeated, and then it's moved back to the start.
+	for _, prerouting := range [][]string{
+		{"KUBE-SERVICES", Chain},
+		{Chain, "KUBE-SERVICES", Chain},
+	} {
+		nat.prerouting = prerouting
+		if installed, err := b.Installed(); err != nil || installed != nil {
+			t.Errorf("Got %v, %v with PREROUTING %q, expected no rules", installed, err, prerouting)
+		}
+		if err := b.Install(rules); err != nil {
+			t.Fatalf("Unexpected error reinstalling: %v", err)
+		}
+		if expect := []string{Chain, "KUBE-SERVICES"}; !reflect.DeepEqual(nat.prerouting, expect) {
+			t.Errorf("Got PREROUTING %q after reinstalling, expected %q", nat.prerouting, expect)
+		}
+	}
+
+	if err := b.Uninstall(); err != nil {
+		t.Fatalf("Unexpected error uninstalling: %v", err)
+	}
+	if nat.chain || nat.jumps() > 0 {
+		t.Errorf("Got chain %v and %d jumps after uninstalling, expected neither", nat.chain, nat.jumps())
+	}
+	if err := b.Uninstall(); err != nil {
+		t.Errorf("Unexpected error uninstalling twice: %v", err)
+	}
+}
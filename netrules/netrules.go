@@ -0,0 +1,121 @@
+// Package netrules installs and maintains the netfilter rules that redirect
+// traffic bound for the metadata server to the proxy.
+package netrules
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metrics"
+)
+
+// Results of a reconciliation, as recorded by metrics.RuleReconcileCounter.
+const (
+	resultUnchanged = "unchanged"
+	resultUpdated   = "updated"
+	resultFailed    = "failed"
+)
+
+// Rule redirects TCP connections bound for Destination to RedirectTo.
+type Rule struct {
+	// Destination is the address redirected.  A zero port matches every
+	// port.
+	Destination *net.TCPAddr
+	// RedirectTo is the address the proxy listens on.
+	RedirectTo *net.TCPAddr
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%v -> %v", r.Destination, r.RedirectTo)
+}
+
+// Backend installs rules into the kernel.  Only the rules a Backend has
+// installed itself are visible to, or touched by, it.
+type Backend interface {
+	// Installed returns the rules that are currently installed and in
+	// effect, in order.
+	Installed() ([]Rule, error)
+	// Install atomically replaces the installed rules with rules.
+	Install(rules []Rule) error
+	// Uninstall removes every installed rule.
+	Uninstall() error
+}
+
+// Manager keeps a Backend's installed rules in line with Rules.
+type Manager struct {
+	Backend Backend
+	Rules   []Rule
+	// FailClosed leaves the rules installed when the manager is closed,
+	// so that traffic keeps being redirected to the proxy while it's down
+	// and fails, rather than reaching the metadata server unfiltered.
+	FailClosed bool
+}
+
+// Reconcile installs Rules if they aren't already in effect.  It returns
+// whether the installed rules were changed.
+func (m *Manager) Reconcile() (bool, error) {
+	installed, err := m.Backend.Installed()
+	if err != nil {
+		metrics.RuleReconcileCounter.WithLabelValues(resultFailed).Inc()
+		return false, fmt.Errorf("failed to list installed rules: %v", err)
+	}
+	if equalRules(installed, m.Rules) {
+		metrics.RuleReconcileCounter.WithLabelValues(resultUnchanged).Inc()
+		return false, nil
+	}
+	if err := m.Backend.Install(m.Rules); err != nil {
+		metrics.RuleReconcileCounter.WithLabelValues(resultFailed).Inc()
+		return false, fmt.Errorf("failed to install rules: %v", err)
+	}
+	metrics.RuleReconcileCounter.WithLabelValues(resultUpdated).Inc()
+	return true, nil
+}
+
+// Run reconciles every interval until stop is closed.  Failures are logged
+// and retried on the next tick.
+func (m *Manager) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if changed, err := m.Reconcile(); err != nil {
+			log.Printf("Failed to reconcile redirect rules: %v", err)
+		} else if changed {
+			log.Printf("Reinstalled redirect rules %v", m.Rules)
+		}
+	}
+}
+
+// Close uninstalls the rules, unless the manager fails closed.
+func (m *Manager) Close() error {
+	if m.FailClosed {
+		return nil
+	}
+	return m.Backend.Uninstall()
+}
+
+// equalRules returns whether a and b are the same rules in the same order.
+func equalRules(a, b []Rule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !equalAddr(a[i].Destination, b[i].Destination) || !equalAddr(a[i].RedirectTo, b[i].RedirectTo) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalAddr(a, b *net.TCPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
@@ -0,0 +1,109 @@
+package netrules_test
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/netrules"
+)
+
+// fakeBackend is a Backend that keeps its rules in memory.
+type fakeBackend struct {
+	rules      []netrules.Rule
+	installs   int
+	uninstalls int
+	err        error
+}
+
+func (f *fakeBackend) Installed() ([]netrules.Rule, error) {
+	return f.rules, f.err
+}
+
+func (f *fakeBackend) Install(rules []netrules.Rule) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.installs++
+	f.rules = append([]netrules.Rule(nil), rules...)
+	return nil
+}
+
+func (f *fakeBackend) Uninstall() error {
+	if f.err != nil {
+		return f.err
+	}
+	f.uninstalls++
+	f.rules = nil
+	return nil
+}
+
+func rule(dst, to string) netrules.Rule {
+	d, err := net.ResolveTCPAddr("tcp", dst)
+	if err != nil {
+		panic(err)
+	}
+	t, err := net.ResolveTCPAddr("tcp", to)
+	if err != nil {
+		panic(err)
+	}
+	return netrules.Rule{Destination: d, RedirectTo: t}
+}
+
+var metadataRules = []netrules.Rule{rule("169.254.169.254:80", "127.0.0.1:988")}
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+	b := &fakeBackend{}
+	m := &netrules.Manager{Backend: b, Rules: metadataRules}
+
+	if changed, err := m.Reconcile(); err != nil || !changed {
+		t.Fatalf("Got %v, %v on first reconcile, expected rules to be installed", changed, err)
+	}
+	if !reflect.DeepEqual(b.rules, metadataRules) {
+		t.Errorf("Got rules %v, expected %v", b.rules, metadataRules)
+	}
+	// Reconciling again is a no-op.
+	if changed, err := m.Reconcile(); err != nil || changed {
+		t.Errorf("Got %v, %v on second reconcile, expected no change", changed, err)
+	}
+	if b.installs != 1 {
+		t.Errorf("Got %d installs, expected 1", b.installs)
+	}
+
+	// Rules that are tampered with are put back.
+	b.rules = []netrules.Rule{rule("169.254.169.254:80", "127.0.0.1:999")}
+	if changed, err := m.Reconcile(); err != nil || !changed {
+		t.Errorf("Got %v, %v after tampering, expected rules to be reinstalled", changed, err)
+	}
+	b.rules = nil
+	if changed, err := m.Reconcile(); err != nil || !changed {
+		t.Errorf("Got %v, %v after removal, expected rules to be reinstalled", changed, err)
+	}
+	if !reflect.DeepEqual(b.rules, metadataRules) {
+		t.Errorf("Got rules %v, expected %v", b.rules, metadataRules)
+	}
+
+	b.err = errors.New("iptables is locked")
+	if _, err := m.Reconcile(); err == nil {
+		t.Errorf("Got nil error from failing backend, expected an error")
+	}
+}
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+	for _, failClosed := range []bool{false, true} {
+		b := &fakeBackend{}
+		m := &netrules.Manager{Backend: b, Rules: metadataRules, FailClosed: failClosed}
+		if _, err := m.Reconcile(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Close(); err != nil {
+			t.Errorf("Unexpected error closing: %v", err)
+		}
+		if installed := b.rules != nil; installed != failClosed {
+			t.Errorf("Got rules installed %v after closing with fail closed %v, expected %v", installed, failClosed, failClosed)
+		}
+	}
+}
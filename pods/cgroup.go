@@ -0,0 +1,83 @@
+package pods
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Cgroup is what a process's cgroup says about the container and pod it
+// runs in.
+type Cgroup struct {
+	// Path is the process's cgroup, as in "/kubepods/burstable/pod<uid>/<id>".
+	Path string
+	// PodUID is the UID of the pod the process runs in, or "" if it isn't
+	// in a pod.
+	PodUID string
+	// ContainerID is the ID of the container the process runs in, or "" if
+	// it isn't in a container.
+	ContainerID string
+}
+
+var (
+	// podUIDPattern matches the pod UIDs in the cgroup paths of the
+	// cgroupfs and systemd drivers, where dashes are underscores.
+	podUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+	// containerIDPattern matches the last element of a container's cgroup
+	// path, as named by Docker, containerd and CRI-O.
+	containerIDPattern = regexp.MustCompile(`^(?:docker-|cri-containerd-|crio-)?([0-9a-f]{64})(?:\.scope)?$`)
+)
+
+// ParseCgroup parses the contents of /proc/<pid>/cgroup.  Of the process's
+// cgroups, the one in a Kubernetes pod is used if there's one, and otherwise
+// the cgroup v2 one.
+func ParseCgroup(data []byte) (Cgroup, error) {
+	var paths, v2 []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// Lines are hierarchy-ID:controllers:path.
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		paths = append(paths, fields[2])
+		if fields[0] == "0" && fields[1] == "" {
+			v2 = append(v2, fields[2])
+		}
+	}
+	if len(paths) == 0 {
+		return Cgroup{}, fmt.Errorf("no cgroups in %q", data)
+	}
+	for _, p := range paths {
+		if strings.Contains(p, "kubepods") {
+			return cgroupFor(p), nil
+		}
+	}
+	if len(v2) > 0 {
+		return cgroupFor(v2[0]), nil
+	}
+	return cgroupFor(paths[0]), nil
+}
+
+func cgroupFor(path string) Cgroup {
+	c := Cgroup{Path: path}
+	if m := podUIDPattern.FindStringSubmatch(path); m != nil {
+		c.PodUID = strings.Replace(m[1], "_", "-", -1)
+	}
+	if m := containerIDPattern.FindStringSubmatch(filepath.Base(path)); m != nil {
+		c.ContainerID = m[1]
+	}
+	return c
+}
+
+// ReadCgroup reads the cgroup of the process pid from the proc filesystem
+// mounted at procRoot.
+func ReadCgroup(procRoot string, pid int) (Cgroup, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return Cgroup{}, err
+	}
+	return ParseCgroup(data)
+}
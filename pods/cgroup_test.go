@@ -0,0 +1,84 @@
+package pods
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const containerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseCgroup(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		data   string
+		expect Cgroup
+	}{
+		{
+			"cgroup v2 cgroupfs",
+			"0::/kubepods/burstable/pod1b2c3d4e-0000-1111-2222-333344445555/" + containerID + "\n",
+			Cgroup{"/kubepods/burstable/pod1b2c3d4e-0000-1111-2222-333344445555/" + containerID, "1b2c3d4e-0000-1111-2222-333344445555", containerID},
+		},
+		{
+			"cgroup v2 systemd containerd",
+			"0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1b2c3d4e_0000_1111_2222_333344445555.slice/cri-containerd-" + containerID + ".scope\n",
+			Cgroup{"/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1b2c3d4e_0000_1111_2222_333344445555.slice/cri-containerd-" + containerID + ".scope", "1b2c3d4e-0000-1111-2222-333344445555", containerID},
+		},
+		{
+			"cgroup v1",
+			"12:cpuset:/\n11:memory:/kubepods/pod1b2c3d4e-0000-1111-2222-333344445555/" + containerID + "\n1:name=systemd:/\n0::/\n",
+			Cgroup{"/kubepods/pod1b2c3d4e-0000-1111-2222-333344445555/" + containerID, "1b2c3d4e-0000-1111-2222-333344445555", containerID},
+		},
+		{
+			"docker",
+			"0::/system.slice/docker-" + containerID + ".scope\n",
+			Cgroup{"/system.slice/docker-" + containerID + ".scope", "", containerID},
+		},
+		{
+			"host service",
+			"0::/system.slice/node-agent.service\n",
+			Cgroup{"/system.slice/node-agent.service", "", ""},
+		},
+		{
+			"cgroup v1 host",
+			"4:memory:/user.slice\n1:name=systemd:/user.slice/session-1.scope\n",
+			Cgroup{"/user.slice", "", ""},
+		},
+	}
+	for _, tc := range tests {
+		got, err := ParseCgroup([]byte(tc.data))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if got != tc.expect {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, got, tc.expect)
+		}
+	}
+	if _, err := ParseCgroup([]byte("\n")); err == nil {
+		t.Errorf("Got nil error for no cgroups, expected an error")
+	}
+}
+
+func TestReadCgroup(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "42"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "42", "cgroup"), []byte("0::/system.slice/sshd.service\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := ReadCgroup(dir, 42); err != nil || c.Path != "/system.slice/sshd.service" {
+		t.Errorf("Got %+v, %v, expected path /system.slice/sshd.service", c, err)
+	}
+	if _, err := ReadCgroup(dir, 43); err == nil {
+		t.Errorf("Got nil error for a missing process, expected an error")
+	}
+}
@@ -0,0 +1,244 @@
+// Package pods maps the addresses and processes of clients to the Kubernetes
+// pods they belong to.
+package pods
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotSynced is returned by Lookup while the resolver's view of the node's
+// pods is missing or out of date.
+var ErrNotSynced = errors.New("pod resolver isn't synced")
+
+// Pod identifies a pod.
+type Pod struct {
+	Namespace      string
+	Name           string
+	UID            string
+	ServiceAccount string
+	Labels         map[string]string
+}
+
+func (p *Pod) String() string {
+	return p.Namespace + "/" + p.Name
+}
+
+// KubeletResolver resolves pod IPs and UIDs by polling the kubelet's list of
+// the pods on its node.  Pods using the host network are left out of the IPs,
+// since their IP is the node's.
+type KubeletResolver struct {
+	url      string
+	client   *http.Client
+	interval time.Duration
+	now      func() time.Time
+
+	mu       sync.RWMutex
+	byIP     map[string]*Pod
+	byUID    map[string]*Pod
+	lastSync time.Time
+}
+
+// NewKubeletResolver returns a resolver that polls the kubelet's /pods
+// endpoint at url every interval.  It's considered out of date once three
+// polls in a row have failed.
+func NewKubeletResolver(url string, client *http.Client, interval time.Duration) *KubeletResolver {
+	return &KubeletResolver{
+		url:      url,
+		client:   client,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// NewAPIClient returns a client for a Kubernetes API, the kubelet's or the
+// API server's, that authenticates with the bearer token in tokenFile, if
+// set, and trusts the CAs in caFile, if set.  The token file is re-read for
+// every request, so that rotated tokens are picked up.
+func NewAPIClient(tokenFile, caFile string, timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA file %q", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	var rt http.RoundTripper = transport
+	if tokenFile != "" {
+		rt = bearerTransport{tokenFile, transport}
+	}
+	return &http.Client{Transport: rt, Timeout: timeout}, nil
+}
+
+// bearerTransport adds the bearer token read from tokenFile to requests.
+type bearerTransport struct {
+	tokenFile string
+	base      http.RoundTripper
+}
+
+func (b bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := ioutil.ReadFile(b.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token: %v", err)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return b.base.RoundTrip(req)
+}
+
+// podList is the subset of a v1.PodList the resolver uses.
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			UID       string            `json:"uid"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			ServiceAccountName string `json:"serviceAccountName"`
+			HostNetwork        bool   `json:"hostNetwork"`
+		} `json:"spec"`
+		Status struct {
+			Phase  string `json:"phase"`
+			PodIP  string `json:"podIP"`
+			PodIPs []struct {
+				IP string `json:"ip"`
+			} `json:"podIPs"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// Sync polls the kubelet once.
+func (r *KubeletResolver) Sync() error {
+	resp, err := r.client.Get(r.url)
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list pods: %s", resp.Status)
+	}
+	var list podList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("failed to parse pod list: %v", err)
+	}
+
+	byIP, byUID := map[string]*Pod{}, map[string]*Pod{}
+	for _, item := range list.Items {
+		// Finished pods' IPs may already belong to other pods.
+		if item.Status.Phase == "Succeeded" || item.Status.Phase == "Failed" {
+			continue
+		}
+		pod := &Pod{
+			Namespace:      item.Metadata.Namespace,
+			Name:           item.Metadata.Name,
+			UID:            item.Metadata.UID,
+			ServiceAccount: item.Spec.ServiceAccountName,
+			Labels:         item.Metadata.Labels,
+		}
+		// Host network pods can still be found from their processes'
+		// cgroups.
+		byUID[pod.UID] = pod
+		if item.Spec.HostNetwork {
+			continue
+		}
+		ips := []string{item.Status.PodIP}
+		for _, ip := range item.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+		for _, s := range ips {
+			if ip := net.ParseIP(s); ip != nil {
+				byIP[ip.String()] = pod
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byIP = byIP
+	r.byUID = byUID
+	r.lastSync = r.now()
+	return nil
+}
+
+// Run polls the kubelet every interval until stop is closed.
+func (r *KubeletResolver) Run(stop <-chan struct{}) {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		if err := r.Sync(); err != nil {
+			log.Printf("Failed to sync pods: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Synced returns whether the resolver's view of the node's pods is up to
+// date.
+func (r *KubeletResolver) Synced() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.synced()
+}
+
+func (r *KubeletResolver) synced() bool {
+	return !r.lastSync.IsZero() && r.now().Sub(r.lastSync) <= 3*r.interval
+}
+
+// Lookup returns the pod with the given IP, or nil if there's none.  It
+// returns ErrNotSynced if the resolver is out of date.
+func (r *KubeletResolver) Lookup(ip net.IP) (*Pod, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !r.synced() {
+		return nil, ErrNotSynced
+	}
+	return r.byIP[ip.String()], nil
+}
+
+// Cached returns the pod that had the given IP when the resolver last
+// synced, however long ago that was, or nil if there was none.
+func (r *KubeletResolver) Cached(ip net.IP) *Pod {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byIP[ip.String()]
+}
+
+// LookupUID returns the running pod with the given UID, or nil if there's
+// none.  It returns ErrNotSynced if the resolver is out of date.
+func (r *KubeletResolver) LookupUID(uid string) (*Pod, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !r.synced() {
+		return nil, ErrNotSynced
+	}
+	return r.byUID[uid], nil
+}
+
+// CachedUID returns the pod that had the given UID when the resolver last
+// synced, or nil if there was none.
+func (r *KubeletResolver) CachedUID(uid string) *Pod {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byUID[uid]
+}
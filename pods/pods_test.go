@@ -0,0 +1,139 @@
+package pods
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const podListJSON = `{"items": [
+	{"metadata": {"name": "web-1", "namespace": "default", "uid": "u1", "labels": {"tier": "prod"}},
+	 "spec": {"serviceAccountName": "web"},
+	 "status": {"phase": "Running", "podIP": "10.0.0.5", "podIPs": [{"ip": "10.0.0.5"}, {"ip": "fd00::5"}]}},
+	{"metadata": {"name": "node-agent", "namespace": "kube-system", "uid": "u2"},
+	 "spec": {"serviceAccountName": "agent", "hostNetwork": true},
+	 "status": {"phase": "Running", "podIP": "10.128.0.2"}},
+	{"metadata": {"name": "job-1", "namespace": "batch", "uid": "u3"},
+	 "spec": {"serviceAccountName": "default"},
+	 "status": {"phase": "Succeeded", "podIP": "10.0.0.6"}}
+]}`
+
+func TestKubeletResolver(t *testing.T) {
+	t.Parallel()
+	fail := false
+	kubelet := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if fail {
+			http.Error(rw, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(rw, podListJSON)
+	}))
+	defer kubelet.Close()
+
+	now := time.Unix(1000, 0)
+	r := NewKubeletResolver(kubelet.URL+"/pods", kubelet.Client(), time.Minute)
+	r.now = func() time.Time { return now }
+
+	if _, err := r.Lookup(net.ParseIP("10.0.0.5")); err != ErrNotSynced {
+		t.Errorf("Got %v before syncing, expected %v", err, ErrNotSynced)
+	}
+	if err := r.Sync(); err != nil {
+		t.Fatalf("Unexpected error syncing: %v", err)
+	}
+
+	tests := []struct {
+		ip     string
+		expect string
+	}{
+		{"10.0.0.5", "default/web-1"},
+		{"fd00::5", "default/web-1"},
+		{"::ffff:10.0.0.5", "default/web-1"},
+		{"10.128.0.2", ""},
+		{"10.0.0.6", ""},
+		{"10.0.0.7", ""},
+	}
+	for _, tc := range tests {
+		pod, err := r.Lookup(net.ParseIP(tc.ip))
+		if err != nil {
+			t.Errorf("Unexpected error looking up %s: %v", tc.ip, err)
+			continue
+		}
+		if got := podString(pod); got != tc.expect {
+			t.Errorf("Got %q for %s, expected %q", got, tc.ip, tc.expect)
+		}
+	}
+	if pod, _ := r.Lookup(net.ParseIP("10.0.0.5")); pod.ServiceAccount != "web" || pod.UID != "u1" || pod.Labels["tier"] != "prod" {
+		t.Errorf("Got pod %+v, expected service account web, UID u1 and label tier=prod", pod)
+	}
+	for uid, expect := range map[string]string{"u1": "default/web-1", "u2": "kube-system/node-agent", "u3": "", "u4": ""} {
+		pod, err := r.LookupUID(uid)
+		if err != nil {
+			t.Errorf("Unexpected error looking up UID %s: %v", uid, err)
+		} else if got := podString(pod); got != expect {
+			t.Errorf("Got %q for UID %s, expected %q", got, uid, expect)
+		}
+	}
+
+	// Failed polls leave the resolver synced for a while, and then not.
+	fail = true
+	if err := r.Sync(); err == nil {
+		t.Errorf("Got nil error syncing with kubelet down, expected an error")
+	}
+	now = now.Add(2 * time.Minute)
+	if !r.Synced() {
+		t.Errorf("Got resolver not synced after one failed poll, expected it synced")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := r.Lookup(net.ParseIP("10.0.0.5")); err != ErrNotSynced {
+		t.Errorf("Got %v after the kubelet has been down for 4m, expected %v", err, ErrNotSynced)
+	}
+	if got := podString(r.Cached(net.ParseIP("10.0.0.5"))); got != "default/web-1" {
+		t.Errorf("Got cached pod %q, expected %q", got, "default/web-1")
+	}
+}
+
+func TestAPIClientToken(t *testing.T) {
+	t.Parallel()
+	var auth string
+	kubelet := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		auth = req.Header.Get("Authorization")
+	}))
+	defer kubelet.Close()
+
+	dir, err := ioutil.TempDir("", "pods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	client, err := NewAPIClient(tokenFile, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"first", "rotated"} {
+		if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(kubelet.URL)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if auth != "Bearer "+token {
+			t.Errorf("Got Authorization %q, expected %q", auth, "Bearer "+token)
+		}
+	}
+}
+
+func podString(p *Pod) string {
+	if p == nil {
+		return ""
+	}
+	return p.String()
+}
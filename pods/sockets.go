@@ -0,0 +1,146 @@
+package pods
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FindSocketOwner returns the pid and uid of a process owning the TCP socket
+// connected from local to remote, by looking it up in the proc filesystem
+// mounted at procRoot.  The socket must be in the network namespace procRoot
+// shows, and the caller must be allowed to read the file descriptors of the
+// process.  Finding the pid means reading every process's file descriptors.
+func FindSocketOwner(procRoot string, local, remote *net.TCPAddr) (pid int, uid uint32, err error) {
+	inode, uid, err := findSocket(procRoot, local, remote)
+	if err != nil {
+		return 0, 0, err
+	}
+	pid, err = findInodeOwner(procRoot, inode)
+	if err != nil {
+		return 0, 0, err
+	}
+	return pid, uid, nil
+}
+
+// findSocket returns the inode and owner of the TCP socket connected from
+// local to remote, from /proc/net/tcp and /proc/net/tcp6.
+func findSocket(procRoot string, local, remote *net.TCPAddr) (inode string, uid uint32, err error) {
+	for _, name := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(filepath.Join(procRoot, "net", name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		inode, uid, err := scanSockets(f, local, remote)
+		f.Close()
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to read %s sockets: %v", name, err)
+		}
+		if inode != "" {
+			return inode, uid, nil
+		}
+	}
+	return "", 0, fmt.Errorf("no socket from %v to %v", local, remote)
+}
+
+// scanSockets finds the socket connected from local to remote in the
+// contents of /proc/net/tcp or /proc/net/tcp6, whose lines are:
+//
+//	sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ...
+func scanSockets(f *os.File, local, remote *net.TCPAddr) (inode string, uid uint32, err error) {
+	s := bufio.NewScanner(f)
+	// Skip the header.
+	s.Scan()
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		// Sockets in TIME_WAIT have no inode.
+		if fields[9] == "0" {
+			continue
+		}
+		l, err := parseProcAddr(fields[1])
+		if err != nil {
+			return "", 0, err
+		}
+		r, err := parseProcAddr(fields[2])
+		if err != nil {
+			return "", 0, err
+		}
+		if !equalTCPAddr(l, local) || !equalTCPAddr(r, remote) {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[7], 10, 32)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid uid %q", fields[7])
+		}
+		return fields[9], uint32(n), nil
+	}
+	return "", 0, s.Err()
+}
+
+// parseProcAddr parses an address in /proc/net/tcp or /proc/net/tcp6, such
+// as "0100007F:03DC".  The kernel writes IP addresses as 32-bit words in host
+// byte order, and ports in hex.
+func parseProcAddr(s string) (*net.TCPAddr, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid socket address %q", s)
+	}
+	words, err := hex.DecodeString(s[:i])
+	if err != nil || (len(words) != net.IPv4len && len(words) != net.IPv6len) {
+		return nil, fmt.Errorf("invalid socket address %q", s)
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket address %q", s)
+	}
+	ip := make(net.IP, len(words))
+	for j := 0; j < len(words); j += 4 {
+		binary.NativeEndian.PutUint32(ip[j:], binary.BigEndian.Uint32(words[j:]))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func equalTCPAddr(a, b *net.TCPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// findInodeOwner returns the pid of a process with a file descriptor for the
+// socket with the given inode.
+func findInodeOwner(procRoot, inode string) (int, error) {
+	procs, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return 0, err
+	}
+	target := "socket:[" + inode + "]"
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || !proc.IsDir() {
+			continue
+		}
+		fdDir := filepath.Join(procRoot, proc.Name(), "fd")
+		// Processes may exit, or hide their file descriptors from us.
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				return pid, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no process owns socket %s", inode)
+}
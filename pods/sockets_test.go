@@ -0,0 +1,144 @@
+package pods
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// procAddr formats addr as the kernel does in /proc/net/tcp.
+func procAddr(addr string) string {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	ip := tcpAddr.IP.To4()
+	if ip == nil {
+		ip = tcpAddr.IP.To16()
+	}
+	var b strings.Builder
+	for i := 0; i < len(ip); i += 4 {
+		fmt.Fprintf(&b, "%08X", binary.NativeEndian.Uint32(ip[i:]))
+	}
+	return fmt.Sprintf("%s:%04X", b.String(), tcpAddr.Port)
+}
+
+func TestParseProcAddr(t *testing.T) {
+	t.Parallel()
+	for _, addr := range []string{"127.0.0.1:988", "10.0.0.5:41000", "[::1]:988", "[fd00::5]:80", "[::ffff:127.0.0.1]:988"} {
+		got, err := parseProcAddr(procAddr(addr))
+		if err != nil {
+			t.Errorf("Unexpected error parsing %s: %v", procAddr(addr), err)
+			continue
+		}
+		expect, _ := net.ResolveTCPAddr("tcp", addr)
+		if !equalTCPAddr(got, expect) {
+			t.Errorf("Got %v for %s, expected %v", got, procAddr(addr), expect)
+		}
+	}
+	for _, bad := range []string{"", "0100007F", "0100007:03DC", "0100007F:XYZ", "0100007F00:03DC"} {
+		if _, err := parseProcAddr(bad); err == nil {
+			t.Errorf("Got nil error parsing %q, expected an error", bad)
+		}
+	}
+}
+
+func TestFindSocketOwner(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, data string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(pid, fd, target string) {
+		if err := os.MkdirAll(filepath.Join(dir, pid, "fd"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, filepath.Join(dir, pid, "fd", fd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const header = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	line := func(local, remote, st, uid, inode string) string {
+		return fmt.Sprintf("   0: %s %s %s 00000000:00000000 00:00000000 00000000 %5s        0 %s 1 0000000000000000 20 4 30 10 -1\n", procAddr(local), procAddr(remote), st, uid, inode)
+	}
+	write("net/tcp", header+
+		line("127.0.0.1:988", "0.0.0.0:0", "0A", "0", "100")+
+		line("127.0.0.1:988", "127.0.0.1:41000", "01", "0", "101")+
+		line("127.0.0.1:41000", "127.0.0.1:988", "01", "1000", "102")+
+		line("127.0.0.1:41001", "127.0.0.1:988", "06", "1000", "0")+
+		line("127.0.0.1:41002", "127.0.0.1:988", "01", "1001", "103"))
+	write("net/tcp6", header+
+		line("[::1]:42000", "[::1]:988", "01", "1002", "104"))
+	link("1", "3", "socket:[100]")
+	link("1", "4", "socket:[101]")
+	link("20", "0", "/dev/null")
+	link("20", "7", "socket:[102]")
+	link("30", "5", "socket:[104]")
+
+	tests := []struct {
+		local, remote string
+		expectPid     int
+		expectUID     uint32
+		expectErr     bool
+	}{
+		{"127.0.0.1:41000", "127.0.0.1:988", 20, 1000, false},
+		{"[::ffff:127.0.0.1]:41000", "127.0.0.1:988", 20, 1000, false},
+		{"[::1]:42000", "[::1]:988", 30, 1002, false},
+		// In TIME_WAIT.
+		{"127.0.0.1:41001", "127.0.0.1:988", 0, 0, true},
+		// No process has it open.
+		{"127.0.0.1:41002", "127.0.0.1:988", 0, 0, true},
+		{"127.0.0.1:41003", "127.0.0.1:988", 0, 0, true},
+	}
+	for _, tc := range tests {
+		local, _ := net.ResolveTCPAddr("tcp", tc.local)
+		remote, _ := net.ResolveTCPAddr("tcp", tc.remote)
+		pid, uid, err := FindSocketOwner(dir, local, remote)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("Got error %v for %s -> %s, expected error: %t", err, tc.local, tc.remote, tc.expectErr)
+			continue
+		}
+		if pid != tc.expectPid || uid != tc.expectUID {
+			t.Errorf("Got pid %d, uid %d for %s -> %s, expected %d, %d", pid, uid, tc.local, tc.remote, tc.expectPid, tc.expectUID)
+		}
+	}
+}
+
+func TestFindSocketOwnerProc(t *testing.T) {
+	t.Parallel()
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skipf("No /proc/net/tcp: %v", err)
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	pid, uid, err := FindSocketOwner("/proc", c.LocalAddr().(*net.TCPAddr), c.RemoteAddr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pid != os.Getpid() || uid != uint32(os.Getuid()) {
+		t.Errorf("Got pid %d, uid %d, expected %d, %d", pid, uid, os.Getpid(), os.Getuid())
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metrics"
+)
+
+// Audit event priorities.
+const (
+	PriorityHigh = "high"
+)
+
+// AuditEvent is something the proxy saw that should be looked into, such as
+// a caller being served a decoy.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Priority string    `json:"priority"`
+	// Path is the cleaned path requested, and Client the address of the
+	// client.
+	Path   string `json:"path"`
+	Client string `json:"client"`
+	// Namespace, Pod and ServiceAccount describe the calling pod, and UID
+	// and Cgroup the calling process, as far as they're known.
+	Namespace      string  `json:"namespace,omitempty"`
+	Pod            string  `json:"pod,omitempty"`
+	ServiceAccount string  `json:"serviceAccount,omitempty"`
+	UID            *uint32 `json:"uid,omitempty"`
+	Cgroup         string  `json:"cgroup,omitempty"`
+	// Canary identifies the decoy content served, if any.
+	Canary string `json:"canary,omitempty"`
+}
+
+// Auditor records audit events.
+type Auditor interface {
+	Audit(e *AuditEvent)
+}
+
+// jsonAuditor writes audit events to w as JSON, one per line.
+type jsonAuditor struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAuditor returns an auditor writing events to w as JSON, one per
+// line.
+func NewJSONAuditor(w io.Writer) Auditor {
+	return &jsonAuditor{w: w}
+}
+
+func (a *jsonAuditor) Audit(e *AuditEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode audit event: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		log.Printf("Failed to write audit event %s: %v", b, err)
+	}
+}
+
+// logAuditor logs audit events with the standard logger.
+type logAuditor struct{}
+
+func (logAuditor) Audit(e *AuditEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode audit event: %v", err)
+		return
+	}
+	log.Printf("AUDIT %s", b)
+}
+
+// audit records e with the handler's auditor, and counts it.
+func (h *Handler) audit(e *AuditEvent) {
+	metrics.AuditEventCounter.WithLabelValues(e.Event, e.Priority).Inc()
+	h.auditor.Audit(e)
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/extauthz"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metrics"
+)
+
+// reasonNeedsRewrite is the reason for refusing requests in authorization
+// mode whose responses would have to be filtered.
+const reasonNeedsRewrite = "needs_rewrite"
+
+// NewAuthzHandler returns a handler serving h's decisions over the Envoy
+// ext_authz gRPC API, envoy.service.auth.v3.Authorization, for a proxy that
+// forwards the allowed requests itself.  Allowed requests are returned with
+// the changes h would make to them as header mutations: :path is set to the
+// cleaned path and canonical query, and the headers the policy doesn't allow
+// are removed.  Requests whose responses h would filter, such as directory
+// listings with concealed entries, are refused, since an authorization
+// service can't change responses.
+//
+// Callers are resolved by the source address of the checked request, never
+// by the connection the check comes in on, even on the unix socket.  Its
+// X-Forwarded-For header is ignored, since the proxy asking usually sets it,
+// and removed.  Middlewares aren't called.
+func NewAuthzHandler(h *Handler) http.Handler {
+	return extauthz.NewHandler(h.authorize)
+}
+
+// authorize decides an ext_authz CheckRequest as ServeHTTP would the request
+// it describes.
+func (h *Handler) authorize(ctx context.Context, check *extauthz.CheckRequest) *extauthz.CheckResponse {
+	x := &Exchange{Start: time.Now()}
+	var header http.Header
+	req, err := checkedRequest(ctx, check)
+	if err != nil {
+		x.Rejection = &Rejection{
+			Code:    http.StatusBadRequest,
+			Reason:  metadata.ReasonUnparseable,
+			Message: "Metadata proxy could not safely parse request",
+		}
+	} else {
+		log.Println(req.URL.Path)
+		x.Request = req
+		// Filtering changes the header.
+		header = req.Header.Clone()
+		x.Rejection = h.filter(x)
+	}
+	if x.Rejection == nil {
+		// Decide on the query as it's forwarded, as forward does.  HEAD
+		// requests are refused too, since Envoy would return the
+		// metadata server's Content-Length and ETag for them.
+		query, _ := metadata.ParseQuery(req.URL.RawQuery)
+		if x.Policy.NeedsRedaction(query) || x.Policy.NeedsKubeEnvFilter(x.Path) || x.Policy.NeedsListingFilter(x.Path, query) {
+			x.Rejection = &Rejection{
+				Code:    http.StatusForbidden,
+				Reason:  reasonNeedsRewrite,
+				Message: "This metadata request needs its response filtered, which the metadata proxy can't do as an authorization service",
+			}
+		}
+	}
+	countDecision(x)
+
+	if r := x.Rejection; r != nil {
+		d := &extauthz.DeniedHTTPResponse{
+			Status: extauthz.HTTPStatus{Code: extauthz.StatusCode(r.Code)},
+			Headers: []extauthz.HeaderValueOption{
+				{Header: extauthz.HeaderValue{Key: "content-type", Value: "text/plain; charset=utf-8"}},
+			},
+			// As written by http.Error.
+			Body: r.Message + "\n",
+		}
+		// Decoys are served with their own body and Content-Type.
+		if r.Body != nil {
+			d.Headers, d.Body = nil, string(r.Body)
+		}
+		for k, v := range r.Header {
+			for _, v := range v {
+				d.Headers = append(d.Headers, extauthz.HeaderValueOption{Header: extauthz.HeaderValue{Key: strings.ToLower(k), Value: v}})
+			}
+		}
+		return &extauthz.CheckResponse{
+			Status:         extauthz.Status{Code: extauthz.CodePermissionDenied, Message: r.Reason},
+			DeniedResponse: d,
+		}
+	}
+
+	// Filter has already parsed the query, so this can't fail.
+	query, _ := metadata.ParseQuery(req.URL.RawQuery)
+	// Envoy's own timeouts bound the wait, but the metadata server should
+	// still be told to give up when the proxy would.
+	h.capTimeout(query)
+	path := x.Path
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	// Pass on the external authorization service's changes to the headers,
+	// if any, as well as the policy's.
+	headers := append([]extauthz.HeaderValueOption{{Header: extauthz.HeaderValue{Key: ":path", Value: path}}}, changedHeaders(header, req.Header)...)
+	return &extauthz.CheckResponse{OkResponse: &extauthz.OKHTTPResponse{
+		Headers:         headers,
+		HeadersToRemove: removedHeaders(x.Policy, header, req.Header),
+	}}
+}
+
+// checkedRequest returns the request an ext_authz CheckRequest describes.
+func checkedRequest(ctx context.Context, check *extauthz.CheckRequest) (*http.Request, error) {
+	a := check.Attributes
+	r := a.Request.HTTP
+	u, err := url.ParseRequestURI(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	major, minor, ok := http.ParseHTTPVersion(r.Protocol)
+	if !ok {
+		major, minor = 1, 1
+	}
+	src := a.Source.Address.SocketAddress
+	req := &http.Request{
+		Method:     r.Method,
+		URL:        u,
+		RequestURI: r.Path,
+		Proto:      r.Protocol,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     http.Header{},
+		Host:       r.Host,
+		Body:       http.NoBody,
+		RemoteAddr: net.JoinHostPort(src.Address, strconv.FormatUint(uint64(src.PortValue), 10)),
+	}
+	for k, v := range r.Headers {
+		// Pseudo-headers are in the fields above.
+		if !strings.HasPrefix(k, ":") && k != "x-forwarded-for" {
+			req.Header.Set(k, v)
+		}
+	}
+	if _, ok := req.Header["Transfer-Encoding"]; ok {
+		req.ContentLength = -1
+	} else if v := req.Header.Get("Content-Length"); v != "" {
+		if req.ContentLength, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return req.WithContext(checkContext{ctx}), nil
+}
+
+// checkContext is the context of a checked request.  It's done when the
+// check is, but has none of the values of the check's own context, such as
+// the peer credentials of an Envoy connected over the unix socket, so that
+// callers are only resolved by the checked request's source address.
+type checkContext struct {
+	context.Context
+}
+
+func (checkContext) Value(key interface{}) interface{} {
+	return nil
+}
+
+// removedHeaders returns the lower-case names of the headers in before, the
+// checked request's header, that were removed by filtering it or that policy
+// doesn't forward to the metadata server, in order.  X-Forwarded-For is
+// always removed.
+func removedHeaders(policy *metadata.Policy, before, after http.Header) []string {
+	kept := after.Clone()
+	policy.SanitizeHeader(kept)
+	kept.Del(tokenHeader)
+	removed := []string{"x-forwarded-for"}
+	for name := range before {
+		if _, ok := kept[name]; !ok {
+			removed = append(removed, strings.ToLower(name))
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// changedHeaders returns the headers whose values in after, the header of a
+// filtered request, differ from those in before, in order of their names.
+func changedHeaders(before, after http.Header) []extauthz.HeaderValueOption {
+	var names []string
+	for name, values := range after {
+		if !reflect.DeepEqual(values, before[name]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var changed []extauthz.HeaderValueOption
+	for _, name := range names {
+		for i, v := range after[name] {
+			changed = append(changed, extauthz.HeaderValueOption{
+				Header: extauthz.HeaderValue{Key: strings.ToLower(name), Value: v},
+				Append: i > 0,
+			})
+		}
+	}
+	return changed
+}
+
+// countDecision records the metrics ServeHTTP's built-in metrics middleware
+// would for x.
+func countDecision(x *Exchange) {
+	result, code := filterResultProxied, http.StatusOK
+	if x.Rejection != nil {
+		result, code = filterResultBlocked, x.Rejection.Code
+	}
+	metrics.RequestCounter.WithLabelValues(result, strconv.Itoa(code)).Inc()
+	metricsMiddleware{}.PostResponse(x)
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/extauthz"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+)
+
+// newCheck returns a CheckRequest for a request from 10.0.0.5 with the path
+// and headers, as Envoy would send it.
+func newCheck(method, path string, headers map[string]string) *extauthz.CheckRequest {
+	h := map[string]string{
+		":authority":      "metadata.google.internal",
+		":method":         method,
+		":path":           path,
+		"x-forwarded-for": "10.0.0.5",
+		"x-request-id":    "42",
+	}
+	for k, v := range headers {
+		h[k] = v
+	}
+	return &extauthz.CheckRequest{Attributes: extauthz.AttributeContext{
+		Source: extauthz.Peer{Address: extauthz.Address{SocketAddress: extauthz.SocketAddress{Address: "10.0.0.5", PortValue: 41234}}},
+		Request: extauthz.Request{HTTP: extauthz.HTTPRequest{
+			Method:   method,
+			Headers:  h,
+			Path:     path,
+			Host:     "metadata.google.internal",
+			Scheme:   "http",
+			Protocol: "HTTP/1.1",
+		}},
+	}}
+}
+
+func TestAuthorize(t *testing.T) {
+	t.Parallel()
+	policy, err := metadata.ParsePolicy([]byte(`{
+		"concealedInstanceAttributes": {"globs": ["kube-env"]},
+		"namespaces": {"restricted": {"concealedInstanceAttributes": {"globs": ["*"]}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flavor := map[string]string{"metadata-flavor": "Google"}
+	withAuthorization := map[string]string{"metadata-flavor": "Google", "authorization": "Bearer secret"}
+	restricted := &pods.Pod{Namespace: "restricted", Name: "web-1"}
+
+	tests := []struct {
+		name          string
+		pod           *pods.Pod
+		check         *extauthz.CheckRequest
+		expectCode    int
+		expectPath    string
+		expectRemoved []string
+	}{
+		{"allowed", nil, newCheck("GET", "/computeMetadata/v1/instance/id", flavor), 0, "/computeMetadata/v1/instance/id", []string{"x-forwarded-for", "x-request-id"}},
+		{"rewritten", nil, newCheck("GET", "/computeMetadata/v1/instance//./id?alt=text", flavor), 0, "/computeMetadata/v1/instance/id?alt=text", []string{"x-forwarded-for", "x-request-id"}},
+		{"timeout capped", nil, newCheck("GET", "/computeMetadata/v1/instance/id?timeout_sec=999999999", flavor), 0, "/computeMetadata/v1/instance/id?timeout_sec=60", []string{"x-forwarded-for", "x-request-id"}},
+		{"header removed", nil, newCheck("GET", "/computeMetadata/v1/instance/id", withAuthorization), 0, "/computeMetadata/v1/instance/id", []string{"authorization", "x-forwarded-for", "x-request-id"}},
+		{"missing flavor", nil, newCheck("GET", "/computeMetadata/v1/instance/id", nil), http.StatusForbidden, "", nil},
+		{"concealed", nil, newCheck("GET", "/computeMetadata/v1/instance/attributes/kube-env", flavor), http.StatusForbidden, "", nil},
+		{"concealed in namespace", restricted, newCheck("GET", "/computeMetadata/v1/instance/attributes/cluster-name", flavor), http.StatusForbidden, "", nil},
+		{"listing", nil, newCheck("GET", "/computeMetadata/v1/instance/attributes/", flavor), http.StatusForbidden, "", nil},
+		{"listing HEAD", nil, newCheck("HEAD", "/computeMetadata/v1/instance/attributes/", flavor), http.StatusForbidden, "", nil},
+		{"method", nil, newCheck("POST", "/computeMetadata/v1/instance/id", flavor), http.StatusMethodNotAllowed, "", nil},
+		{"body", nil, newCheck("GET", "/computeMetadata/v1/instance/id", map[string]string{"metadata-flavor": "Google", "content-length": "3"}), http.StatusBadRequest, "", nil},
+		{"unparseable", nil, newCheck("GET", "instance/id", flavor), http.StatusBadRequest, "", nil},
+	}
+	for _, tc := range tests {
+		opts := testOptions
+		opts.Resolver = fakeResolver{pod: tc.pod}
+		h := newMetadataHandler(opts, policy)
+		resp := h.authorize(context.Background(), tc.check)
+		if tc.expectCode != 0 {
+			if resp.Allowed() || resp.DeniedResponse == nil || int(resp.DeniedResponse.Status.Code) != tc.expectCode {
+				t.Errorf("%s: got %+v, expected denial with %d", tc.name, resp, tc.expectCode)
+			}
+			continue
+		}
+		if !resp.Allowed() || resp.OkResponse == nil {
+			t.Errorf("%s: got %+v, expected it allowed", tc.name, resp)
+			continue
+		}
+		expect := []extauthz.HeaderValueOption{{Header: extauthz.HeaderValue{Key: ":path", Value: tc.expectPath}}}
+		if got := resp.OkResponse.Headers; !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: got headers %+v, expected %+v", tc.name, got, expect)
+		}
+		if got := resp.OkResponse.HeadersToRemove; !reflect.DeepEqual(got, tc.expectRemoved) {
+			t.Errorf("%s: got headers to remove %q, expected %q", tc.name, got, tc.expectRemoved)
+		}
+	}
+}
+
+func TestAuthorizeRedaction(t *testing.T) {
+	t.Parallel()
+	policy := metadata.DefaultPolicy()
+	policy.RecursiveMode = metadata.RecursiveRedact
+	h := newMetadataHandler(testOptions, policy)
+	flavor := map[string]string{"metadata-flavor": "Google"}
+	for _, path := range []string{
+		"/computeMetadata/v1/instance?recursive=true",
+		"/computeMetadata/v1/instance?alt=json;recursive=true",
+	} {
+		for _, method := range []string{"GET", "HEAD"} {
+			resp := h.authorize(context.Background(), newCheck(method, path, flavor))
+			if resp.Allowed() || resp.Status.Message != reasonNeedsRewrite {
+				t.Errorf("%s %s: got %+v, expected it refused as %s", method, path, resp, reasonNeedsRewrite)
+			}
+		}
+	}
+}
+
+func TestAuthorizeExtAuthz(t *testing.T) {
+	t.Parallel()
+	opts := testOptions
+	opts.Authorizer = okAuthorizer{&extauthz.OKHTTPResponse{
+		Headers:         []extauthz.HeaderValueOption{{Header: extauthz.HeaderValue{Key: "accept", Value: "application/json"}}},
+		HeadersToRemove: []string{"user-agent"},
+	}}
+	h := newMetadataHandler(opts, metadata.DefaultPolicy())
+	resp := h.authorize(context.Background(), newCheck("GET", "/computeMetadata/v1/instance/id", map[string]string{"metadata-flavor": "Google", "user-agent": "curl/8"}))
+	if !resp.Allowed() || resp.OkResponse == nil {
+		t.Fatalf("Got %+v, expected it allowed", resp)
+	}
+	expect := []extauthz.HeaderValueOption{
+		{Header: extauthz.HeaderValue{Key: ":path", Value: "/computeMetadata/v1/instance/id"}},
+		{Header: extauthz.HeaderValue{Key: "accept", Value: "application/json"}},
+	}
+	if got := resp.OkResponse.Headers; !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got headers %+v, expected %+v", got, expect)
+	}
+	if got, expect := resp.OkResponse.HeadersToRemove, []string{"user-agent", "x-forwarded-for", "x-request-id"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got headers to remove %q, expected %q", got, expect)
+	}
+}
+
+func TestAuthzHandler(t *testing.T) {
+	t.Parallel()
+	h := newMetadataHandler(testOptions, metadata.DefaultPolicy())
+	srv := httptest.NewUnstartedServer(NewAuthzHandler(h))
+	srv.Config.Protocols = &http.Protocols{}
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	c, err := extauthz.NewClient("grpc://"+strings.TrimPrefix(srv.URL, "http://"), time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.Check(context.Background(), newCheck("GET", "/computeMetadata/v1/instance/id", map[string]string{"metadata-flavor": "Google"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Allowed() {
+		t.Errorf("Got %+v, expected it allowed", resp)
+	}
+
+	resp, err = c.Check(context.Background(), newCheck("GET", "/computeMetadata/v1/instance/attributes/kube-env", map[string]string{"metadata-flavor": "Google"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &extauthz.DeniedHTTPResponse{
+		Status:  extauthz.HTTPStatus{Code: http.StatusForbidden},
+		Headers: []extauthz.HeaderValueOption{{Header: extauthz.HeaderValue{Key: "content-type", Value: "text/plain; charset=utf-8"}}},
+		Body:    "This metadata endpoint is concealed\n",
+	}
+	if resp.Allowed() || !reflect.DeepEqual(resp.DeniedResponse, expect) {
+		t.Errorf("Got %+v, expected a denial with %+v", resp, expect)
+	}
+}
+
+func TestAuthzHandlerUnixSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is only available on Linux")
+	}
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "authz.sock")
+
+	// Envoy's own uid sees every attribute, but the pod it asks about
+	// doesn't.
+	policy, err := metadata.ParsePolicy([]byte(fmt.Sprintf(`{
+		"namespaces": {"restricted": {"concealedInstanceAttributes": {"globs": ["*"]}}},
+		"uids": {"%d": {"concealedInstanceAttributes": {"globs": []}}}
+	}`, os.Getuid())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions
+	opts.Resolver = fakeResolver{pod: &pods.Pod{Namespace: "restricted", Name: "web-1"}}
+	opts.UnixSocket, opts.UnixSocketMode = path, 0600
+	h := newMetadataHandler(opts, policy)
+	lns, err := listen(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{Handler: NewAuthzHandler(h), ConnContext: withPeer, Protocols: &http.Protocols{}}
+	s.Protocols.SetUnencryptedHTTP2(true)
+	go serve(s, lns)
+	defer s.Close()
+
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	msg := newCheck("GET", "/computeMetadata/v1/instance/attributes/cluster-name", map[string]string{"metadata-flavor": "Google"}).Marshal()
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	req, err := http.NewRequest("POST", "http://envoy"+extauthz.CheckPath, bytes.NewReader(append(body, msg...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 5 {
+		t.Fatalf("Got response %q, grpc-status %q, expected a message", b, resp.Trailer.Get("Grpc-Status"))
+	}
+	var check extauthz.CheckResponse
+	if err := check.Unmarshal(b[5:]); err != nil {
+		t.Fatal(err)
+	}
+	if check.Allowed() || check.DeniedResponse == nil || check.DeniedResponse.Status.Code != http.StatusForbidden {
+		t.Errorf("Got %+v, expected a denial under the pod's namespace policy", check)
+	}
+}
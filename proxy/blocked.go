@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+// blockedReasons are the reasons for refusing a request that the policy's
+// blocked response applies to: those of decoyReasons, and unknown APIs and
+// rule errors, which are hidden as well.
+var blockedReasons = map[string]bool{
+	metadata.ReasonConcealed:  true,
+	metadata.ReasonUnknownAPI: true,
+	metadata.ReasonRuleDenied: true,
+	metadata.ReasonRuleError:  true,
+	reasonTokenMissing:        true,
+	reasonTokenInvalid:        true,
+	reasonTokenNotAllowed:     true,
+}
+
+// notFoundBody is the body of the metadata server's responses to requests
+// for endpoints that don't exist, with the path requested.
+const notFoundBody = `<!DOCTYPE html>
+<html lang=en>
+  <meta charset=utf-8>
+  <meta name=viewport content="initial-scale=1, minimum-scale=1, width=device-width">
+  <title>Error 404 (Not Found)!!1</title>
+  <a href=//www.google.com/><span id=logo aria-label=Google></span></a>
+  <p><b>404.</b> <ins>That’s an error.</ins>
+  <p>The requested URL <code>%s</code> was not found on this server.  <ins>That’s all we know.</ins>
+`
+
+// requestIDPattern matches the X-Request-Id headers of requests that are
+// used as their request IDs, rather than making one up.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// blockedError is the body of BlockedJSON responses.
+type blockedError struct {
+	Error struct {
+		Code      int    `json:"code"`
+		Reason    string `json:"reason"`
+		RequestID string `json:"requestId"`
+	} `json:"error"`
+}
+
+// blockedResponse returns r, the refusal of req for err, as the blocked
+// response the policy, or the rule that refused it, calls for.
+func blockedResponse(req *http.Request, policy *metadata.Policy, cleanedPath string, r *Rejection, err error) *Rejection {
+	if !blockedReasons[r.Reason] {
+		return r
+	}
+	profile := policy.BlockedResponse
+	if fe, ok := err.(*metadata.FilterError); ok && fe.BlockedResponse != "" {
+		profile = fe.BlockedResponse
+	}
+	if _, ok := err.(*tokenError); ok {
+		if rule := policy.TokenRule(cleanedPath); rule != nil && rule.BlockedResponse != "" {
+			profile = rule.BlockedResponse
+		}
+	}
+
+	header := http.Header{"X-Content-Type-Options": {"nosniff"}}
+	b := &Rejection{Code: http.StatusForbidden, Reason: r.Reason, Message: r.Message, Header: header}
+	switch profile {
+	case metadata.BlockedNotFound:
+		b.Code = http.StatusNotFound
+		b.Header = metadataServerHeader.Clone()
+		b.Header.Set("Content-Type", "text/html; charset=UTF-8")
+		b.Body = []byte(fmt.Sprintf(notFoundBody, html.EscapeString(req.URL.Path)))
+	case metadata.BlockedForbidden:
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		b.Body = []byte(http.StatusText(http.StatusForbidden) + "\n")
+	case metadata.BlockedJSON:
+		id := req.Header.Get("X-Request-Id")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		var e blockedError
+		e.Error.Code, e.Error.Reason, e.Error.RequestID = b.Code, r.Reason, id
+		body, _ := json.Marshal(&e)
+		header.Set("Content-Type", "application/json")
+		header.Set("X-Request-Id", id)
+		b.Body = append(body, '\n')
+		log.Printf("Refused request %s from %s: %s", id, clientAddr(req.RemoteAddr), r.Message)
+	default:
+		return r
+	}
+	return b
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to make request ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+)
+
+func TestBlockedResponse(t *testing.T) {
+	t.Parallel()
+	policy, err := metadata.ParsePolicy([]byte(`{
+		"concealedInstanceAttributes": {"globs": ["kube-env"]},
+		"rules": [{"name": "no-hostname", "path": "/computeMetadata/v1/instance/hostname", "expression": "false", "blockedResponse": "json"}],
+		"namespaces": {
+			"hidden": {"blockedResponse": "notFound", "concealedInstanceAttributes": {"globs": ["*"]}},
+			"quiet": {"blockedResponse": "forbidden"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := func(namespace string) *pods.Pod {
+		return &pods.Pod{Namespace: namespace, Name: "web-1"}
+	}
+	const kubeEnv = "/computeMetadata/v1/instance/attributes/kube-env"
+
+	tests := []struct {
+		name              string
+		pod               *pods.Pod
+		path              string
+		header            http.Header
+		expectCode        int
+		expectContentType string
+		expectBody        string
+	}{
+		{"message", pod("default"), kubeEnv, nil, http.StatusForbidden, "text/plain; charset=utf-8", "This metadata endpoint is concealed\n"},
+		{"not found", pod("hidden"), kubeEnv, nil, http.StatusNotFound, "text/html; charset=UTF-8", "<p>The requested URL <code>" + kubeEnv + "</code> was not found on this server."},
+		{"not found escaped", pod("hidden"), "/computeMetadata/v1/instance/attributes/kube-env<b>", nil, http.StatusNotFound, "text/html; charset=UTF-8", "<code>/computeMetadata/v1/instance/attributes/kube-env&lt;b&gt;</code>"},
+		{"forbidden", pod("quiet"), kubeEnv, nil, http.StatusForbidden, "text/plain; charset=utf-8", "Forbidden\n"},
+		{"rule", pod("hidden"), "/computeMetadata/v1/instance/hostname", http.Header{"X-Request-Id": {"abc-123"}}, http.StatusForbidden, "application/json", `{"error":{"code":403,"reason":"rule_denied","requestId":"abc-123"}}` + "\n"},
+		{"missing flavor", pod("hidden"), "/computeMetadata/v1/instance/id", http.Header{"Metadata-Flavor": nil}, http.StatusForbidden, "text/plain; charset=utf-8", "Calls to /computeMetadata without"},
+	}
+	for _, tc := range tests {
+		opts := testOptions
+		opts.Resolver = fakeResolver{pod: tc.pod}
+		h := newMetadataHandler(opts, policy)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = tc.path
+		req.Host = "metadata.google.internal"
+		req.Header.Set("Metadata-Flavor", "Google")
+		for k, v := range tc.header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d", tc.name, rec.Code, tc.expectCode)
+		}
+		if got := rec.Header().Get("Content-Type"); got != tc.expectContentType {
+			t.Errorf("%s: got Content-Type %q, expected %q", tc.name, got, tc.expectContentType)
+		}
+		if !strings.Contains(rec.Body.String(), tc.expectBody) {
+			t.Errorf("%s: got body %q, expected it to contain %q", tc.name, rec.Body.String(), tc.expectBody)
+		}
+		if strings.Contains(rec.Body.String(), "concealed") && tc.name != "message" {
+			t.Errorf("%s: got body %q, expected it not to say the endpoint is concealed", tc.name, rec.Body.String())
+		}
+	}
+}
+
+func TestBlockedResponseRequestID(t *testing.T) {
+	t.Parallel()
+	policy, err := metadata.ParsePolicy([]byte(`{"blockedResponse": "json"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newMetadataHandler(testOptions, policy)
+	ids := map[string]bool{}
+	for _, id := range []string{"", "not a valid id"} {
+		req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/attributes/kube-env", nil)
+		req.Host = "metadata.google.internal"
+		req.Header.Set("Metadata-Flavor", "Google")
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var body blockedError
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Got body %q: %v", rec.Body.String(), err)
+		}
+		got := body.Error.RequestID
+		if len(got) != 32 || got != rec.Header().Get("X-Request-Id") {
+			t.Errorf("Got request ID %q, and %q in the header, expected the same random ID", got, rec.Header().Get("X-Request-Id"))
+		}
+		if body.Error.Reason != metadata.ReasonConcealed {
+			t.Errorf("Got reason %q, expected %q", body.Error.Reason, metadata.ReasonConcealed)
+		}
+		ids[got] = true
+	}
+	if len(ids) != 2 {
+		t.Errorf("Got request IDs %v, expected different ones", ids)
+	}
+}
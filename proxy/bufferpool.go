@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metrics"
+)
+
+// bufferSizeClasses are the buffer sizes handed out by bufferPool, smallest
+// first.  Most metadata responses are well under 1KiB, so the small classes
+// do nearly all of the work; the largest matches the size io.Copy would
+// otherwise allocate.
+var bufferSizeClasses = []int{1 << 10, 4 << 10, 32 << 10}
+
+// sizeHintWeight is the weight given to each observed response size when
+// updating the pool's running size estimate, out of 1<<sizeHintShift.
+const (
+	sizeHintShift  = 4
+	sizeHintWeight = 1
+)
+
+// sizeClass is a sync.Pool of equally sized buffers.
+type sizeClass struct {
+	size  int
+	label string
+	pool  sync.Pool
+}
+
+// bufferPool is an httputil.BufferPool that never blocks.  Buffers are kept
+// in per-size sync.Pools, so idle buffers are released by the garbage
+// collector instead of being pinned for the life of the process, and Get
+// allocates rather than waiting when a pool is empty.
+//
+// httputil.ReverseProxy doesn't tell the pool how much data it's about to
+// copy, so the pool keeps a running average of response sizes (fed by
+// observe) and hands out buffers from the smallest class that fits it.
+type bufferPool struct {
+	classes []*sizeClass
+	// sizeHint is a moving average of observed response sizes, in bytes.
+	sizeHint int64
+}
+
+func newBufferPool() *bufferPool {
+	bp := &bufferPool{
+		sizeHint: int64(bufferSizeClasses[0]),
+	}
+	for _, size := range bufferSizeClasses {
+		c := &sizeClass{
+			size:  size,
+			label: strconv.Itoa(size),
+		}
+		c.pool.New = func() interface{} {
+			metrics.BufferPoolAllocCounter.WithLabelValues(c.label).Inc()
+			b := make([]byte, c.size)
+			return &b
+		}
+		bp.classes = append(bp.classes, c)
+	}
+	return bp
+}
+
+// Get returns a buffer sized for a typical response.
+func (bp *bufferPool) Get() []byte {
+	c := bp.classFor(atomic.LoadInt64(&bp.sizeHint))
+	metrics.BufferPoolGetCounter.WithLabelValues(c.label).Inc()
+	return *c.pool.Get().(*[]byte)
+}
+
+// Put returns b to the pool it came from.  Buffers that weren't handed out by
+// Get are dropped.
+func (bp *bufferPool) Put(b []byte) {
+	for _, c := range bp.classes {
+		if cap(b) == c.size {
+			b = b[:c.size]
+			c.pool.Put(&b)
+			return
+		}
+	}
+}
+
+// observe folds the size of a response into the pool's size estimate.
+// Unknown sizes (-1) are ignored.
+func (bp *bufferPool) observe(n int64) {
+	if n < 0 {
+		return
+	}
+	for {
+		old := atomic.LoadInt64(&bp.sizeHint)
+		hint := old + (n-old)*sizeHintWeight>>sizeHintShift
+		if atomic.CompareAndSwapInt64(&bp.sizeHint, old, hint) {
+			metrics.BufferPoolSizeHint.Set(float64(hint))
+			return
+		}
+	}
+}
+
+// classFor returns the smallest size class that can hold n bytes, or the
+// largest class if none can.
+func (bp *bufferPool) classFor(n int64) *sizeClass {
+	for _, c := range bp.classes {
+		if int64(c.size) >= n {
+			return c
+		}
+	}
+	return bp.classes[len(bp.classes)-1]
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// chanBufferPool is the channel-based pool bufferPool replaced, kept here to
+// benchmark against.
+type chanBufferPool chan []byte
+
+func newChanBufferPool() chanBufferPool {
+	bp := make(chan []byte, 100)
+	for i := 0; i < 100; i++ {
+		bp <- make([]byte, 32*1024)
+	}
+	return bp
+}
+
+func (bp chanBufferPool) Get() []byte {
+	return <-bp
+}
+
+func (bp chanBufferPool) Put(b []byte) {
+	bp <- b
+}
+
+func TestBufferPoolGetDoesNotBlock(t *testing.T) {
+	t.Parallel()
+	bp := newBufferPool()
+	// Take more buffers than the old pool held without returning any.
+	for i := 0; i < 1000; i++ {
+		if b := bp.Get(); len(b) == 0 {
+			t.Fatalf("Got empty buffer on Get #%d", i)
+		}
+	}
+}
+
+func TestBufferPoolSizeClass(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		observed   []int64
+		expectSize int
+	}{
+		{nil, 1 << 10},
+		{[]int64{-1, -1, -1}, 1 << 10},
+		{[]int64{200, 300, 250}, 1 << 10},
+		{repeat(3000, 100), 4 << 10},
+		{repeat(1<<20, 100), 32 << 10},
+	}
+
+	for _, tc := range tests {
+		bp := newBufferPool()
+		for _, n := range tc.observed {
+			bp.observe(n)
+		}
+		if got := len(bp.Get()); got != tc.expectSize {
+			t.Errorf("After observing %v, got buffer of %d bytes, expected %d", tc.observed, got, tc.expectSize)
+		}
+	}
+}
+
+func TestBufferPoolPutForeignBuffer(t *testing.T) {
+	t.Parallel()
+	bp := newBufferPool()
+	bp.Put(make([]byte, 10))
+	bp.Put(make([]byte, 1<<10, 2<<10))
+	if got := len(bp.Get()); got != 1<<10 {
+		t.Errorf("Got buffer of %d bytes, expected %d", got, 1<<10)
+	}
+}
+
+func repeat(n int64, count int) []int64 {
+	s := make([]int64, count)
+	for i := range s {
+		s[i] = n
+	}
+	return s
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	pools := []struct {
+		name string
+		pool httputil.BufferPool
+	}{
+		{"chan", newChanBufferPool()},
+		{"adaptive", newBufferPool()},
+	}
+	for _, p := range pools {
+		p := p
+		b.Run(p.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					p.pool.Put(p.pool.Get())
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkReverseProxy(b *testing.B) {
+	// A typical metadata response, e.g. an access token.
+	body := strings.Repeat("x", 202)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, body)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	adaptive := newBufferPool()
+	pools := []struct {
+		name    string
+		pool    httputil.BufferPool
+		observe func(*http.Response) error
+	}{
+		{"chan", newChanBufferPool(), nil},
+		{"adaptive", adaptive, func(resp *http.Response) error {
+			adaptive.observe(resp.ContentLength)
+			return nil
+		}},
+	}
+	for _, p := range pools {
+		p := p
+		b.Run(p.name, func(b *testing.B) {
+			proxy := httputil.NewSingleHostReverseProxy(u)
+			proxy.BufferPool = p.pool
+			proxy.ModifyResponse = p.observe
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rw := httptest.NewRecorder()
+					proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/computeMetadata/v1/", nil))
+					io.Copy(ioutil.Discard, rw.Body)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+// reasonDecoy is the reason for serving a decoy in place of refusing a
+// request.
+const reasonDecoy = "decoy"
+
+// eventDecoyServed is the audit event for serving a decoy.
+const eventDecoyServed = "decoy_served"
+
+// decoyReasons are the reasons for refusing a request that a decoy is served
+// in place of.  Requests refused for other reasons, such as a missing
+// Metadata-Flavor header, are refused by the metadata server as well, so
+// neither decoys nor blocked responses hide them.
+var decoyReasons = map[string]bool{
+	metadata.ReasonConcealed:  true,
+	metadata.ReasonRuleDenied: true,
+	reasonTokenMissing:        true,
+	reasonTokenInvalid:        true,
+	reasonTokenNotAllowed:     true,
+}
+
+// metadataServerHeader holds the headers the metadata server responds with,
+// which decoys and BlockedNotFound responses are served with as well.
+var metadataServerHeader = http.Header{
+	"Metadata-Flavor":  {"Google"},
+	"Server":           {"Metadata Server for VM"},
+	"X-Frame-Options":  {"SAMEORIGIN"},
+	"X-Xss-Protection": {"0"},
+}
+
+// decoy returns a Rejection serving policy's decoy for the cleaned path to
+// the caller, in place of r, the refusal of req for err, or nil if there's
+// no decoy to serve.  Serving a decoy is audited.
+func (h *Handler) decoy(req *http.Request, policy *metadata.Policy, cleanedPath string, c metadata.Caller, r *Rejection, err error) *Rejection {
+	if !decoyReasons[r.Reason] || len(policy.Decoys) == 0 {
+		return nil
+	}
+	// Concealed requests are refused before Filter returns their path.
+	if fe, ok := err.(*metadata.FilterError); ok && fe.Path != "" {
+		cleanedPath = fe.Path
+	}
+	d := policy.Decoy(cleanedPath)
+	if d == nil {
+		return nil
+	}
+
+	canary := h.canary(req, cleanedPath, c)
+	data := &metadata.DecoyData{
+		Path:           cleanedPath,
+		Query:          map[string]string{},
+		Namespace:      c.Namespace,
+		Pod:            c.PodName,
+		ServiceAccount: c.ServiceAccount,
+		Canary:         canary,
+		Now:            time.Now(),
+	}
+	// Filter may have refused the request before parsing its query, so
+	// queries that can't be parsed are left empty.
+	query, _ := metadata.ParseQuery(req.URL.RawQuery)
+	for k, v := range query {
+		data.Query[k] = v[0]
+	}
+	body, renderErr := d.Render(data)
+	if renderErr != nil {
+		log.Printf("Failed to render decoy for %s, refusing the request: %v", cleanedPath, renderErr)
+		return nil
+	}
+
+	e := &AuditEvent{
+		Time:           data.Now,
+		Event:          eventDecoyServed,
+		Priority:       PriorityHigh,
+		Path:           cleanedPath,
+		Client:         clientAddr(req.RemoteAddr),
+		Namespace:      c.Namespace,
+		Pod:            c.PodName,
+		ServiceAccount: c.ServiceAccount,
+		Cgroup:         c.Cgroup,
+		Canary:         canary,
+	}
+	if c.HasUID {
+		uid := c.UID
+		e.UID = &uid
+	}
+	h.audit(e)
+
+	header := metadataServerHeader.Clone()
+	contentType := d.ContentType
+	if contentType == "" {
+		contentType = "application/text"
+	}
+	header.Set("Content-Type", contentType)
+	return &Rejection{
+		Code:    http.StatusOK,
+		Reason:  reasonDecoy,
+		Message: r.Message,
+		Header:  header,
+		Body:    body,
+	}
+}
+
+// canary returns the canary of the decoy content for the caller of req, which
+// is the same for every request from the caller to the cleaned path.
+func (h *Handler) canary(req *http.Request, cleanedPath string, c metadata.Caller) string {
+	mac := hmac.New(sha256.New, h.canaryKey)
+	for _, s := range []string{cleanedPath, c.Namespace, c.PodName, c.Cgroup, strconv.FormatBool(c.HasUID), strconv.FormatUint(uint64(c.UID), 10)} {
+		mac.Write([]byte(s))
+		mac.Write([]byte{0})
+	}
+	// Callers that aren't known to be pods or processes are told apart by
+	// their IP.
+	if c.Namespace == "" && !c.HasUID {
+		if ip := clientIP(req); ip != nil {
+			mac.Write(ip)
+		}
+	}
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+)
+
+// fakeAuditor records the audit events.
+type fakeAuditor struct {
+	mu     sync.Mutex
+	events []*AuditEvent
+}
+
+func (f *fakeAuditor) Audit(e *AuditEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, e)
+}
+
+func TestDecoys(t *testing.T) {
+	t.Parallel()
+	policy, err := metadata.ParsePolicy([]byte(`{
+		"concealedInstanceAttributes": {"globs": ["kube-env"]},
+		"rules": [{"name": "no-identity", "path": "/computeMetadata/v1/instance/service-accounts/*/identity", "expression": "false"}],
+		"decoys": [
+			{"path": "/computeMetadata/v1/instance/attributes/kube-env", "builtin": "kube-env"},
+			{"path": "/computeMetadata/v1/instance/service-accounts/*/identity", "builtin": "identity"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := &pods.Pod{Namespace: "default", Name: "web-1", ServiceAccount: "web"}
+
+	tests := []struct {
+		name        string
+		pod         *pods.Pod
+		path        string
+		flavor      bool
+		expectCode  int
+		expectBody  string
+		expectEvent bool
+	}{
+		{"kube-env", web, "/computeMetadata/v1/instance/attributes/kube-env", true, http.StatusOK, "ALLOCATE_NODE_CIDRS: ", true},
+		{"identity", web, "/computeMetadata/v1/instance/service-accounts/default/identity?audience=https://example.com", true, http.StatusOK, "eyJ", true},
+		{"missing flavor", web, "/computeMetadata/v1/instance/attributes/kube-env", false, http.StatusForbidden, "Calls to /computeMetadata without", false},
+		{"no decoy", web, "/computeMetadata/v1/instance/attributes/kube-env/", true, http.StatusForbidden, "This metadata endpoint is concealed", false},
+	}
+	for _, tc := range tests {
+		auditor := &fakeAuditor{}
+		opts := testOptions
+		opts.Resolver = fakeResolver{pod: tc.pod}
+		opts.Auditor = auditor
+		h := newMetadataHandler(opts, policy)
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Host = "metadata.google.internal"
+		if tc.flavor {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d", tc.name, rec.Code, tc.expectCode)
+		}
+		if !strings.HasPrefix(rec.Body.String(), tc.expectBody) {
+			t.Errorf("%s: got body %q, expected it to start with %q", tc.name, rec.Body.String(), tc.expectBody)
+		}
+		if !tc.expectEvent {
+			if len(auditor.events) != 0 {
+				t.Errorf("%s: got audit events %+v, expected none", tc.name, auditor.events)
+			}
+			continue
+		}
+		if got := rec.Header().Get("Metadata-Flavor"); got != "Google" {
+			t.Errorf("%s: got Metadata-Flavor %q, expected %q", tc.name, got, "Google")
+		}
+		if len(auditor.events) != 1 {
+			t.Errorf("%s: got audit events %+v, expected one", tc.name, auditor.events)
+			continue
+		}
+		e := auditor.events[0]
+		if e.Event != eventDecoyServed || e.Priority != PriorityHigh || e.Namespace != "default" || e.Pod != "web-1" || e.Canary == "" {
+			t.Errorf("%s: got audit event %+v, expected a decoy served to default/web-1", tc.name, e)
+		}
+	}
+}
+
+func TestDecoyCanary(t *testing.T) {
+	t.Parallel()
+	policy, err := metadata.ParsePolicy([]byte(`{
+		"concealedInstanceAttributes": {"globs": ["kube-env"]},
+		"decoys": [{"path": "/computeMetadata/v1/instance/attributes/kube-env", "builtin": "kube-env"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions
+	opts.Auditor = &fakeAuditor{}
+	get := func(h *Handler, pod *pods.Pod) []byte {
+		h.resolver = fakeResolver{pod: pod}
+		req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/attributes/kube-env", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Body.Bytes()
+	}
+	h := newMetadataHandler(opts, policy)
+	web := get(h, &pods.Pod{Namespace: "default", Name: "web-1"})
+	if again := get(h, &pods.Pod{Namespace: "default", Name: "web-1"}); !bytes.Equal(web, again) {
+		t.Errorf("Got different decoys for the same pod, expected the same")
+	}
+	if ci := get(h, &pods.Pod{Namespace: "ci", Name: "runner-1"}); bytes.Equal(web, ci) {
+		t.Errorf("Got the same decoy for different pods, expected different canaries")
+	}
+	if other := get(newMetadataHandler(opts, policy), &pods.Pod{Namespace: "default", Name: "web-1"}); bytes.Equal(web, other) {
+		t.Errorf("Got the same decoy from different proxies, expected different canary keys")
+	}
+}
+
+func TestDecoyQuery(t *testing.T) {
+	t.Parallel()
+	policy, err := metadata.ParsePolicy([]byte(`{
+		"rules": [{"name": "no-identity", "path": "/computeMetadata/v1/instance/service-accounts/*/identity", "expression": "false"}],
+		"decoys": [{"path": "/computeMetadata/v1/instance/service-accounts/*/identity", "builtin": "identity"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions
+	opts.Auditor = &fakeAuditor{}
+	h := newMetadataHandler(opts, policy)
+	// The audience is after a semicolon, as the metadata server would see it.
+	req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/service-accounts/default/identity?format=full;audience=https://example.com", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Host = "metadata.google.internal"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	parts := strings.Split(rec.Body.String(), ".")
+	if len(parts) != 3 {
+		t.Fatalf("Got body %q, expected a JWT", rec.Body.String())
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := `"aud":"https://example.com"`; !strings.Contains(string(claims), expect) {
+		t.Errorf("Got claims %s, expected them to contain %s", claims, expect)
+	}
+}
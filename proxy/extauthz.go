@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/extauthz"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metrics"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/tokens"
+)
+
+// Authorizer checks requests with an external authorization service.  It's
+// implemented by extauthz.Client.
+type Authorizer interface {
+	Check(ctx context.Context, req *extauthz.CheckRequest) (*extauthz.CheckResponse, error)
+}
+
+// Reasons for rejecting requests by the external authorization service.
+const (
+	reasonExtAuthzDenied      = "ext_authz_denied"
+	reasonExtAuthzUnavailable = "ext_authz_unavailable"
+)
+
+// failureExtAuthz is the kind of failure of the external authorization
+// service, as used in metric labels.
+const failureExtAuthz = "ext_authz"
+
+// checkExtAuthz asks the authorizer whether req from the caller, to the
+// cleaned path, with the token of id if it has one, is allowed, and changes the headers of allowed requests as
+// it says.  If the authorizer fails, or says to change headers the policy
+// doesn't forward, the request is allowed, unchanged, only if the handler
+// fails open.
+func (h *Handler) checkExtAuthz(req *http.Request, policy *metadata.Policy, cleanedPath string, c metadata.Caller, id *tokens.Identity) *Rejection {
+	resp, err := h.authorizer.Check(req.Context(), newCheckRequest(req, cleanedPath, c, id))
+	if err == nil && resp.Allowed() && resp.OkResponse != nil {
+		err = applyOKResponse(req.Header, policy, resp.OkResponse)
+	}
+	if err != nil {
+		mode := "closed"
+		if h.authorizerFailOpen {
+			mode = "open"
+		}
+		log.Printf("Failed to authorize request from %s, failing %s: %v", clientAddr(req.RemoteAddr), mode, err)
+		metrics.FailureFallbackCounter.WithLabelValues(failureExtAuthz, mode).Inc()
+		if h.authorizerFailOpen {
+			return nil
+		}
+		return &Rejection{
+			Code:    http.StatusServiceUnavailable,
+			Reason:  reasonExtAuthzUnavailable,
+			Message: "Metadata proxy could not authorize the request",
+		}
+	}
+	if resp.Allowed() {
+		return nil
+	}
+	r := &Rejection{
+		Code:    http.StatusForbidden,
+		Reason:  reasonExtAuthzDenied,
+		Message: "This metadata request is denied by the external authorization service",
+	}
+	if d := resp.DeniedResponse; d != nil {
+		if code := int(d.Status.Code); code >= 400 && code < 600 {
+			r.Code = code
+		}
+		if d.Body != "" {
+			r.Message = d.Body
+		}
+		for _, o := range d.Headers {
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			r.Header.Add(o.Header.Key, o.Header.Value)
+		}
+	}
+	return r
+}
+
+// applyOKResponse changes header as the authorizer's response to an allowed
+// request says.  Pseudo-headers can't be changed, since the request has been
+// filtered by its path, and neither can headers the policy doesn't forward,
+// which would be removed anyway; either is an error, and then header is left
+// unchanged.
+func applyOKResponse(header http.Header, policy *metadata.Policy, o *extauthz.OKHTTPResponse) error {
+	for _, name := range o.HeadersToRemove {
+		if strings.HasPrefix(name, ":") {
+			return fmt.Errorf("external authorization service removed pseudo-header %q", name)
+		}
+	}
+	for _, opt := range o.Headers {
+		name := opt.Header.Key
+		if strings.HasPrefix(name, ":") {
+			return fmt.Errorf("external authorization service set pseudo-header %q", name)
+		}
+		kept := http.Header{}
+		kept.Set(name, opt.Header.Value)
+		policy.SanitizeHeader(kept)
+		if len(kept) == 0 {
+			return fmt.Errorf("external authorization service set header %q, which isn't forwarded", name)
+		}
+	}
+	for _, name := range o.HeadersToRemove {
+		header.Del(name)
+	}
+	for _, opt := range o.Headers {
+		if opt.Append {
+			header.Add(opt.Header.Key, opt.Header.Value)
+		} else {
+			header.Set(opt.Header.Key, opt.Header.Value)
+		}
+	}
+	return nil
+}
+
+// newCheckRequest describes req from the caller, to the cleaned path, to the
+// external authorization service.  The service account token isn't sent, but
+// the identity it was verified as, if any, is.
+func newCheckRequest(req *http.Request, cleanedPath string, c metadata.Caller, id *tokens.Identity) *extauthz.CheckRequest {
+	headers := map[string]string{}
+	for k, v := range req.Header {
+		if k != http.CanonicalHeaderKey(tokenHeader) {
+			headers[strings.ToLower(k)] = strings.Join(v, ",")
+		}
+	}
+	// Filter has already parsed the query, so this can't fail.
+	query, _ := metadata.CanonicalQuery(req.URL.RawQuery)
+	path := cleanedPath
+	if query != "" {
+		path += "?" + query
+	}
+	check := &extauthz.CheckRequest{Attributes: extauthz.AttributeContext{
+		Source: extauthz.Peer{Address: socketAddress(req.RemoteAddr)},
+		Request: extauthz.Request{HTTP: extauthz.HTTPRequest{
+			Method:   req.Method,
+			Headers:  headers,
+			Path:     path,
+			Host:     req.Host,
+			Scheme:   "http",
+			Query:    query,
+			Protocol: req.Proto,
+		}},
+	}}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		check.Attributes.Destination.Address = socketAddress(addr.String())
+	}
+	a := &check.Attributes
+	if c.Namespace != "" {
+		a.Source.Principal = c.Namespace + "/" + c.ServiceAccount
+		a.Source.Labels = c.Labels
+		a.ContextExtensions = map[string]string{
+			"namespace":      c.Namespace,
+			"pod":            c.PodName,
+			"serviceAccount": c.ServiceAccount,
+		}
+	}
+	if c.HasUID {
+		if a.ContextExtensions == nil {
+			a.ContextExtensions = map[string]string{}
+		}
+		a.ContextExtensions["uid"] = strconv.FormatUint(uint64(c.UID), 10)
+		if c.Cgroup != "" {
+			a.ContextExtensions["cgroup"] = c.Cgroup
+		}
+	}
+	if id != nil {
+		if a.ContextExtensions == nil {
+			a.ContextExtensions = map[string]string{}
+		}
+		a.ContextExtensions["tokenNamespace"] = id.Namespace
+		a.ContextExtensions["tokenServiceAccount"] = id.ServiceAccount
+	}
+	return check
+}
+
+// socketAddress returns the extauthz address for a host:port address, or an
+// empty one for addresses of other kinds, such as unix sockets'.
+func socketAddress(hostPort string) extauthz.Address {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return extauthz.Address{}
+	}
+	host, _ = splitZone(host)
+	n, _ := strconv.ParseUint(port, 10, 16)
+	return extauthz.Address{SocketAddress: extauthz.SocketAddress{Address: host, PortValue: uint32(n)}}
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/extauthz"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+)
+
+// fakeAuthorizer denies requests to paths containing "token", fails for
+// paths containing "unavailable", and records the requests it's asked about.
+type fakeAuthorizer struct {
+	mu     sync.Mutex
+	checks []*extauthz.CheckRequest
+}
+
+func (f *fakeAuthorizer) Check(ctx context.Context, req *extauthz.CheckRequest) (*extauthz.CheckResponse, error) {
+	f.mu.Lock()
+	f.checks = append(f.checks, req)
+	f.mu.Unlock()
+	path := req.Attributes.Request.HTTP.Path
+	switch {
+	case strings.Contains(path, "unavailable"):
+		return nil, errors.New("OPA is down")
+	case strings.Contains(path, "token"):
+		return &extauthz.CheckResponse{
+			Status: extauthz.Status{Code: extauthz.CodePermissionDenied},
+			DeniedResponse: &extauthz.DeniedHTTPResponse{
+				Status:  extauthz.HTTPStatus{Code: http.StatusUnauthorized},
+				Headers: []extauthz.HeaderValueOption{{Header: extauthz.HeaderValue{Key: "x-denied-by", Value: "opa"}}},
+				Body:    "tokens are not for " + req.Attributes.Source.Principal,
+			},
+		}, nil
+	}
+	return &extauthz.CheckResponse{}, nil
+}
+
+func TestExtAuthz(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &pods.Pod{Namespace: "default", Name: "web-1", ServiceAccount: "web", Labels: map[string]string{"tier": "prod"}}
+
+	tests := []struct {
+		name         string
+		path         string
+		failOpen     bool
+		expectCode   int
+		expectBody   string
+		expectHeader string
+		expectCheck  bool
+	}{
+		{"allowed", "/computeMetadata/v1/instance/id", false, http.StatusOK, "ok", "", true},
+		{"denied", "/computeMetadata/v1/instance/service-accounts/default/token", false, http.StatusUnauthorized, "tokens are not for default/web\n", "opa", true},
+		{"fail closed", "/computeMetadata/v1/instance/attributes/unavailable", false, http.StatusServiceUnavailable, "Metadata proxy could not authorize the request\n", "", true},
+		{"fail open", "/computeMetadata/v1/instance/attributes/unavailable", true, http.StatusOK, "ok", "", true},
+		{"denied by policy", "/computeMetadata/v1/instance/attributes/kube-env", false, http.StatusForbidden, "", "", false},
+	}
+	for _, tc := range tests {
+		authorizer := &fakeAuthorizer{}
+		opts := testOptions
+		opts.Resolver = fakeResolver{pod: pod}
+		opts.Authorizer, opts.AuthorizerFailOpen = authorizer, tc.failOpen
+		h := newUpstreamHandler(u, opts, metadata.DefaultPolicy())
+		req := httptest.NewRequest("GET", tc.path+"?alt=text", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d", tc.name, rec.Code, tc.expectCode)
+		}
+		if tc.expectBody != "" && rec.Body.String() != tc.expectBody {
+			t.Errorf("%s: got body %q, expected %q", tc.name, rec.Body.String(), tc.expectBody)
+		}
+		if got := rec.Header().Get("X-Denied-By"); got != tc.expectHeader {
+			t.Errorf("%s: got X-Denied-By %q, expected %q", tc.name, got, tc.expectHeader)
+		}
+		if got := len(authorizer.checks) > 0; got != tc.expectCheck {
+			t.Errorf("%s: got checked %v, expected %v", tc.name, got, tc.expectCheck)
+			continue
+		}
+		if !tc.expectCheck {
+			continue
+		}
+		a := authorizer.checks[0].Attributes
+		if expect := tc.path + "?alt=text"; a.Request.HTTP.Path != expect {
+			t.Errorf("%s: got path %q checked, expected %q", tc.name, a.Request.HTTP.Path, expect)
+		}
+		if got := a.Request.HTTP.Headers["metadata-flavor"]; got != "Google" {
+			t.Errorf("%s: got metadata-flavor %q checked, expected %q", tc.name, got, "Google")
+		}
+		if a.Source.Address.SocketAddress.Address != "192.0.2.1" || a.Source.Principal != "default/web" || a.Source.Labels["tier"] != "prod" {
+			t.Errorf("%s: got source %+v checked, expected 192.0.2.1 and pod default/web-1", tc.name, a.Source)
+		}
+		if got := a.ContextExtensions["pod"]; got != "web-1" {
+			t.Errorf("%s: got pod %q checked, expected %q", tc.name, got, "web-1")
+		}
+	}
+}
+
+// okAuthorizer allows every request, changing its headers as ok says.
+type okAuthorizer struct {
+	ok *extauthz.OKHTTPResponse
+}
+
+func (a okAuthorizer) Check(ctx context.Context, req *extauthz.CheckRequest) (*extauthz.CheckResponse, error) {
+	return &extauthz.CheckResponse{OkResponse: a.ok}, nil
+}
+
+func TestExtAuthzOKResponse(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, strings.Join(req.Header["Accept"], ",")+" "+req.UserAgent()+" "+req.URL.Path)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := func(key, value string, append bool) extauthz.HeaderValueOption {
+		return extauthz.HeaderValueOption{Header: extauthz.HeaderValue{Key: key, Value: value}, Append: append}
+	}
+
+	tests := []struct {
+		name       string
+		ok         *extauthz.OKHTTPResponse
+		failOpen   bool
+		expectCode int
+		expectBody string
+	}{
+		{"none", nil, false, http.StatusOK, "text/plain curl/8 /computeMetadata/v1/instance/id"},
+		{"set", &extauthz.OKHTTPResponse{Headers: []extauthz.HeaderValueOption{header("accept", "application/json", false)}}, false, http.StatusOK, "application/json curl/8 /computeMetadata/v1/instance/id"},
+		{"append", &extauthz.OKHTTPResponse{Headers: []extauthz.HeaderValueOption{header("accept", "application/json", true)}}, false, http.StatusOK, "text/plain,application/json curl/8 /computeMetadata/v1/instance/id"},
+		{"remove", &extauthz.OKHTTPResponse{HeadersToRemove: []string{"user-agent"}}, false, http.StatusOK, "text/plain  /computeMetadata/v1/instance/id"},
+		{"pseudo-header", &extauthz.OKHTTPResponse{Headers: []extauthz.HeaderValueOption{header(":path", "/computeMetadata/v1/instance/attributes/kube-env", false)}}, false, http.StatusServiceUnavailable, "Metadata proxy could not authorize the request\n"},
+		{"not forwarded", &extauthz.OKHTTPResponse{Headers: []extauthz.HeaderValueOption{header("authorization", "Bearer x", false)}}, false, http.StatusServiceUnavailable, "Metadata proxy could not authorize the request\n"},
+		{"not forwarded fail open", &extauthz.OKHTTPResponse{
+			Headers:         []extauthz.HeaderValueOption{header("accept", "application/json", false), header("authorization", "Bearer x", false)},
+			HeadersToRemove: []string{"user-agent"},
+		}, true, http.StatusOK, "text/plain curl/8 /computeMetadata/v1/instance/id"},
+	}
+	for _, tc := range tests {
+		opts := testOptions
+		opts.Authorizer, opts.AuthorizerFailOpen = okAuthorizer{tc.ok}, tc.failOpen
+		h := newUpstreamHandler(u, opts, metadata.DefaultPolicy())
+		req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/id", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Header.Set("Accept", "text/plain")
+		req.Header.Set("User-Agent", "curl/8")
+		req.Host = "metadata.google.internal"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d", tc.name, rec.Code, tc.expectCode)
+		}
+		if rec.Body.String() != tc.expectBody {
+			t.Errorf("%s: got body %q, expected %q", tc.name, rec.Body.String(), tc.expectBody)
+		}
+	}
+}
+
+func TestExtAuthzToken(t *testing.T) {
+	t.Parallel()
+	policy, err := metadata.ParsePolicy([]byte(`{
+		"concealedInstanceAttributes": {"globs": []},
+		"tokenRules": [{"path": "/computeMetadata/v1/instance/attributes/kube-env", "serviceAccounts": ["kube-system/node-agent"]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := fakeVerifier{"agent": {Namespace: "kube-system", ServiceAccount: "node-agent", PodName: "node-agent-1"}}
+
+	tests := []struct {
+		name                      string
+		path                      string
+		expectNamespace, expectSA string
+	}{
+		{"token rule", "/computeMetadata/v1/instance/attributes/kube-env", "kube-system", "node-agent"},
+		{"no token rule", "/computeMetadata/v1/instance/id", "", ""},
+	}
+	for _, tc := range tests {
+		authorizer := &fakeAuthorizer{}
+		opts := testOptions
+		opts.Authorizer = authorizer
+		h := newMetadataHandler(opts, policy)
+		h.verifier = verifier
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Header.Set(tokenHeader, "agent")
+		req.Host = "metadata.google.internal"
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if len(authorizer.checks) != 1 {
+			t.Errorf("%s: got %d checks, expected 1", tc.name, len(authorizer.checks))
+			continue
+		}
+		a := authorizer.checks[0].Attributes
+		if got, ok := a.Request.HTTP.Headers[strings.ToLower(tokenHeader)]; ok {
+			t.Errorf("%s: got token %q checked, expected none", tc.name, got)
+		}
+		if got := a.ContextExtensions["tokenNamespace"]; got != tc.expectNamespace {
+			t.Errorf("%s: got tokenNamespace %q checked, expected %q", tc.name, got, tc.expectNamespace)
+		}
+		if got := a.ContextExtensions["tokenServiceAccount"]; got != tc.expectSA {
+			t.Errorf("%s: got tokenServiceAccount %q checked, expected %q", tc.name, got, tc.expectSA)
+		}
+	}
+}
+
+func TestExtAuthzCanonicalQuery(t *testing.T) {
+	t.Parallel()
+	authorizer := &fakeAuthorizer{}
+	opts := testOptions
+	opts.Authorizer = authorizer
+	h := newMetadataHandler(opts, metadata.DefaultPolicy())
+	req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/id?wait_for_change=false;alt=text", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Host = "metadata.google.internal"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if len(authorizer.checks) != 1 {
+		t.Fatalf("Got %d checks, expected 1", len(authorizer.checks))
+	}
+	r := authorizer.checks[0].Attributes.Request.HTTP
+	if expect := "/computeMetadata/v1/instance/id?alt=text&wait_for_change=false"; r.Path != expect {
+		t.Errorf("Got path %q checked, expected %q", r.Path, expect)
+	}
+	if expect := "alt=text&wait_for_change=false"; r.Query != expect {
+		t.Errorf("Got query %q checked, expected %q", r.Query, expect)
+	}
+}
@@ -0,0 +1,462 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metrics"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+)
+
+// FailureMode is how the proxy handles requests when something it depends on
+// has failed.
+type FailureMode string
+
+const (
+	// FailDeny refuses requests with 503 Service Unavailable.
+	FailDeny FailureMode = "deny"
+	// FailDefault handles requests with the top-level policy: the built-in
+	// default policy if the policy file can't be loaded, or the policy
+	// file's own, rather than a namespace's, if the pod can't be resolved.
+	FailDefault FailureMode = "default"
+	// FailCache uses the last policy, pod or response that was good.
+	FailCache FailureMode = "cache"
+)
+
+var failureModeValues = []FailureMode{FailDeny, FailDefault, FailCache}
+
+// Kinds of failure, as used in metric labels.
+const (
+	failureStartup  = "startup"
+	failureReload   = "reload"
+	failureIdentity = "identity"
+	failureUpstream = "upstream"
+)
+
+// Reasons requests are refused for under FailDeny, as used in metric labels.
+const (
+	reasonPolicyUnavailable   = "policy_unavailable"
+	reasonIdentityUnavailable = "identity_unavailable"
+)
+
+// FailureModes gives the FailureMode for each kind of failure.
+type FailureModes struct {
+	// Startup applies when the policy file can't be loaded at startup.
+	// FailCache loads the copy of the last good policy file.
+	Startup FailureMode
+	// Reload applies when the policy file can't be reloaded.  FailCache
+	// keeps the current policy.
+	Reload FailureMode
+	// Identity applies when the pod a request comes from can't be
+	// resolved because the pod resolver isn't synced.  FailCache uses the
+	// pod that had the client's IP when the resolver last synced.
+	Identity FailureMode
+	// Upstream applies when the metadata server can't be reached or fails
+	// with a 5xx.  FailCache serves the last good response to the same
+	// GET, other than for service account tokens; FailDefault doesn't
+	// apply.
+	Upstream FailureMode
+}
+
+// DefaultFailureModes fail closed, except that a policy that fails to reload
+// is kept.
+var DefaultFailureModes = FailureModes{
+	Startup:  FailDeny,
+	Reload:   FailCache,
+	Identity: FailDeny,
+	Upstream: FailDeny,
+}
+
+// Validate returns an error if any mode is unknown or doesn't apply.
+func (m FailureModes) Validate() error {
+	for kind, mode := range m.byKind() {
+		found := false
+		for _, v := range failureModeValues {
+			found = found || mode == v
+		}
+		if !found {
+			return fmt.Errorf("unknown %s failure mode %q", kind, mode)
+		}
+	}
+	if m.Upstream == FailDefault {
+		return fmt.Errorf("upstream failure mode can't be %q", FailDefault)
+	}
+	return nil
+}
+
+func (m FailureModes) byKind() map[string]FailureMode {
+	return map[string]FailureMode{
+		failureStartup:  m.Startup,
+		failureReload:   m.Reload,
+		failureIdentity: m.Identity,
+		failureUpstream: m.Upstream,
+	}
+}
+
+// Export publishes the modes as metrics.FailureModeGauge.
+func (m FailureModes) Export() {
+	for kind, mode := range m.byKind() {
+		for _, v := range failureModeValues {
+			value := 0.0
+			if v == mode {
+				value = 1
+			}
+			metrics.FailureModeGauge.WithLabelValues(kind, string(v)).Set(value)
+		}
+	}
+}
+
+// fallBack records that the failure mode for kind was applied.
+func fallBack(kind string, mode FailureMode) {
+	metrics.FailureFallbackCounter.WithLabelValues(kind, string(mode)).Inc()
+}
+
+// policyHolder holds the policy in effect, or nil if requests are refused
+// because there's none.
+type policyHolder struct {
+	policy *metadata.Policy
+}
+
+// currentPolicy returns the policy in effect, or nil if there's none.
+func (h *Handler) currentPolicy() *metadata.Policy {
+	return h.policy.Load().(policyHolder).policy
+}
+
+// setPolicy puts policy into effect.  A nil policy refuses every request.
+func (h *Handler) setPolicy(policy *metadata.Policy) {
+	h.policy.Store(policyHolder{policy})
+}
+
+// LoadPolicy loads the policy file at path at startup, applying the startup
+// failure mode if it can't.  Good policy files are copied to cachePath, if
+// set, for FailCache to load.
+func (h *Handler) LoadPolicy(path, cachePath string) error {
+	return h.loadPolicy(path, cachePath, failureStartup, h.failure.Startup)
+}
+
+// ReloadPolicy is LoadPolicy for reloading the policy file, applying the
+// reload failure mode.
+func (h *Handler) ReloadPolicy(path, cachePath string) error {
+	return h.loadPolicy(path, cachePath, failureReload, h.failure.Reload)
+}
+
+// loadPolicy loads the policy file at path and puts it into effect.  If it
+// can't, it applies mode, the failure mode for kind, and returns the error.
+// Good policy files are copied to cachePath, if set, for FailCache to load.
+func (h *Handler) loadPolicy(path, cachePath, kind string, mode FailureMode) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("failed to read policy: %v", err)
+	}
+	var policy *metadata.Policy
+	if err == nil {
+		policy, err = metadata.ParsePolicy(data)
+	}
+	if err == nil {
+		h.setPolicy(policy)
+		if cachePath != "" {
+			if err := writeFileAtomic(cachePath, data); err != nil {
+				log.Printf("Failed to cache policy: %v", err)
+			}
+		}
+		return nil
+	}
+
+	fallBack(kind, mode)
+	switch mode {
+	case FailDefault:
+		h.setPolicy(metadata.DefaultPolicy())
+	case FailCache:
+		if h.currentPolicy() != nil {
+			break
+		}
+		if cachePath == "" {
+			return fmt.Errorf("%v, and there's no cached policy", err)
+		}
+		cached, cacheErr := metadata.LoadPolicy(cachePath)
+		if cacheErr != nil {
+			return fmt.Errorf("%v, and the cached policy couldn't be loaded: %v", err, cacheErr)
+		}
+		h.setPolicy(cached)
+	default:
+		h.setPolicy(nil)
+	}
+	return err
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers see
+// either the old contents or the new.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// PodResolver maps client IPs and pod UIDs to pods.  It's implemented by
+// pods.KubeletResolver.
+type PodResolver interface {
+	// Lookup returns the pod with the IP, or nil if there's none, or
+	// pods.ErrNotSynced.
+	Lookup(ip net.IP) (*pods.Pod, error)
+	// Cached returns the pod that last had the IP, or nil.
+	Cached(ip net.IP) *pods.Pod
+	// LookupUID and CachedUID do the same for pod UIDs.
+	LookupUID(uid string) (*pods.Pod, error)
+	CachedUID(uid string) *pods.Pod
+}
+
+// errPolicyUnavailable and errIdentityUnavailable are returned by policyFor
+// when requests are refused under FailDeny.
+var (
+	errPolicyUnavailable   = errors.New("Metadata proxy has no valid policy")
+	errIdentityUnavailable = errors.New("Metadata proxy could not identify the calling pod")
+)
+
+// policyFor returns the policy to filter req with, and what's known of its
+// caller: the policy in effect, for the namespace of the pod req comes from if
+// there's a resolver.  Requests on the unix socket listener, or over loopback
+// if loopback clients are resolved, get the policy for their calling process.
+func (h *Handler) policyFor(req *http.Request) (*metadata.Policy, metadata.Caller, error) {
+	policy := h.currentPolicy()
+	if policy == nil {
+		return nil, metadata.Caller{}, errPolicyUnavailable
+	}
+	if p, ok := peer(req.Context()); ok {
+		return h.peerPolicy(policy, p)
+	}
+	if o, ok := loopbackOwner(req.Context()); ok {
+		return h.peerPolicy(policy, o.peer())
+	}
+	if h.resolver == nil {
+		return policy, metadata.Caller{}, nil
+	}
+	ip := clientIP(req)
+	var pod *pods.Pod
+	var err error
+	if ip == nil {
+		err = fmt.Errorf("unparseable client address %q", req.RemoteAddr)
+	} else {
+		pod, err = h.resolver.Lookup(ip)
+	}
+	if err != nil {
+		log.Printf("Failed to resolve pod for %s, failure mode %s applies: %v", clientAddr(req.RemoteAddr), h.failure.Identity, err)
+		fallBack(failureIdentity, h.failure.Identity)
+		switch h.failure.Identity {
+		case FailDefault:
+			return policy, metadata.Caller{}, nil
+		case FailCache:
+			if ip != nil {
+				pod = h.resolver.Cached(ip)
+			}
+			if pod == nil {
+				return nil, metadata.Caller{}, errIdentityUnavailable
+			}
+		default:
+			return nil, metadata.Caller{}, errIdentityUnavailable
+		}
+	}
+	c := podCaller(metadata.Caller{}, pod)
+	return policy.ForCaller(c), c, nil
+}
+
+// podCaller returns c with the identity of pod, if it's not nil.
+func podCaller(c metadata.Caller, pod *pods.Pod) metadata.Caller {
+	if pod != nil {
+		c.Namespace = pod.Namespace
+		c.PodName = pod.Name
+		c.ServiceAccount = pod.ServiceAccount
+		c.Labels = pod.Labels
+	}
+	return c
+}
+
+// clientIP returns the IP address req came from, or nil if it's unknown.
+// The zone of link-local IPv6 addresses is dropped, and IPv4 clients of
+// dual-stack listeners are returned as IPv4-mapped addresses, which
+// net.IP.Equal and String treat as IPv4.
+func clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip, _ := splitZone(host)
+	return net.ParseIP(ip)
+}
+
+// maxCachedBytes bounds the size of the responses kept by responseCache.
+const maxCachedBytes = 64 << 10
+
+// maxCachedResponses bounds the number of responses kept by responseCache.
+const maxCachedResponses = 1024
+
+// credentialPattern matches the paths of service account access and identity
+// tokens, which responseCache doesn't keep.
+var credentialPattern = regexp.MustCompile(`(?i)/service-accounts/[^/]+/(token|identity)/?$`)
+
+// responseCache keeps the last good response to each GET, to be served in
+// place of upstream failures.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	header http.Header
+	body   []byte
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: map[string]cachedResponse{}}
+}
+
+// cacheKey returns the key for req's response, or "" if it can't be cached.
+// Long-polls aren't, since serving them from the cache would turn clients
+// waiting on a change into busy loops, and neither are tokens, which would be
+// served after they expire.
+func cacheKey(req *http.Request) string {
+	if req.Method != "GET" || credentialPattern.MatchString(req.URL.Path) {
+		return ""
+	}
+	if wait, _ := strconv.ParseBool(req.URL.Query().Get("wait_for_change")); wait {
+		return ""
+	}
+	return req.URL.RequestURI() + " " + req.Header.Get("Accept-Encoding")
+}
+
+// store keeps a copy of resp if it's a successful, small enough response to a
+// cacheable request.  The body is read and replaced.
+func (c *responseCache) store(resp *http.Response) error {
+	key := cacheKey(resp.Request)
+	if key == "" || resp.StatusCode != http.StatusOK || resp.ContentLength < 0 || resp.ContentLength > maxCachedBytes {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCachedResponses {
+		// Evict an arbitrary entry.
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = cachedResponse{resp.Header.Clone(), body}
+	return nil
+}
+
+// response returns the cached response to req, or nil if there's none.
+func (c *responseCache) response(req *http.Request) *http.Response {
+	key := cacheKey(req)
+	if key == "" {
+		return nil
+	}
+	c.mu.Lock()
+	cached, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	header := cached.header.Clone()
+	header.Set("Warning", `111 - "Revalidation Failed"`)
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(cached.body)),
+		ContentLength: int64(len(cached.body)),
+		Request:       req,
+	}
+}
+
+// upstreamFailed replaces resp, a 5xx response from the metadata server,
+// according to the upstream failure mode.
+func (h *Handler) upstreamFailed(resp *http.Response) {
+	fallBack(failureUpstream, h.failure.Upstream)
+	if h.cache == nil {
+		return
+	}
+	cached := h.cache.response(resp.Request)
+	if cached == nil {
+		return
+	}
+	resp.Body.Close()
+	*resp = *cached
+}
+
+// rewriteError marks errors from rewriting a response, as opposed to
+// failures to reach the metadata server.
+type rewriteError struct {
+	err error
+}
+
+func (e rewriteError) Error() string {
+	return e.err.Error()
+}
+
+// proxyError is used as httputil.ReverseProxy.ErrorHandler.  When the
+// metadata server can't be reached, it serves the cached response, if the
+// upstream failure mode allows and there is one, and 502 Bad Gateway if not.
+func (h *Handler) proxyError(rw http.ResponseWriter, req *http.Request, err error) {
+	if err, ok := err.(middlewareError); ok {
+		x := exchangeFrom(req.Context())
+		x.Rejection = rejectionFor(err.err)
+		x.Rejection.write(rw)
+		return
+	}
+	log.Printf("Proxy error: %v", err)
+	if _, ok := err.(rewriteError); !ok {
+		fallBack(failureUpstream, h.failure.Upstream)
+		if h.cache != nil {
+			if resp := h.cache.response(req); resp != nil {
+				if err := applyRewrite(resp); err == nil {
+					writeResponse(rw, resp)
+					return
+				}
+			}
+		}
+	}
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
+// writeResponse writes resp to rw.
+func writeResponse(rw http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		rw.Header()[k] = v
+	}
+	rw.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(rw, resp.Body); err != nil {
+		log.Printf("Failed to write cached response: %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metrics"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+)
+
+func TestLoadPolicyFailureModes(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	good := write("good.json", `{"rejectLegacyMetadataRequestHeader": true}`)
+	bad := write("bad.json", `{"rejectLegacyMetadataRequestHeader": "yes"}`)
+	cached := write("cached.json", `{"requireMetadataFlavor": false}`)
+	missing := filepath.Join(dir, "missing.json")
+
+	goodPolicy, err := metadata.LoadPolicy(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachedPolicy, err := metadata.LoadPolicy(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := metadata.DefaultPolicy()
+	current.AllowedMethods = []string{"GET"}
+
+	tests := []struct {
+		name      string
+		current   *metadata.Policy
+		path      string
+		cachePath string
+		mode      FailureMode
+		expect    *metadata.Policy
+		expectErr bool
+	}{
+		{"good", nil, good, "", FailDeny, goodPolicy, false},
+		{"good replaces current", current, good, "", FailDeny, goodPolicy, false},
+		{"startup deny", nil, bad, cached, FailDeny, nil, true},
+		{"startup default", nil, bad, cached, FailDefault, metadata.DefaultPolicy(), true},
+		{"startup cache", nil, bad, cached, FailCache, cachedPolicy, true},
+		{"startup cache missing file", nil, missing, cached, FailCache, cachedPolicy, true},
+		{"startup cache without cache", nil, bad, "", FailCache, nil, true},
+		{"startup cache with missing cache", nil, bad, missing, FailCache, nil, true},
+		{"reload deny", current, bad, cached, FailDeny, nil, true},
+		{"reload default", current, bad, cached, FailDefault, metadata.DefaultPolicy(), true},
+		{"reload cache", current, bad, cached, FailCache, current, true},
+	}
+	for _, tc := range tests {
+		h := newMetadataHandler(testOptions, tc.current)
+		err := h.loadPolicy(tc.path, tc.cachePath, failureStartup, tc.mode)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("%s: got error %v, expected error: %t", tc.name, err, tc.expectErr)
+		}
+		if got := h.currentPolicy(); !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("%s: got policy %+v, expected %+v", tc.name, got, tc.expect)
+		}
+	}
+
+	// Good policies are copied to the cache.
+	cachePath := filepath.Join(dir, "copy.json")
+	h := newMetadataHandler(testOptions, nil)
+	if err := h.loadPolicy(good, cachePath, failureStartup, FailCache); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p, err := metadata.LoadPolicy(cachePath); err != nil || !reflect.DeepEqual(p, goodPolicy) {
+		t.Errorf("Got cached policy %+v, %v, expected %+v", p, err, goodPolicy)
+	}
+}
+
+// fakeResolver is a PodResolver that returns fixed answers.
+type fakeResolver struct {
+	pod    *pods.Pod
+	err    error
+	cached *pods.Pod
+}
+
+func (f fakeResolver) Lookup(ip net.IP) (*pods.Pod, error) {
+	return f.pod, f.err
+}
+
+func (f fakeResolver) Cached(ip net.IP) *pods.Pod {
+	return f.cached
+}
+
+func (f fakeResolver) LookupUID(uid string) (*pods.Pod, error) {
+	return f.pod, f.err
+}
+
+func (f fakeResolver) CachedUID(uid string) *pods.Pod {
+	return f.cached
+}
+
+func TestIdentityFailureModes(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kube-env is only revealed to kube-system.
+	policy, err := metadata.ParsePolicy([]byte(`{"namespaces": {"kube-system": {"concealedInstanceAttributes": {"globs": []}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	system := &pods.Pod{Namespace: "kube-system", Name: "agent"}
+	web := &pods.Pod{Namespace: "default", Name: "web"}
+
+	tests := []struct {
+		name       string
+		policy     *metadata.Policy
+		resolver   PodResolver
+		mode       FailureMode
+		remoteAddr string
+		expectCode int
+	}{
+		{"no policy", nil, nil, FailDeny, "10.0.0.5:1234", http.StatusServiceUnavailable},
+		{"no resolver", policy, nil, FailDeny, "10.0.0.5:1234", http.StatusForbidden},
+		{"resolved", policy, fakeResolver{pod: system}, FailDeny, "10.0.0.5:1234", http.StatusOK},
+		{"resolved other namespace", policy, fakeResolver{pod: web}, FailDeny, "10.0.0.5:1234", http.StatusForbidden},
+		{"resolved IPv6", policy, fakeResolver{pod: system}, FailDeny, "[fd00::5]:1234", http.StatusOK},
+		{"not a pod", policy, fakeResolver{}, FailDeny, "10.0.0.5:1234", http.StatusForbidden},
+		{"not synced deny", policy, fakeResolver{err: pods.ErrNotSynced, cached: system}, FailDeny, "10.0.0.5:1234", http.StatusServiceUnavailable},
+		{"not synced default", policy, fakeResolver{err: pods.ErrNotSynced, cached: system}, FailDefault, "10.0.0.5:1234", http.StatusForbidden},
+		{"not synced cache", policy, fakeResolver{err: pods.ErrNotSynced, cached: system}, FailCache, "10.0.0.5:1234", http.StatusOK},
+		{"not synced cache miss", policy, fakeResolver{err: pods.ErrNotSynced}, FailCache, "10.0.0.5:1234", http.StatusServiceUnavailable},
+		{"unknown client deny", policy, fakeResolver{pod: system}, FailDeny, "@", http.StatusServiceUnavailable},
+		{"unknown client default", policy, fakeResolver{pod: system}, FailDefault, "@", http.StatusForbidden},
+		{"unknown client cache", policy, fakeResolver{pod: system, cached: system}, FailCache, "@", http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		opts := testOptions
+		opts.Failure.Identity = tc.mode
+		h := newUpstreamHandler(u, opts, tc.policy)
+		h.resolver = tc.resolver
+		req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/attributes/kube-env", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		req.RemoteAddr = tc.remoteAddr
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d", tc.name, rw.Code, tc.expectCode)
+		}
+	}
+}
+
+func TestUpstreamFailureModes(t *testing.T) {
+	t.Parallel()
+	// state is what the stand-in metadata server does: "ok" serves the
+	// value, "error" fails with 500 and "down" drops the connection.
+	var mu sync.Mutex
+	state, value := "ok", "v1"
+	set := func(s, v string) {
+		mu.Lock()
+		defer mu.Unlock()
+		state, value = s, v
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		state, value := state, value
+		mu.Unlock()
+		switch state {
+		case "error":
+			http.Error(rw, "internal error", http.StatusInternalServerError)
+		case "down":
+			conn, _, err := rw.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Failed to hijack: %v", err)
+				return
+			}
+			conn.Close()
+		default:
+			io.WriteString(rw, value)
+		}
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(h *Handler, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	tests := []struct {
+		mode       FailureMode
+		state      string
+		path       string
+		expectCode int
+		expectBody string
+	}{
+		{FailDeny, "ok", "/computeMetadata/v1/instance/id", http.StatusOK, "v1"},
+		{FailDeny, "error", "/computeMetadata/v1/instance/id", http.StatusInternalServerError, "internal error\n"},
+		{FailDeny, "down", "/computeMetadata/v1/instance/id", http.StatusBadGateway, ""},
+		{FailCache, "ok", "/computeMetadata/v1/instance/id", http.StatusOK, "v1"},
+		{FailCache, "error", "/computeMetadata/v1/instance/id", http.StatusOK, "v1"},
+		{FailCache, "down", "/computeMetadata/v1/instance/id", http.StatusOK, "v1"},
+		{FailCache, "down", "/computeMetadata/v1/instance/hostname", http.StatusBadGateway, ""},
+		{FailCache, "error", "/computeMetadata/v1/instance/hostname", http.StatusInternalServerError, "internal error\n"},
+		{FailCache, "down", "/computeMetadata/v1/instance/id?wait_for_change=true", http.StatusBadGateway, ""},
+		{FailCache, "ok", "/computeMetadata/v1/instance/service-accounts/default/token", http.StatusOK, "v1"},
+		{FailCache, "down", "/computeMetadata/v1/instance/service-accounts/default/token", http.StatusBadGateway, ""},
+		{FailCache, "ok", "/computeMetadata/v1/instance/service-accounts/default/email", http.StatusOK, "v1"},
+		{FailCache, "down", "/computeMetadata/v1/instance/service-accounts/default/email", http.StatusOK, "v1"},
+	}
+	handlers := map[FailureMode]*Handler{}
+	for _, mode := range []FailureMode{FailDeny, FailCache} {
+		opts := testOptions
+		opts.Failure.Upstream = mode
+		handlers[mode] = newUpstreamHandler(u, opts, metadata.DefaultPolicy())
+	}
+	for _, tc := range tests {
+		set(tc.state, "v1")
+		rw := get(handlers[tc.mode], tc.path)
+		if rw.Code != tc.expectCode || rw.Body.String() != tc.expectBody {
+			t.Errorf("%s with upstream %s: got %d %q for %s, expected %d %q", tc.mode, tc.state, rw.Code, rw.Body.String(), tc.path, tc.expectCode, tc.expectBody)
+		}
+		if tc.mode == FailCache && tc.state != "ok" && tc.expectCode == http.StatusOK && rw.Header().Get("Warning") == "" {
+			t.Errorf("%s with upstream %s: got no Warning header on cached response", tc.mode, tc.state)
+		}
+	}
+
+	// The cache holds the latest good response.
+	set("ok", "v2")
+	get(handlers[FailCache], "/computeMetadata/v1/instance/id")
+	set("down", "v2")
+	if rw := get(handlers[FailCache], "/computeMetadata/v1/instance/id"); rw.Body.String() != "v2" {
+		t.Errorf("Got %q from cache, expected %q", rw.Body.String(), "v2")
+	}
+}
+
+func TestFailureModesExport(t *testing.T) {
+	modes := FailureModes{Startup: FailDefault, Reload: FailCache, Identity: FailDeny, Upstream: FailCache}
+	modes.Export()
+	for kind, mode := range modes.byKind() {
+		for _, v := range failureModeValues {
+			var m dto.Metric
+			if err := metrics.FailureModeGauge.WithLabelValues(kind, string(v)).Write(&m); err != nil {
+				t.Fatal(err)
+			}
+			expect := 0.0
+			if v == mode {
+				expect = 1
+			}
+			if got := m.GetGauge().GetValue(); got != expect {
+				t.Errorf("Got %v for %s failure mode %s, expected %v", got, kind, v, expect)
+			}
+		}
+	}
+}
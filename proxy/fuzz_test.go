@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+// leakPatterns match, in lower case, the cleaned paths of endpoints that
+// fuzzPolicy conceals.  They're written independently of the filter, so that
+// they can catch its mistakes.
+var leakPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^/0\.1/meta-data/attributes/kube-env(/|$)`),
+	regexp.MustCompile(`^/computemetadata/v1(beta1)?/instance/attributes/kube-env(/|$)`),
+	regexp.MustCompile(`^/(0\.1/meta-data|computemetadata/v1(beta1)?/instance)/service-accounts/[^/]+/identity(/|$)`),
+	regexp.MustCompile(`^/(0\.1/meta-data|computemetadata/v1(beta1)?)/project/attributes/secret(/|$)`),
+}
+
+func fuzzPolicy() *metadata.Policy {
+	p := metadata.DefaultPolicy()
+	p.RecursiveMode = metadata.RecursiveRedact
+	p.ConcealedProjectAttributes.Globs = []string{"secret"}
+	return p
+}
+
+// leaked returns whether the metadata server would serve a concealed
+// endpoint for the path, whether or not it decodes it a second time.
+func leaked(p string) bool {
+	candidates := []string{p}
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		candidates = append(candidates, unescaped)
+	}
+	for _, c := range candidates {
+		c = path.Clean(strings.ToLower(strings.Replace(c, "\\", "/", -1)))
+		for _, re := range leakPatterns {
+			if re.MatchString(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FuzzServeHTTP checks that whatever request target a client sends, the
+// metadata server is never asked for a concealed endpoint.
+func FuzzServeHTTP(f *testing.F) {
+	for _, seed := range []string{
+		"/computeMetadata/v1/instance/attributes/kube-env",
+		"/computeMetadata/v1/instance/attributes/cluster-name",
+		"/computeMetadata/v1/instance/attributes//kube-env",
+		"/computeMetadata/v1/instance/attributes/../attributes/kube-env",
+		"/computeMetadata/v1/instance/attributes%2Fkube-env",
+		"/computeMetadata/v1/instance/attributes/%2e%2e/attributes/kube-env",
+		"/computeMetadata/v1/instance/attributes/kube%252Denv",
+		"/computeMetadata/v1/instance/attributes/kube-env;x",
+		"/computeMetadata/v1/instance/attributes/KUBE-ENV",
+		"/computeMetadata/v1/instance/service-accounts/default/identity?audience=https://x",
+		"/computeMetadata/v1/project/attributes/secret",
+		"/computeMetadata/v1/instance/?recursive=true",
+		"/computeMetadata/v1/instance/?alt=text;recursive=true",
+		"/0.1/meta-data/attributes/kube-env",
+		"http://169.254.169.254/computeMetadata/v1/instance/attributes/kube-env",
+		"//computeMetadata/v1/instance/attributes/kube-env",
+		"*",
+	} {
+		f.Add(seed)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for _, p := range []string{req.URL.Path, req.URL.EscapedPath()} {
+			if leaked(p) {
+				rw.Header().Set("X-Leaked", p)
+			}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte("{}"))
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		f.Fatal(err)
+	}
+	h := newUpstreamHandler(u, testOptions, fuzzPolicy())
+
+	f.Fuzz(func(t *testing.T, target string) {
+		raw := "GET " + target + " HTTP/1.1\r\nHost: metadata.google.internal\r\nMetadata-Flavor: Google\r\n\r\n"
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			return
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if p := rw.Header().Get("X-Leaked"); p != "" {
+			t.Errorf("Request for %q reached the metadata server as concealed path %q", target, p)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metrics"
+	"golang.org/x/net/netutil"
+)
+
+// Listener is an address to listen and proxy at.
+type Listener struct {
+	Addr string
+	// MaxConnections bounds the number of connections served at once on
+	// this listener.
+	MaxConnections int
+}
+
+// ParseListeners parses a comma-separated list of addresses to listen at,
+// each optionally followed by "=" and its connection limit.  Listeners
+// without a limit get maxConnections.
+func ParseListeners(s string, maxConnections int) ([]Listener, error) {
+	var listeners []Listener
+	for _, l := range strings.Split(s, ",") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		lc := Listener{Addr: l, MaxConnections: maxConnections}
+		if i := strings.LastIndex(l, "="); i >= 0 {
+			n, err := strconv.Atoi(l[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid connection limit in %q", l)
+			}
+			lc.Addr, lc.MaxConnections = l[:i], n
+		}
+		if _, _, err := net.SplitHostPort(lc.Addr); err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %v", lc.Addr, err)
+		}
+		listeners = append(listeners, lc)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listen addresses given")
+	}
+	return listeners, nil
+}
+
+// listenNetwork returns the network to listen at addr on.  IPv4 and IPv6
+// addresses only accept connections of their own family, except for the
+// unspecified IPv6 address, "[::]", which accepts both where the system
+// supports dual-stack sockets.  Names and empty hosts are left to net.Listen.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	case ip.IsUnspecified():
+		return "tcp"
+	default:
+		return "tcp6"
+	}
+}
+
+// listen listens at each of the listeners, and the config's unix socket if
+// set, limiting their connections and applying the config's keep-alive
+// period and transparent mode.  If any fails, those already listening are
+// closed.
+func listen(listeners []Listener, opts Options) ([]net.Listener, error) {
+	var lns []net.Listener
+	for _, l := range listeners {
+		ln, err := net.Listen(listenNetwork(l.Addr), l.Addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("failed to listen at %s: %v", l.Addr, err)
+		}
+		tln := tcpKeepAliveListener{TCPListener: ln.(*net.TCPListener), keepAlivePeriod: opts.KeepAlivePeriod}
+		if opts.OriginalDsts != nil {
+			tln.originalDst = getOriginalDst
+			tln.originalDsts = opts.OriginalDsts
+		}
+		lns = append(lns, netutil.LimitListener(tln, l.MaxConnections))
+	}
+	if opts.UnixSocket != "" {
+		ln, err := listenUnix(opts.UnixSocket, opts.UnixSocketMode, opts.ProcRoot)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("failed to listen at %s: %v", opts.UnixSocket, err)
+		}
+		lns = append(lns, netutil.LimitListener(ln, opts.MaxConnections))
+	}
+	return lns, nil
+}
+
+// serve serves handler on every listener, and returns the first error any of
+// them fails with.
+func serve(s *http.Server, lns []net.Listener) error {
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			errs <- s.Serve(ln)
+		}(ln)
+	}
+	return <-errs
+}
+
+// clientAddr formats the remote address of a request for logging, with
+// IPv4-mapped IPv6 addresses written as IPv4 and IPv6 zones kept.
+func clientAddr(remoteAddr string) string {
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	ip, zone := splitZone(host)
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	if zone != "" {
+		ip += "%" + zone
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+// splitZone splits the zone, as in "fe80::1%eth0", from an IPv6 address.
+func splitZone(host string) (ip, zone string) {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+// tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
+// connections. It's used by ListenAndServe and ListenAndServeTLS so
+// dead TCP connections (e.g. closing laptop mid-download) eventually
+// go away.
+//
+// In transparent mode, when originalDst is set, it also looks up where each
+// connection was originally bound for and closes those that weren't bound
+// for one of originalDsts, including those that weren't redirected at all.
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+	keepAlivePeriod time.Duration
+	originalDst     func(*net.TCPConn) (*net.TCPAddr, error)
+	originalDsts    []*net.TCPAddr
+}
+
+func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
+	for {
+		tc, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(ln.keepAlivePeriod)
+		if ln.originalDst == nil {
+			return tc, nil
+		}
+		dst, err := ln.originalDst(tc)
+		if err != nil {
+			log.Printf("Refusing connection from %v: %v", tc.RemoteAddr(), err)
+		} else if !allowedDestination(ln.originalDsts, dst) {
+			log.Printf("Refusing connection from %v to %v", tc.RemoteAddr(), dst)
+		} else {
+			return &transparentConn{tc, dst}, nil
+		}
+		metrics.OriginalDstRejectCounter.Inc()
+		tc.Close()
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseListeners(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in     string
+		expect []Listener
+	}{
+		{"127.0.0.1:988", []Listener{{"127.0.0.1:988", 100}}},
+		{"127.0.0.1:988=5, [::1]:988", []Listener{{"127.0.0.1:988", 5}, {"[::1]:988", 100}}},
+		{"[fd20:ce::254]:80=20", []Listener{{"[fd20:ce::254]:80", 20}}},
+		{":988", []Listener{{":988", 100}}},
+		{"", nil},
+		{"127.0.0.1", nil},
+		{"::1:988", nil},
+		{"127.0.0.1:988=0", nil},
+		{"127.0.0.1:988=many", nil},
+	}
+	for _, tc := range tests {
+		got, err := ParseListeners(tc.in, 100)
+		if tc.expect == nil {
+			if err == nil {
+				t.Errorf("Got nil error parsing %q, expected an error", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", tc.in, err)
+		} else if !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("Got %v parsing %q, expected %v", got, tc.in, tc.expect)
+		}
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		addr   string
+		expect string
+	}{
+		{"127.0.0.1:988", "tcp4"},
+		{"0.0.0.0:988", "tcp4"},
+		{"[::1]:988", "tcp6"},
+		{"[fd20:ce::254]:80", "tcp6"},
+		{"[::]:988", "tcp"},
+		{":988", "tcp"},
+		{"localhost:988", "tcp"},
+	}
+	for _, tc := range tests {
+		if got := listenNetwork(tc.addr); got != tc.expect {
+			t.Errorf("Got %q for %q, expected %q", got, tc.addr, tc.expect)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"10.0.0.5:1234", "10.0.0.5:1234"},
+		{"[::ffff:10.0.0.5]:1234", "10.0.0.5:1234"},
+		{"[fd00:0::5]:1234", "[fd00::5]:1234"},
+		{"[fe80::1%eth0]:1234", "[fe80::1%eth0]:1234"},
+		{"@", "@"},
+	}
+	for _, tc := range tests {
+		if got := clientAddr(tc.in); got != tc.expect {
+			t.Errorf("Got %q for %q, expected %q", got, tc.in, tc.expect)
+		}
+	}
+}
+
+// TestListenersLimitConnections serves on an IPv4 and an IPv6 loopback
+// listener, and checks that each has its own connection limit.
+func TestListenersLimitConnections(t *testing.T) {
+	t.Parallel()
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback isn't available: %v", err)
+	} else {
+		ln.Close()
+	}
+	lns, err := listen([]Listener{{"127.0.0.1:0", 1}, {"[::1]:0", 2}}, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, clientAddr(req.RemoteAddr))
+	})}
+	go serve(s, lns)
+	defer s.Close()
+
+	// connected returns whether a request on a new connection to addr is
+	// served promptly.
+	connected := func(addr string) (net.Conn, bool) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		fmt.Fprint(c, "GET / HTTP/1.1\r\nHost: metadata\r\n\r\n")
+		_, err = c.Read(make([]byte, 1))
+		return c, err == nil
+	}
+
+	v4, v6 := lns[0].Addr().String(), lns[1].Addr().String()
+	held := []net.Conn{}
+	defer func() {
+		for _, c := range held {
+			c.Close()
+		}
+	}()
+	for i, tc := range []struct {
+		addr   string
+		expect bool
+	}{
+		{v4, true},
+		{v4, false},
+		{v6, true},
+		{v6, true},
+		{v6, false},
+	} {
+		c, ok := connected(tc.addr)
+		held = append(held, c)
+		if ok != tc.expect {
+			t.Errorf("Connection %d to %s: got served %v, expected %v", i, tc.addr, ok, tc.expect)
+		}
+	}
+}
+
+func TestListenerServesIPv6Clients(t *testing.T) {
+	t.Parallel()
+	lns, err := listen([]Listener{{"[::1]:0", 10}}, testOptions)
+	if err != nil {
+		t.Skipf("IPv6 loopback isn't available: %v", err)
+	}
+	s := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, clientIP(req))
+	})}
+	go serve(s, lns)
+	defer s.Close()
+	resp, err := http.Get("http://" + lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "::1" {
+		t.Errorf("Got client IP %q, expected %q", body, "::1")
+	}
+}
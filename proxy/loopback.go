@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+)
+
+// socketOwnerKey is the request context key for the process at the other end
+// of a loopback TCP connection.
+type socketOwnerKey struct{}
+
+// socketOwner finds the process at the other end of a loopback TCP
+// connection, the first time it's asked, from the proc filesystem mounted at
+// procRoot.
+type socketOwner struct {
+	procRoot       string
+	client, server *net.TCPAddr
+
+	once sync.Once
+	p    *peerCred
+}
+
+func (o *socketOwner) peer() *peerCred {
+	o.once.Do(func() {
+		p := &peerCred{}
+		p.pid, p.uid, p.err = pods.FindSocketOwner(o.procRoot, o.client, o.server)
+		if p.err == nil {
+			p.cgroup, p.err = readCgroup(o.procRoot, p.pid)
+		}
+		o.p = p
+	})
+	return o.p
+}
+
+// loopbackOwner returns the owner of the client socket a request arrived on,
+// if it arrived over loopback and loopback clients are resolved.
+func loopbackOwner(ctx context.Context) (*socketOwner, bool) {
+	o, ok := ctx.Value(socketOwnerKey{}).(*socketOwner)
+	return o, ok
+}
+
+// withSocketOwner is used in http.Server.ConnContext when loopback clients
+// are resolved.  It must run after withOriginalDst, since in transparent mode
+// the client's socket is connected to the original destination rather than
+// to the proxy.
+func withSocketOwner(ctx context.Context, c net.Conn, procRoot string) context.Context {
+	client, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !client.IP.IsLoopback() {
+		return ctx
+	}
+	server, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, socketOwnerKey{}, &socketOwner{procRoot: procRoot, client: client, server: server})
+}
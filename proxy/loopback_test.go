@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+func TestLoopbackClients(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skipf("No /proc/net/tcp: %v", err)
+	}
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, "ok")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kube-env is only revealed to the test's uid.
+	policy, err := metadata.ParsePolicy([]byte(fmt.Sprintf(`{"uids": {"%d": {"concealedInstanceAttributes": {"globs": []}}}}`, os.Getuid())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyProc, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptyProc)
+
+	tests := []struct {
+		name       string
+		procRoot   string
+		expectCode int
+	}{
+		{"found", "/proc", http.StatusOK},
+		{"not found", emptyProc, http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		procRoot := tc.procRoot
+		s := &http.Server{
+			Handler: newUpstreamHandler(u, testOptions, policy),
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return withSocketOwner(ctx, c, procRoot)
+			},
+		}
+		go s.Serve(ln)
+		req, err := http.NewRequest("GET", "http://"+ln.Addr().String()+"/computeMetadata/v1/instance/attributes/kube-env", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		s.Close()
+		if resp.StatusCode != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d", tc.name, resp.StatusCode, tc.expectCode)
+		}
+	}
+}
+
+func TestWithSocketOwner(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		remote string
+		expect bool
+	}{
+		{"127.0.0.1:41000", true},
+		{"[::1]:41000", true},
+		{"[::ffff:127.0.0.1]:41000", true},
+		{"10.0.0.5:41000", false},
+	}
+	for _, tc := range tests {
+		remote, _ := net.ResolveTCPAddr("tcp", tc.remote)
+		c := fakeConn{local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 988}, remote: remote}
+		if _, got := loopbackOwner(withSocketOwner(context.Background(), c, "/proc")); got != tc.expect {
+			t.Errorf("Got socket owner %t for client %s, expected %t", got, tc.remote, tc.expect)
+		}
+	}
+}
+
+// fakeConn is a net.Conn with fixed addresses.
+type fakeConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c fakeConn) LocalAddr() net.Addr  { return c.local }
+func (c fakeConn) RemoteAddr() net.Addr { return c.remote }
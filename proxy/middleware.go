@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metrics"
+)
+
+// Middleware hooks into the handling of every request by a Handler.  Hooks
+// are called in the order middlewares are registered, after the built-in
+// logging, metrics and X-Forwarded-For middlewares, except for PostResponse
+// hooks, which are called in reverse order.
+//
+// A hook rejects the request by returning an error.  A *Rejection is
+// responded with as is; any other error is responded with as 403 Forbidden.
+//
+// Embed BaseMiddleware to implement only some of the hooks.
+type Middleware interface {
+	// PreFilter is called before the request is checked against policy.
+	// It may replace x.Request, even with one with a new context, or wrap
+	// x.ResponseWriter.  Once a
+	// PreFilter hook rejects the request, the later ones aren't called.
+	PreFilter(x *Exchange) error
+	// PostFilter is called once the request was checked against policy,
+	// whether it was allowed or not.  Returning an error rejects a request
+	// that was allowed.
+	PostFilter(x *Exchange) error
+	// PreUpstream is called with the request about to be sent to the
+	// metadata server, after the proxy's changes to it, and may change it
+	// further.
+	PreUpstream(x *Exchange, out *http.Request) error
+	// PostResponse is called once the response was written, for every
+	// request, even if it was rejected before the middleware's other hooks
+	// were called.
+	PostResponse(x *Exchange)
+}
+
+// BaseMiddleware implements every Middleware hook as a no-op.
+type BaseMiddleware struct{}
+
+func (BaseMiddleware) PreFilter(x *Exchange) error                      { return nil }
+func (BaseMiddleware) PostFilter(x *Exchange) error                     { return nil }
+func (BaseMiddleware) PreUpstream(x *Exchange, out *http.Request) error { return nil }
+func (BaseMiddleware) PostResponse(x *Exchange)                         {}
+
+// Exchange is a request being handled, and what's known about it so far.
+type Exchange struct {
+	// Request is the client's request.
+	Request *http.Request
+	// ResponseWriter is where the response is written.
+	ResponseWriter http.ResponseWriter
+	// Start is when the Handler got the request.
+	Start time.Time
+	// Policy is the policy the request was checked against, and Caller
+	// what's known of where it comes from, once known.
+	Policy *metadata.Policy
+	Caller metadata.Caller
+	// Path is the cleaned path forwarded to the metadata server, once the
+	// request is allowed.
+	Path string
+	// Rejection is why the request was refused, if it was.
+	Rejection *Rejection
+	// Code is the status code of the response, once written.
+	Code int
+}
+
+// exchangeKey is the request context key for the request's Exchange.
+type exchangeKey struct{}
+
+// exchangeFrom returns the Exchange of the request with context ctx, or nil.
+func exchangeFrom(ctx context.Context) *Exchange {
+	x, _ := ctx.Value(exchangeKey{}).(*Exchange)
+	return x
+}
+
+// Rejection is a request refused by the proxy or by a middleware.
+type Rejection struct {
+	// Code is the HTTP status code to respond with.
+	Code int
+	// Reason is a short, fixed identifier for why the request was
+	// rejected, suitable for use as a metric label.
+	Reason string
+	// Message is the body of the response.
+	Message string
+	// Header holds headers to respond with, such as Allow.
+	Header http.Header
+	// Body, if set, is the body of the response as is, in place of
+	// Message, such as a decoy's content.
+	Body []byte
+}
+
+func (r *Rejection) Error() string {
+	return r.Message
+}
+
+// write responds with the rejection.
+func (r *Rejection) write(rw http.ResponseWriter) {
+	for k, v := range r.Header {
+		rw.Header()[k] = v
+	}
+	if r.Body != nil {
+		rw.WriteHeader(r.Code)
+		rw.Write(r.Body)
+		return
+	}
+	http.Error(rw, r.Message, r.Code)
+}
+
+// reasonMiddleware is the reason for rejections by middlewares that return
+// errors other than Rejections.
+const reasonMiddleware = "middleware"
+
+// rejectionFor returns the Rejection for an error rejecting a request.
+func rejectionFor(err error) *Rejection {
+	switch err := err.(type) {
+	case *Rejection:
+		return err
+	case *metadata.FilterError:
+		r := &Rejection{Code: err.Code, Reason: err.Reason, Message: err.Error()}
+		if len(err.Allow) > 0 {
+			r.Header = http.Header{"Allow": {strings.Join(err.Allow, ", ")}}
+		}
+		return r
+	case *tokenError:
+		return &Rejection{Code: err.code, Reason: err.reason, Message: err.msg}
+	}
+	return &Rejection{Code: http.StatusForbidden, Reason: reasonMiddleware, Message: err.Error()}
+}
+
+// middlewareError is returned by upstreamTransport when a PreUpstream hook
+// rejects a request, so that it isn't mistaken for an upstream failure.
+type middlewareError struct {
+	err error
+}
+
+func (e middlewareError) Error() string {
+	return e.err.Error()
+}
+
+// upstreamTransport is http.DefaultTransport, calling the PreUpstream hooks
+// of middlewares before each request.
+type upstreamTransport struct {
+	middlewares []Middleware
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if x := exchangeFrom(req.Context()); x != nil {
+		for _, m := range t.middlewares {
+			if err := m.PreUpstream(x, req); err != nil {
+				return nil, middlewareError{err}
+			}
+		}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// statusWriter records the status code of the response in its Exchange.
+type statusWriter struct {
+	http.ResponseWriter
+	x *Exchange
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.x.Code == 0 {
+		s.x.Code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.x.Code == 0 {
+		s.x.Code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for
+// http.ResponseController.
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// builtinMiddlewares are the middlewares every Handler starts with.
+var builtinMiddlewares = []Middleware{
+	loggingMiddleware{},
+	metricsMiddleware{},
+	forwardedForMiddleware{},
+}
+
+// loggingMiddleware logs the path of every request.
+type loggingMiddleware struct {
+	BaseMiddleware
+}
+
+func (loggingMiddleware) PreFilter(x *Exchange) error {
+	log.Println(x.Request.URL.Path)
+	return nil
+}
+
+// Filter results, as used in metric labels.
+const (
+	filterResultBlocked = "filter_result_blocked"
+	filterResultProxied = "filter_result_proxied"
+)
+
+// metricsMiddleware counts responses by filter result and status code, and
+// rejected requests by reason.
+type metricsMiddleware struct {
+	BaseMiddleware
+}
+
+func (metricsMiddleware) PreFilter(x *Exchange) error {
+	x.ResponseWriter = responseWriter{x, x.ResponseWriter}
+	return nil
+}
+
+func (metricsMiddleware) PostResponse(x *Exchange) {
+	if x.Rejection == nil {
+		return
+	}
+	metrics.FilterRejectCounter.WithLabelValues(x.Rejection.Reason).Inc()
+	if x.Rejection.Reason == metadata.ReasonHostNotAllowed {
+		metrics.HostRejectCounter.Inc()
+	}
+}
+
+// responseWriter wraps the given http.ResponseWriter to record metrics.
+type responseWriter struct {
+	x *Exchange
+	http.ResponseWriter
+}
+
+// WriteHeader records the header and writes the appropriate metric.
+func (m responseWriter) WriteHeader(code int) {
+	filterResult := filterResultProxied
+	if m.x.Rejection != nil {
+		filterResult = filterResultBlocked
+	}
+	metrics.RequestCounter.WithLabelValues(filterResult, strconv.Itoa(code)).Inc()
+	m.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for
+// http.ResponseController.
+func (m responseWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// forwardedForMiddleware refuses requests with X-Forwarded-For headers, and
+// strips the one httputil.ReverseProxy.ServeHTTP adds before requests are
+// sent upstream, since the GCE metadata server rejects requests with that
+// header.
+type forwardedForMiddleware struct {
+	BaseMiddleware
+}
+
+func (forwardedForMiddleware) PreFilter(x *Exchange) error {
+	if _, ok := x.Request.Header["X-Forwarded-For"]; ok {
+		return &Rejection{
+			Code:    http.StatusForbidden,
+			Reason:  metadata.ReasonForwardedFor,
+			Message: "Calls with X-Forwarded-For header are not allowed by the metadata proxy",
+		}
+	}
+	return nil
+}
+
+func (forwardedForMiddleware) PreUpstream(x *Exchange, out *http.Request) error {
+	out.Header.Del("X-Forwarded-For")
+	return nil
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+)
+
+// testMiddleware logs its hooks as they're called, and calls the functions
+// set for them.
+type testMiddleware struct {
+	name         string
+	log          *hookLog
+	preFilter    func(x *Exchange) error
+	postFilter   func(x *Exchange) error
+	preUpstream  func(x *Exchange, out *http.Request) error
+	postResponse func(x *Exchange)
+}
+
+type hookLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *hookLog) add(call string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, call)
+}
+
+func (m *testMiddleware) PreFilter(x *Exchange) error {
+	m.log.add(m.name + ".PreFilter")
+	if m.preFilter != nil {
+		return m.preFilter(x)
+	}
+	return nil
+}
+
+func (m *testMiddleware) PostFilter(x *Exchange) error {
+	m.log.add(m.name + ".PostFilter")
+	if m.postFilter != nil {
+		return m.postFilter(x)
+	}
+	return nil
+}
+
+func (m *testMiddleware) PreUpstream(x *Exchange, out *http.Request) error {
+	m.log.add(m.name + ".PreUpstream")
+	if m.preUpstream != nil {
+		return m.preUpstream(x, out)
+	}
+	return nil
+}
+
+func (m *testMiddleware) PostResponse(x *Exchange) {
+	m.log.add(m.name + ".PostResponse")
+	if m.postResponse != nil {
+		m.postResponse(x)
+	}
+}
+
+// newTestUpstream returns a metadata server that answers every request with
+// "ok", and the last request it got.
+func newTestUpstream() (*httptest.Server, func() *http.Request) {
+	var mu sync.Mutex
+	var last *http.Request
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		last = req
+		mu.Unlock()
+		rw.Write([]byte("ok"))
+	}))
+	return s, func() *http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		r := last
+		last = nil
+		return r
+	}
+}
+
+func TestMiddlewareHooks(t *testing.T) {
+	t.Parallel()
+	upstream, _ := newTestUpstream()
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	log := &hookLog{}
+	var seen Exchange
+	a := &testMiddleware{name: "a", log: log}
+	b := &testMiddleware{name: "b", log: log,
+		postFilter: func(x *Exchange) error {
+			seen.Policy, seen.Path = x.Policy, x.Path
+			return nil
+		},
+		postResponse: func(x *Exchange) {
+			seen.Code, seen.Rejection = x.Code, x.Rejection
+		},
+	}
+	opts := testOptions
+	opts.Middlewares = []Middleware{a, b}
+	h := newUpstreamHandler(u, opts, metadata.DefaultPolicy())
+
+	req := httptest.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/./id", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Got code %d, expected %d: %s", rw.Code, http.StatusOK, rw.Body)
+	}
+	expected := []string{
+		"a.PreFilter", "b.PreFilter",
+		"a.PostFilter", "b.PostFilter",
+		"a.PreUpstream", "b.PreUpstream",
+		"b.PostResponse", "a.PostResponse",
+	}
+	if !reflect.DeepEqual(log.calls, expected) {
+		t.Errorf("Got hooks %q, expected %q", log.calls, expected)
+	}
+	if seen.Policy == nil || seen.Path != "/computeMetadata/v1/instance/id" {
+		t.Errorf("Got policy %v and path %q after filtering, expected a policy and %q", seen.Policy, seen.Path, "/computeMetadata/v1/instance/id")
+	}
+	if seen.Code != http.StatusOK || seen.Rejection != nil {
+		t.Errorf("Got code %d and rejection %v after responding, expected %d and none", seen.Code, seen.Rejection, http.StatusOK)
+	}
+}
+
+func TestMiddlewareRejections(t *testing.T) {
+	t.Parallel()
+	upstream, lastRequest := newTestUpstream()
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	tenantRejection := &Rejection{Code: http.StatusUnauthorized, Reason: "no_tenant", Message: "No tenant", Header: http.Header{"Www-Authenticate": {"Tenant"}}}
+	requireTenant := func(x *Exchange) error {
+		if x.Request.Header.Get("X-Tenant") == "" {
+			return tenantRejection
+		}
+		return nil
+	}
+	tests := []struct {
+		name         string
+		middleware   *testMiddleware
+		header       http.Header
+		expectCode   int
+		expectBody   string
+		expectHeader http.Header
+		expectReason string
+		expectSent   bool
+	}{
+		{
+			name:       "allowed",
+			middleware: &testMiddleware{preFilter: requireTenant},
+			header:     http.Header{"Metadata-Flavor": {"Google"}, "X-Tenant": {"a"}},
+			expectCode: http.StatusOK,
+			expectBody: "ok",
+			expectSent: true,
+		},
+		{
+			name:         "pre-filter rejection",
+			middleware:   &testMiddleware{preFilter: requireTenant},
+			header:       http.Header{"Metadata-Flavor": {"Google"}},
+			expectCode:   http.StatusUnauthorized,
+			expectBody:   "No tenant\n",
+			expectHeader: http.Header{"Www-Authenticate": {"Tenant"}},
+			expectReason: "no_tenant",
+		},
+		{
+			name: "post-filter error",
+			middleware: &testMiddleware{postFilter: func(x *Exchange) error {
+				return errors.New("Not today")
+			}},
+			header:       http.Header{"Metadata-Flavor": {"Google"}},
+			expectCode:   http.StatusForbidden,
+			expectBody:   "Not today\n",
+			expectReason: reasonMiddleware,
+		},
+		{
+			name:         "filter rejection first",
+			middleware:   &testMiddleware{postFilter: requireTenant},
+			expectCode:   http.StatusForbidden,
+			expectReason: metadata.ReasonMissingMetadataFlavor,
+		},
+		{
+			name: "pre-upstream rejection",
+			middleware: &testMiddleware{preUpstream: func(x *Exchange, out *http.Request) error {
+				return &Rejection{Code: http.StatusTooManyRequests, Reason: "rate_limited", Message: "Slow down"}
+			}},
+			header:       http.Header{"Metadata-Flavor": {"Google"}},
+			expectCode:   http.StatusTooManyRequests,
+			expectBody:   "Slow down\n",
+			expectReason: "rate_limited",
+		},
+		{
+			name:         "forwarded for",
+			middleware:   &testMiddleware{},
+			header:       http.Header{"Metadata-Flavor": {"Google"}, "X-Forwarded-For": {"10.0.0.1"}},
+			expectCode:   http.StatusForbidden,
+			expectReason: metadata.ReasonForwardedFor,
+		},
+	}
+	for _, tc := range tests {
+		var rejection *Rejection
+		tc.middleware.log = &hookLog{}
+		tc.middleware.postResponse = func(x *Exchange) {
+			rejection = x.Rejection
+		}
+		opts := testOptions
+		opts.Middlewares = []Middleware{tc.middleware}
+		h := newUpstreamHandler(u, opts, metadata.DefaultPolicy())
+
+		req := httptest.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/id", nil)
+		for k, v := range tc.header {
+			req.Header[k] = v
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d: %s", tc.name, rw.Code, tc.expectCode, rw.Body)
+		}
+		if body, _ := ioutil.ReadAll(rw.Body); tc.expectBody != "" && string(body) != tc.expectBody {
+			t.Errorf("%s: got body %q, expected %q", tc.name, body, tc.expectBody)
+		}
+		for k := range tc.expectHeader {
+			if got, expected := rw.Header().Get(k), tc.expectHeader.Get(k); got != expected {
+				t.Errorf("%s: got %s %q, expected %q", tc.name, k, got, expected)
+			}
+		}
+		reason := ""
+		if rejection != nil {
+			reason = rejection.Reason
+		}
+		if reason != tc.expectReason {
+			t.Errorf("%s: got rejection reason %q, expected %q", tc.name, reason, tc.expectReason)
+		}
+		sent := lastRequest()
+		if (sent != nil) != tc.expectSent {
+			t.Errorf("%s: got request sent upstream %v, expected %v", tc.name, sent != nil, tc.expectSent)
+		}
+		if sent != nil {
+			if v, ok := sent.Header["X-Forwarded-For"]; ok {
+				t.Errorf("%s: got X-Forwarded-For %q upstream, expected none", tc.name, v)
+			}
+		}
+	}
+}
+
+func TestMiddlewarePreUpstreamChangesRequest(t *testing.T) {
+	t.Parallel()
+	upstream, lastRequest := newTestUpstream()
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	opts := testOptions
+	opts.Middlewares = []Middleware{&testMiddleware{log: &hookLog{},
+		preUpstream: func(x *Exchange, out *http.Request) error {
+			out.Header.Set("X-Internal-Auth", "secret for "+x.Path)
+			return nil
+		},
+	}}
+	h := newUpstreamHandler(u, opts, metadata.DefaultPolicy())
+	req := httptest.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/id", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	sent := lastRequest()
+	if sent == nil {
+		t.Fatalf("Got no request sent upstream, expected one")
+	}
+	if got, expected := sent.Header.Get("X-Internal-Auth"), "secret for /computeMetadata/v1/instance/id"; got != expected {
+		t.Errorf("Got X-Internal-Auth %q upstream, expected %q", got, expected)
+	}
+	if v, ok := sent.Header["X-Forwarded-For"]; ok {
+		t.Errorf("Got X-Forwarded-For %q upstream, expected none", v)
+	}
+}
+
+func TestMiddlewarePreFilterReplacesContext(t *testing.T) {
+	t.Parallel()
+	upstream, lastRequest := newTestUpstream()
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	log := &hookLog{}
+	opts := testOptions
+	opts.Middlewares = []Middleware{&testMiddleware{name: "a", log: log,
+		preFilter: func(x *Exchange) error {
+			x.Request = x.Request.WithContext(context.Background())
+			return nil
+		},
+	}}
+	h := newUpstreamHandler(u, opts, metadata.DefaultPolicy())
+	req := httptest.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/id", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Got code %d, expected %d: %s", rw.Code, http.StatusOK, rw.Body)
+	}
+	expected := []string{"a.PreFilter", "a.PostFilter", "a.PreUpstream", "a.PostResponse"}
+	if !reflect.DeepEqual(log.calls, expected) {
+		t.Errorf("Got hooks %q, expected %q", log.calls, expected)
+	}
+	sent := lastRequest()
+	if sent == nil {
+		t.Fatalf("Got no request sent upstream, expected one")
+	}
+	if v, ok := sent.Header["X-Forwarded-For"]; ok {
+		t.Errorf("Got X-Forwarded-For %q upstream, expected none", v)
+	}
+}
@@ -0,0 +1,67 @@
+//go:build linux
+
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from <linux/netfilter_ipv4.h>, which has
+// the same value as IP6T_SO_ORIGINAL_DST.
+const soOriginalDst = 80
+
+// getOriginalDst returns the destination c was bound for before netfilter
+// redirected it to us, as recorded by conntrack.  Connections that weren't
+// redirected report their actual destination.
+func getOriginalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := c.LocalAddr().(*net.TCPAddr)
+	ipv4 := local != nil && local.IP.To4() != nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		// The syscall package has no getsockopt for a raw sockaddr, but
+		// these structs are at least as large as sockaddr_in and
+		// sockaddr_in6 respectively, and begin with the same layout.
+		if ipv4 {
+			var mreq *syscall.IPv6Mreq
+			mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if sockErr != nil {
+				return
+			}
+			// struct sockaddr_in: family, port (big-endian), address.
+			b := mreq.Multiaddr
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+				Port: int(b[2])<<8 | int(b[3]),
+			}
+			return
+		}
+		var info *syscall.IPv6MTUInfo
+		info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if sockErr != nil {
+			return
+		}
+		// struct sockaddr_in6 holds the port in network byte order.
+		var port [2]byte
+		binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+		addr = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("failed to get original destination: %v", sockErr)
+	}
+	return addr, nil
+}
@@ -0,0 +1,109 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestGetOriginalDstNetns redirects connections with a real DNAT rule in a
+// new network namespace, and checks that the transparent listener sees where
+// they were bound for.  It needs root and iptables.
+func TestGetOriginalDstNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test needs root to create a network namespace")
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("Test needs iptables")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Network namespaces belong to threads.  This thread is never
+		// unlocked, so it exits with the goroutine rather than being
+		// reused outside the namespace.
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			t.Errorf("Failed to create network namespace: %v", err)
+			return
+		}
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Errorf("Failed to listen: %v", err)
+			return
+		}
+		defer ln.Close()
+		for _, args := range [][]string{
+			{"ip", "link", "set", "lo", "up"},
+			{"ip", "addr", "add", "169.254.169.254/32", "dev", "lo"},
+			{"iptables", "-t", "nat", "-A", "OUTPUT", "-d", "169.254.169.254", "-p", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", ln.Addr().String()},
+		} {
+			if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+				t.Errorf("Failed to run %v: %v: %s", args, err, out)
+				return
+			}
+		}
+
+		dsts, err := ParseDestinations("169.254.169.254:80")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		tln := tcpKeepAliveListener{
+			TCPListener:     ln,
+			keepAlivePeriod: time.Minute,
+			originalDst:     getOriginalDst,
+			originalDsts:    dsts,
+		}
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, err := tln.Accept()
+			if err != nil {
+				t.Errorf("Failed to accept: %v", err)
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}()
+
+		// A direct connection isn't redirected, so it's refused, and
+		// the listener carries on to the redirected one.
+		direct, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Errorf("Failed to dial directly: %v", err)
+			return
+		}
+		defer direct.Close()
+		direct.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := direct.Read(make([]byte, 1)); err == nil {
+			t.Errorf("Got data on direct connection, expected it to be closed")
+		}
+
+		redirected, err := net.Dial("tcp", "169.254.169.254:80")
+		if err != nil {
+			t.Errorf("Failed to dial redirected: %v", err)
+			return
+		}
+		defer redirected.Close()
+		select {
+		case c := <-accepted:
+			if c == nil {
+				return
+			}
+			defer c.Close()
+			if got, expect := c.LocalAddr().String(), "169.254.169.254:80"; got != expect {
+				t.Errorf("Got original destination %q, expected %q", got, expect)
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("Timed out waiting for redirected connection")
+		}
+	}()
+	<-done
+}
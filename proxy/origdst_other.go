@@ -0,0 +1,14 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// getOriginalDst always fails, since only Linux records the original
+// destination of redirected connections.
+func getOriginalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("original destinations are only available on Linux")
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// getPeerCred returns the pid, uid and gid of the process that connected c,
+// as recorded by the kernel when it connected.
+func getPeerCred(c *net.UnixConn) (pid int, uid, gid uint32, err error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		cred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if sockErr != nil {
+		return 0, 0, 0, fmt.Errorf("failed to get peer credentials: %v", sockErr)
+	}
+	return int(cred.Pid), cred.Uid, cred.Gid, nil
+}
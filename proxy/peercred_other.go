@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// getPeerCred always fails, since SO_PEERCRED is only available on Linux.
+func getPeerCred(c *net.UnixConn) (pid int, uid, gid uint32, err error) {
+	return 0, 0, 0, errors.New("peer credentials are only available on Linux")
+}
@@ -0,0 +1,312 @@
+// Package proxy filters and proxies requests to the GCE metadata server, so
+// that pods only see what their policy allows.
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/tokens"
+)
+
+// Handler filters requests to the metadata server by policy, and proxies
+// those allowed.
+type Handler struct {
+	proxy *httputil.ReverseProxy
+	// policy holds a policyHolder with the policy in effect.
+	policy atomic.Value
+	// resolver, if set, resolves the pods requests come from, so that
+	// their namespace's policy applies.
+	resolver PodResolver
+	// verifier, if set, verifies the service account tokens required by
+	// token rules.
+	verifier tokens.Verifier
+	// authorizer, if set, authorizes the requests the policy allows, and
+	// authorizerFailOpen allows them if it fails.
+	authorizer         Authorizer
+	authorizerFailOpen bool
+	// auditor records audit events, and canaryKey keys the canaries of
+	// the decoys served.
+	auditor   Auditor
+	canaryKey []byte
+	// middlewares are the built-in middlewares, then those in the
+	// options.
+	middlewares    []Middleware
+	failure        FailureModes
+	cache          *responseCache
+	writeTimeout   time.Duration
+	maxWaitTimeout time.Duration
+}
+
+// defaultUpstream is the metadata server proxied to by default.
+var defaultUpstream = &url.URL{Scheme: "http", Host: "169.254.169.254"}
+
+// NewHandler returns a Handler configured by opts.  Only the options for the
+// handler are checked; the rest are checked by Server.Run.
+func NewHandler(opts Options) (*Handler, error) {
+	if err := opts.Failure.Validate(); err != nil {
+		return nil, err
+	}
+	u := opts.Upstream
+	if u == nil {
+		u = defaultUpstream
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	h := &Handler{
+		proxy:              proxy,
+		resolver:           opts.Resolver,
+		verifier:           opts.Verifier,
+		authorizer:         opts.Authorizer,
+		authorizerFailOpen: opts.AuthorizerFailOpen,
+		auditor:            opts.Auditor,
+		middlewares:        append(append([]Middleware{}, builtinMiddlewares...), opts.Middlewares...),
+		failure:            opts.Failure,
+		writeTimeout:       opts.WriteTimeout,
+		maxWaitTimeout:     opts.MaxWaitTimeout,
+	}
+	if h.auditor == nil {
+		h.auditor = logAuditor{}
+	}
+	h.canaryKey = make([]byte, 32)
+	if _, err := rand.Read(h.canaryKey); err != nil {
+		return nil, err
+	}
+	if opts.Policy != nil {
+		if err := opts.Policy.CompileRules(); err != nil {
+			return nil, fmt.Errorf("invalid policy: %v", err)
+		}
+	}
+	h.setPolicy(opts.Policy)
+	if opts.Failure.Upstream == FailCache {
+		h.cache = newResponseCache()
+	}
+
+	bp := newBufferPool()
+	proxy.BufferPool = bp
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		bp.observe(resp.ContentLength)
+		if resp.StatusCode >= 500 {
+			h.upstreamFailed(resp)
+		} else if h.cache != nil {
+			if err := h.cache.store(resp); err != nil {
+				return rewriteError{err}
+			}
+		}
+		if err := applyRewrite(resp); err != nil {
+			return rewriteError{err}
+		}
+		return nil
+	}
+	proxy.ErrorHandler = h.proxyError
+
+	proxy.Transport = upstreamTransport{h.middlewares}
+
+	return h, nil
+}
+
+// ServeHTTP serves http requests for the metadata proxy, calling the hooks
+// of the handler's middlewares along the way.
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	x := &Exchange{Start: time.Now()}
+	x.Request = req.WithContext(context.WithValue(req.Context(), exchangeKey{}, x))
+	x.ResponseWriter = &statusWriter{rw, x}
+	defer func() {
+		for i := len(h.middlewares) - 1; i >= 0; i-- {
+			h.middlewares[i].PostResponse(x)
+		}
+	}()
+
+	for _, m := range h.middlewares {
+		if err := m.PreFilter(x); err != nil {
+			x.Rejection = rejectionFor(err)
+			break
+		}
+	}
+	// A PreFilter may have replaced the request with one whose context
+	// lacks the Exchange, which the PreUpstream hooks are found by.
+	if exchangeFrom(x.Request.Context()) != x {
+		x.Request = x.Request.WithContext(context.WithValue(x.Request.Context(), exchangeKey{}, x))
+	}
+	if x.Rejection == nil {
+		x.Rejection = h.filter(x)
+	}
+	for _, m := range h.middlewares {
+		if err := m.PostFilter(x); err != nil && x.Rejection == nil {
+			x.Rejection = rejectionFor(err)
+		}
+	}
+	if x.Rejection != nil {
+		x.Rejection.write(x.ResponseWriter)
+		return
+	}
+	h.forward(x)
+}
+
+// filter checks x's request against the policy for its client, and returns
+// why it's rejected, if it is.
+//
+// Order of the checks below matters; specifically, concealment comes before
+// proxies, since proxies just return immediately.
+func (h *Handler) filter(x *Exchange) *Rejection {
+	req := x.Request
+	policy, caller, err := h.policyFor(req)
+	if err != nil {
+		reason := reasonPolicyUnavailable
+		if err == errIdentityUnavailable {
+			reason = reasonIdentityUnavailable
+		}
+		return &Rejection{Code: http.StatusServiceUnavailable, Reason: reason, Message: err.Error()}
+	}
+	x.Policy, x.Caller = policy, caller
+
+	var id *tokens.Identity
+	cleanedPath, err := policy.Filter(req)
+	if err == nil {
+		id, err = h.checkToken(req, policy, cleanedPath)
+	}
+	if err == nil {
+		err = policy.CheckRules(req, cleanedPath, caller)
+	}
+	if err != nil {
+		r := rejectionFor(err)
+		if d := h.decoy(req, policy, cleanedPath, caller, r, err); d != nil {
+			return d
+		}
+		return blockedResponse(req, policy, cleanedPath, r, err)
+	}
+	if h.authorizer != nil {
+		if r := h.checkExtAuthz(req, policy, cleanedPath, caller, id); r != nil {
+			return r
+		}
+	}
+	x.Path = cleanedPath
+	return nil
+}
+
+// forward proxies x's allowed request to the metadata server.
+func (h *Handler) forward(x *Exchange) {
+	req, rw, policy, cleanedPath := x.Request, x.ResponseWriter, x.Policy, x.Path
+	// Forward exactly the path that was filtered, escaped canonically.
+	req.URL.Path = cleanedPath
+	req.URL.RawPath = ""
+	// Send the metadata server's own name as the Host, rather than
+	// whichever allowed alias the client used.
+	req.Host = ""
+	// Filter has already parsed the query, so this can't fail.
+	req.URL.RawQuery, _ = metadata.CanonicalQuery(req.URL.RawQuery)
+	policy.SanitizeHeader(req.Header)
+	if query := req.URL.Query(); req.Method == "HEAD" {
+		if policy.NeedsRedaction(query) || policy.NeedsKubeEnvFilter(cleanedPath) || policy.NeedsListingFilter(cleanedPath, query) {
+			req = withRewrite(req, rewriteHead)
+		}
+	} else if policy.NeedsRedaction(query) {
+		req = redactRecursive(req, policy, cleanedPath, query)
+	} else if policy.NeedsKubeEnvFilter(cleanedPath) {
+		req = filterKubeEnv(req, policy, query)
+	} else if policy.NeedsListingFilter(cleanedPath, query) {
+		req = filterListing(req, policy, cleanedPath, query)
+	}
+	// Have the upstream give up waiting when the proxy would, rather than
+	// wait past the write deadline.
+	query := req.URL.Query()
+	wait := h.capTimeout(query)
+	req.URL.RawQuery = query.Encode()
+	if wait > 0 {
+		// Give long-polls until the upstream gives up waiting, plus
+		// the usual time to write the response.
+		deadline := time.Now().Add(wait + h.writeTimeout)
+		if err := http.NewResponseController(rw).SetWriteDeadline(deadline); err != nil {
+			log.Printf("Failed to extend write deadline: %v", err)
+		}
+	}
+	h.proxy.ServeHTTP(rw, req)
+}
+
+// redactRecursive returns a copy of the ?recursive request req whose
+// response will have the subtrees policy conceals removed.  The response is always
+// fetched as JSON, so it can be parsed reliably, and then re-encoded in the
+// format the client asked for.
+func redactRecursive(req *http.Request, policy *metadata.Policy, cleanedPath string, query url.Values) *http.Request {
+	alt := query.Get("alt")
+	if alt == "" {
+		alt = "json"
+	}
+	contentType := "application/json"
+	if alt == "text" {
+		contentType = "application/text"
+	}
+	query.Set("alt", "json")
+	req.URL.RawQuery = query.Encode()
+	// Don't let the response be compressed, since it has to be parsed.
+	req.Header.Del("Accept-Encoding")
+	return withRewrite(req, func(resp *http.Response) error {
+		return rewriteBody(resp, contentType, func(body []byte) ([]byte, error) {
+			return policy.Redact(cleanedPath, body, alt)
+		})
+	})
+}
+
+// filterListing returns a copy of the directory listing request req whose
+// response will have the entries policy conceals removed.
+func filterListing(req *http.Request, policy *metadata.Policy, cleanedPath string, query url.Values) *http.Request {
+	alt := query.Get("alt")
+	if alt == "" {
+		alt = "text"
+	}
+	req.Header.Del("Accept-Encoding")
+	return withRewrite(req, func(resp *http.Response) error {
+		return rewriteBody(resp, "", func(body []byte) ([]byte, error) {
+			return policy.FilterListing(cleanedPath, body, alt)
+		})
+	})
+}
+
+// filterKubeEnv returns a copy of the request req for kube-env whose response
+// will have only the keys policy allows.
+func filterKubeEnv(req *http.Request, policy *metadata.Policy, query url.Values) *http.Request {
+	alt := query.Get("alt")
+	if alt == "" {
+		alt = "text"
+	}
+	req.Header.Del("Accept-Encoding")
+	return withRewrite(req, func(resp *http.Response) error {
+		return rewriteBody(resp, "", func(body []byte) ([]byte, error) {
+			return policy.FilterKubeEnv(body, alt)
+		})
+	})
+}
+
+// capTimeout caps the ?timeout_sec of query, the canonical query of a request,
+// to maxWaitTimeout in whole seconds, and returns how long the upstream may
+// wait before responding, or 0 if it isn't a ?wait_for_change request.
+// ?wait_for_change requests whose ?timeout_sec is missing or invalid get the
+// maximum; others are only capped, since the upstream doesn't wait for them.
+func (h *Handler) capTimeout(query url.Values) time.Duration {
+	maxSecs := int64(h.maxWaitTimeout / time.Second)
+	if maxSecs < 1 {
+		maxSecs = 1
+	}
+	secs, err := strconv.ParseInt(query.Get("timeout_sec"), 10, 64)
+	if wait, _ := strconv.ParseBool(query.Get("wait_for_change")); !wait {
+		if err == nil && secs > maxSecs {
+			query.Set("timeout_sec", strconv.FormatInt(maxSecs, 10))
+		}
+		return 0
+	}
+	if err != nil || secs <= 0 || secs > maxSecs {
+		secs = maxSecs
+	}
+	query.Set("timeout_sec", strconv.FormatInt(secs, 10))
+	return time.Duration(secs) * time.Second
+}
+
+// copied from net/http
@@ -0,0 +1,542 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+)
+
+var testOptions = Options{
+	MaxConnections:  10,
+	ReadTimeout:     time.Second,
+	WriteTimeout:    time.Second,
+	MaxWaitTimeout:  time.Minute,
+	MaxHeaderBytes:  1 << 10,
+	KeepAlivePeriod: time.Minute,
+	Failure:         DefaultFailureModes,
+	ProcRoot:        "/proc",
+}
+
+func TestOptionsValidate(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		modify    func(*Options)
+		expectErr bool
+	}{
+		{"valid", func(c *Options) {}, false},
+		{"no connections", func(c *Options) { c.MaxConnections = 0 }, true},
+		{"no read timeout", func(c *Options) { c.ReadTimeout = 0 }, true},
+		{"no write timeout", func(c *Options) { c.WriteTimeout = 0 }, true},
+		{"wait shorter than write", func(c *Options) { c.MaxWaitTimeout = c.WriteTimeout / 2 }, true},
+		{"wait equal to write", func(c *Options) { c.MaxWaitTimeout = c.WriteTimeout }, false},
+		{"no header bytes", func(c *Options) { c.MaxHeaderBytes = 0 }, true},
+		{"no keep-alive", func(c *Options) { c.KeepAlivePeriod = 0 }, true},
+		{"unknown failure mode", func(c *Options) { c.Failure.Startup = "retry" }, true},
+		{"missing failure mode", func(c *Options) { c.Failure.Identity = "" }, true},
+		{"default upstream failure mode", func(c *Options) { c.Failure.Upstream = FailDefault }, true},
+		{"cache upstream failure mode", func(c *Options) { c.Failure.Upstream = FailCache }, false},
+	}
+
+	for _, tc := range tests {
+		opts := testOptions
+		tc.modify(&opts)
+		if err := opts.validate(); (err != nil) != tc.expectErr {
+			t.Errorf("%s: got error %v, expected error: %t", tc.name, err, tc.expectErr)
+		}
+	}
+}
+
+func TestCapTimeout(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		query       string
+		expect      time.Duration
+		expectQuery string
+	}{
+		{"", 0, ""},
+		{"wait_for_change=false&timeout_sec=30", 0, "timeout_sec=30&wait_for_change=false"},
+		{"wait_for_change=false&timeout_sec=999999999", 0, "timeout_sec=60&wait_for_change=false"},
+		{"timeout_sec=999999999", 0, "timeout_sec=60"},
+		{"wait_for_change=true", time.Minute, "timeout_sec=60&wait_for_change=true"},
+		{"wait_for_change=true&timeout_sec=30", 30 * time.Second, "timeout_sec=30&wait_for_change=true"},
+		{"wait_for_change=true&timeout_sec=3600", time.Minute, "timeout_sec=60&wait_for_change=true"},
+		{"wait_for_change=true&timeout_sec=-5", time.Minute, "timeout_sec=60&wait_for_change=true"},
+		{"wait_for_change=true&timeout_sec=soon", time.Minute, "timeout_sec=60&wait_for_change=true"},
+	}
+
+	h := newMetadataHandler(testOptions, metadata.DefaultPolicy())
+	for _, tc := range tests {
+		query, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := h.capTimeout(query); got != tc.expect {
+			t.Errorf("%s: got %v, expected %v", tc.query, got, tc.expect)
+		}
+		if got := query.Encode(); got != tc.expectQuery {
+			t.Errorf("%s: got query %q, expected %q", tc.query, got, tc.expectQuery)
+		}
+	}
+}
+
+func TestServeHTTPCapsTimeoutSec(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.URL.RawQuery)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newUpstreamHandler(u, testOptions, metadata.DefaultPolicy())
+
+	tests := []struct {
+		url         string
+		expectQuery string
+	}{
+		{"/computeMetadata/v1/instance/?wait_for_change=true&timeout_sec=30", "timeout_sec=30&wait_for_change=true"},
+		{"/computeMetadata/v1/instance/?wait_for_change=true&timeout_sec=1800", "timeout_sec=60&wait_for_change=true"},
+		{"/computeMetadata/v1/instance/?wait_for_change=true", "timeout_sec=60&wait_for_change=true"},
+		{"/computeMetadata/v1/instance/?wait_for_change=true&timeout_sec=0", "timeout_sec=60&wait_for_change=true"},
+		{"/computeMetadata/v1/instance/?timeout_sec=1800", "timeout_sec=60"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if got := rw.Body.String(); got != tc.expectQuery {
+			t.Errorf("%s: got query %q forwarded, expected %q", tc.url, got, tc.expectQuery)
+		}
+	}
+}
+
+func TestLongPollOutlivesWriteTimeout(t *testing.T) {
+	t.Parallel()
+	opts := testOptions
+	opts.WriteTimeout = 200 * time.Millisecond
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(2 * opts.WriteTimeout)
+		rw.Write([]byte("changed"))
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newUpstreamHandler(u, opts, metadata.DefaultPolicy())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{Handler: h, WriteTimeout: opts.WriteTimeout}
+	go s.Serve(ln)
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", "http://"+ln.Addr().String()+"/computeMetadata/v1/instance/?wait_for_change=true&timeout_sec=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Host = "metadata.google.internal"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Long-poll failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed reading long-poll response: %v", err)
+	}
+	if string(body) != "changed" {
+		t.Errorf("Got body %q, expected %q", body, "changed")
+	}
+}
+
+func TestServeHTTPMethodNotAllowed(t *testing.T) {
+	t.Parallel()
+	h := newMetadataHandler(testOptions, metadata.DefaultPolicy())
+	req := httptest.NewRequest("PUT", "/computeMetadata/v1/instance/attributes/foo", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Host = "metadata.google.internal"
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got code %d, expected %d", rw.Code, http.StatusMethodNotAllowed)
+	}
+	if got, expect := rw.Header().Get("Allow"), "GET, HEAD"; got != expect {
+		t.Errorf("Got Allow header %q, expected %q", got, expect)
+	}
+}
+
+func TestServeHTTPRedactsRecursive(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if got := req.URL.Query().Get("alt"); got != "json" {
+			t.Errorf("Upstream got alt=%q, expected json", got)
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		io.WriteString(rw, `{"attributes":{"kube-env":"secret","ssh-keys":"k"},"hostname":"h"}`)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := metadata.DefaultPolicy()
+	policy.RecursiveMode = metadata.RecursiveRedact
+	h := newUpstreamHandler(u, testOptions, policy)
+
+	tests := []struct {
+		url               string
+		expectBody        string
+		expectContentType string
+	}{
+		{"/computeMetadata/v1/instance/?recursive=true", `{"attributes":{"ssh-keys":"k"},"hostname":"h"}`, "application/json"},
+		{"/computeMetadata/v1/instance/?recursive=true&alt=text", "attributes/ssh-keys k\nhostname h\n", "application/text"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		req.Header.Set("Accept-Encoding", "gzip")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Errorf("%s: got code %d, expected %d", tc.url, rw.Code, http.StatusOK)
+		}
+		if got := rw.Body.String(); got != tc.expectBody {
+			t.Errorf("%s: got body %q, expected %q", tc.url, got, tc.expectBody)
+		}
+		if got := rw.Header().Get("Content-Type"); got != tc.expectContentType {
+			t.Errorf("%s: got content type %q, expected %q", tc.url, got, tc.expectContentType)
+		}
+	}
+}
+
+func TestServeHTTPRedactionFailsClosed(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "attributes/kube-env secret\n")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := metadata.DefaultPolicy()
+	policy.RecursiveMode = metadata.RecursiveRedact
+	h := newUpstreamHandler(u, testOptions, policy)
+
+	req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/?recursive=true", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Host = "metadata.google.internal"
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Got code %d, expected %d", rw.Code, http.StatusBadGateway)
+	}
+	if strings.Contains(rw.Body.String(), "secret") {
+		t.Errorf("Got body %q, expected it to be withheld", rw.Body.String())
+	}
+}
+
+func TestServeHTTPFiltersAttributeListing(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("alt") == "json" {
+			rw.Header().Set("Content-Type", "application/json")
+			io.WriteString(rw, `["cluster-name","kube-env"]`)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/text")
+		io.WriteString(rw, "cluster-name\nkube-env\n")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newUpstreamHandler(u, testOptions, metadata.DefaultPolicy())
+
+	tests := []struct {
+		url               string
+		expectBody        string
+		expectContentType string
+	}{
+		{"/computeMetadata/v1/instance/attributes/", "cluster-name\n", "application/text"},
+		{"/computeMetadata/v1/instance/attributes/?alt=json", `["cluster-name"]`, "application/json"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if got := rw.Body.String(); got != tc.expectBody {
+			t.Errorf("%s: got body %q, expected %q", tc.url, got, tc.expectBody)
+		}
+		if got := rw.Header().Get("Content-Type"); got != tc.expectContentType {
+			t.Errorf("%s: got content type %q, expected %q", tc.url, got, tc.expectContentType)
+		}
+	}
+}
+
+func TestServeHTTPFiltersKubeEnv(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		const kubeEnv = "CLUSTER_NAME: prod\nKUBELET_KEY: secret\nKUBERNETES_MASTER_NAME: 10.0.0.2\n"
+		if req.URL.Query().Get("alt") == "json" {
+			rw.Header().Set("Content-Type", "application/json")
+			b, _ := json.Marshal(kubeEnv)
+			rw.Write(b)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/text")
+		io.WriteString(rw, kubeEnv)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := metadata.ParsePolicy([]byte(`{
+		"concealedInstanceAttributes": {"globs": ["kube-env*"]},
+		"allowedKubeEnvKeys": {"globs": ["CLUSTER_NAME", "KUBERNETES_MASTER_NAME"]},
+		"namespaces": {"agents": {"allowedKubeEnvKeys": {"globs": ["CLUSTER_NAME"]}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		pod        *pods.Pod
+		url        string
+		expectCode int
+		expectBody string
+	}{
+		{"text", nil, "/computeMetadata/v1/instance/attributes/kube-env", http.StatusOK, "CLUSTER_NAME: prod\nKUBERNETES_MASTER_NAME: 10.0.0.2\n"},
+		{"json", nil, "/computeMetadata/v1/instance/attributes/kube-env?alt=json", http.StatusOK, `"CLUSTER_NAME: prod\nKUBERNETES_MASTER_NAME: 10.0.0.2\n"`},
+		{"namespace", &pods.Pod{Namespace: "agents", Name: "agent-1"}, "/computeMetadata/v1/instance/attributes/kube-env", http.StatusOK, "CLUSTER_NAME: prod\n"},
+		{"other attribute", nil, "/computeMetadata/v1/instance/attributes/kube-env-backup", http.StatusForbidden, "This metadata endpoint is concealed\n"},
+	}
+	for _, tc := range tests {
+		opts := testOptions
+		opts.Resolver = fakeResolver{pod: tc.pod}
+		h := newUpstreamHandler(u, opts, policy)
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d", tc.name, rw.Code, tc.expectCode)
+		}
+		if got := rw.Body.String(); got != tc.expectBody {
+			t.Errorf("%s: got body %q, expected %q", tc.name, got, tc.expectBody)
+		}
+	}
+}
+
+func TestServeHTTPRewritesDropETag(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("ETag", "0123456789abcdef")
+		switch {
+		case req.URL.Query().Get("recursive") != "":
+			rw.Header().Set("Content-Type", "application/json")
+			io.WriteString(rw, `{"attributes":{"kube-env":"secret","ssh-keys":"k"}}`)
+		case strings.HasSuffix(req.URL.Path, "/kube-env"):
+			io.WriteString(rw, "CLUSTER_NAME: prod\nKUBELET_KEY: secret\n")
+		case strings.HasSuffix(req.URL.Path, "/"):
+			io.WriteString(rw, "cluster-name\nkube-env\n")
+		default:
+			io.WriteString(rw, "42")
+		}
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := metadata.DefaultPolicy()
+	policy.RecursiveMode = metadata.RecursiveRedact
+	policy.AllowedKubeEnvKeys.Globs = []string{"CLUSTER_NAME"}
+	h := newUpstreamHandler(u, testOptions, policy)
+
+	tests := []struct {
+		name                string
+		method              string
+		url                 string
+		expectETag          string
+		expectContentLength string
+	}{
+		{"redacted", "GET", "/computeMetadata/v1/instance/?recursive=true", "", "31"},
+		{"listing", "GET", "/computeMetadata/v1/instance/attributes/", "", "13"},
+		{"kube-env", "GET", "/computeMetadata/v1/instance/attributes/kube-env", "", "19"},
+		{"redacted HEAD", "HEAD", "/computeMetadata/v1/instance/?recursive=true", "", ""},
+		{"listing HEAD", "HEAD", "/computeMetadata/v1/instance/attributes/", "", ""},
+		{"kube-env HEAD", "HEAD", "/computeMetadata/v1/instance/attributes/kube-env", "", ""},
+		{"unfiltered", "GET", "/computeMetadata/v1/instance/id", "0123456789abcdef", "2"},
+		{"unfiltered HEAD", "HEAD", "/computeMetadata/v1/instance/id", "0123456789abcdef", "2"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Errorf("%s: got code %d, expected %d", tc.name, rw.Code, http.StatusOK)
+		}
+		if got := rw.Header().Get("ETag"); got != tc.expectETag {
+			t.Errorf("%s: got ETag %q, expected %q", tc.name, got, tc.expectETag)
+		}
+		if got := rw.Header().Get("Content-Length"); got != tc.expectContentLength {
+			t.Errorf("%s: got Content-Length %q, expected %q", tc.name, got, tc.expectContentLength)
+		}
+	}
+}
+
+func TestServeHTTPKubeEnvFilterFailsClosed(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "CLUSTER_NAME: prod\n- KUBELET_KEY: secret\n")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := metadata.DefaultPolicy()
+	policy.AllowedKubeEnvKeys.Globs = []string{"CLUSTER_NAME"}
+	h := newUpstreamHandler(u, testOptions, policy)
+
+	req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/attributes/kube-env", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Host = "metadata.google.internal"
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Got code %d, expected %d", rw.Code, http.StatusBadGateway)
+	}
+	if strings.Contains(rw.Body.String(), "secret") {
+		t.Errorf("Got body %q, expected it to be withheld", rw.Body.String())
+	}
+}
+
+func TestServeHTTPRewritesHost(t *testing.T) {
+	t.Parallel()
+	var gotHost string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		gotHost = req.Host
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newUpstreamHandler(u, testOptions, metadata.DefaultPolicy())
+
+	req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/id", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Host = "metadata"
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Got code %d, expected %d", rw.Code, http.StatusOK)
+	}
+	if gotHost != u.Host {
+		t.Errorf("Upstream got Host %q, expected %q", gotHost, u.Host)
+	}
+
+	req = httptest.NewRequest("GET", "/computeMetadata/v1/instance/id", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Host = "rebound.example.com"
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("Got code %d for rebound Host, expected %d", rw.Code, http.StatusForbidden)
+	}
+}
+
+// newUpstreamHandler returns a Handler with the options and policy that
+// proxies to the metadata server at u.
+func newUpstreamHandler(u *url.URL, opts Options, policy *metadata.Policy) *Handler {
+	opts.Upstream, opts.Policy = u, policy
+	h, err := NewHandler(opts)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// newMetadataHandler returns a Handler with the options and policy that
+// proxies to the real metadata server.
+func newMetadataHandler(opts Options, policy *metadata.Policy) *Handler {
+	return newUpstreamHandler(nil, opts, policy)
+}
+
+func TestRules(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := metadata.ParsePolicy([]byte(`{"rules": [{
+		"name": "prod-only",
+		"path": "/computeMetadata/v1/instance/service-accounts/*/token",
+		"expression": "'tier' in pod.labels && pod.labels.tier == 'prod' && pod.serviceAccount == 'web'"
+	}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prod := &pods.Pod{Namespace: "default", Name: "web-1", ServiceAccount: "web", Labels: map[string]string{"tier": "prod"}}
+	dev := &pods.Pod{Namespace: "default", Name: "web-2", ServiceAccount: "web", Labels: map[string]string{"tier": "dev"}}
+
+	tests := []struct {
+		name       string
+		resolver   PodResolver
+		path       string
+		expectCode int
+	}{
+		{"prod", fakeResolver{pod: prod}, "/computeMetadata/v1/instance/service-accounts/default/token", http.StatusOK},
+		{"dev", fakeResolver{pod: dev}, "/computeMetadata/v1/instance/service-accounts/default/token", http.StatusForbidden},
+		{"not a pod", fakeResolver{}, "/computeMetadata/v1/instance/service-accounts/default/token", http.StatusForbidden},
+		{"no resolver", nil, "/computeMetadata/v1/instance/service-accounts/default/token", http.StatusForbidden},
+		{"other endpoint", fakeResolver{pod: dev}, "/computeMetadata/v1/instance/id", http.StatusOK},
+	}
+	for _, tc := range tests {
+		opts := testOptions
+		opts.Resolver = tc.resolver
+		h := newUpstreamHandler(u, opts, policy)
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		req.RemoteAddr = "10.0.0.5:1234"
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d: %s", tc.name, rw.Code, tc.expectCode, rw.Body)
+		}
+	}
+}
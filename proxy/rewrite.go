@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// maxRewriteBytes bounds the size of responses that are read into memory to
+// be rewritten.  Larger responses are refused rather than passed through.
+const maxRewriteBytes = 8 << 20
+
+// responseRewrite rewrites a response from the metadata server before it's
+// returned to the client.  An error fails the request with 502 Bad Gateway.
+type responseRewrite func(resp *http.Response) error
+
+// rewriteKey is the request context key for the responseRewrite applied to
+// the response.
+type rewriteKey struct{}
+
+// withRewrite returns a shallow copy of req whose response will be passed
+// through rewrite.
+func withRewrite(req *http.Request, rewrite responseRewrite) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), rewriteKey{}, rewrite))
+}
+
+// applyRewrite passes resp through the rewrite attached to its request, if
+// any.  It's used as httputil.ReverseProxy.ModifyResponse.
+func applyRewrite(resp *http.Response) error {
+	rewrite, ok := resp.Request.Context().Value(rewriteKey{}).(responseRewrite)
+	if !ok {
+		return nil
+	}
+	return rewrite(resp)
+}
+
+// rewriteBody replaces the body of a successful response with the result of
+// passing it through f, leaving other responses untouched.  The Content-Type
+// is replaced unless contentType is empty.
+//
+// The metadata server's ETag is removed, since it changes with whatever f
+// removes.  It isn't replaced by one of the rewritten body, since the
+// metadata server wouldn't know it as a last_etag.
+func rewriteBody(resp *http.Response, contentType string, f func([]byte) ([]byte, error)) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		return fmt.Errorf("can't rewrite response with content encoding %q", enc)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRewriteBytes+1))
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	if len(body) > maxRewriteBytes {
+		return fmt.Errorf("response too large to rewrite")
+	}
+	if body, err = f(body); err != nil {
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("ETag")
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+	return nil
+}
+
+// rewriteHead removes what the headers of a response to a HEAD request tell
+// about the body the proxy would have rewritten for a GET: its length and
+// ETag.
+func rewriteHead(resp *http.Response) error {
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("ETag")
+	return nil
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/tokens"
+)
+
+// Options configure a Handler, and the Server serving it.
+type Options struct {
+	// Upstream is the metadata server to proxy to.  If nil, it's
+	// http://169.254.169.254.
+	Upstream *url.URL
+	// Policy is the policy in effect until another is set or loaded.  If
+	// nil, requests are refused until then.  Its rules are compiled by
+	// NewHandler, if they aren't already.
+	Policy *metadata.Policy
+	// Resolver, if set, resolves the pods requests come from, so that their
+	// namespace's policy applies.
+	Resolver PodResolver
+	// Verifier, if set, verifies the service account tokens required by
+	// token rules.
+	Verifier tokens.Verifier
+	// Authorizer, if set, is asked to authorize every request the policy
+	// allows.  If it fails, requests are refused with 503 Service
+	// Unavailable, unless AuthorizerFailOpen is set.
+	Authorizer         Authorizer
+	AuthorizerFailOpen bool
+	// Failure says how to handle requests when the policy, the pod
+	// resolver or the metadata server fails.
+	Failure FailureModes
+	// Auditor records audit events, such as decoys being served.  If nil,
+	// they're logged.
+	Auditor Auditor
+	// Middlewares hook into the handling of every request, after the
+	// built-in ones.
+	Middlewares []Middleware
+
+	// Listeners are the addresses the Server listens at.
+	Listeners []Listener
+	// MaxConnections bounds the number of connections served at once on
+	// listeners without a limit of their own.
+	MaxConnections int
+	// ReadTimeout and WriteTimeout are applied to every request, as in
+	// http.Server.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// MaxWaitTimeout caps how long a ?wait_for_change request may hang.  The
+	// ?timeout_sec of every request is capped to it, and the write deadline
+	// for ?wait_for_change requests is extended by the time they wait.
+	MaxWaitTimeout  time.Duration
+	MaxHeaderBytes  int
+	KeepAlivePeriod time.Duration
+	// OriginalDsts, if set, puts the listeners in transparent mode: only
+	// connections redirected from one of these destinations are served.
+	OriginalDsts []*net.TCPAddr
+	// UnixSocket, if set, is the path of a unix socket to also listen on,
+	// with permissions UnixSocketMode.  Its clients are identified by
+	// their credentials rather than their address.
+	UnixSocket     string
+	UnixSocketMode os.FileMode
+	// ResolveLoopback identifies clients connecting over loopback by the
+	// process owning their socket, like unix socket clients.
+	ResolveLoopback bool
+	// UnencryptedHTTP2 serves HTTP/2 without TLS as well as HTTP/1, as
+	// gRPC clients such as Envoy's need to call a handler made by
+	// NewAuthzHandler.
+	UnencryptedHTTP2 bool
+	// ProcRoot is where the proc filesystem that client processes are
+	// looked up in is mounted.
+	ProcRoot string
+}
+
+// validate returns an error if the options can't be served with.
+func (c Options) validate() error {
+	if c.MaxConnections <= 0 {
+		return fmt.Errorf("max connections must be positive, got %d", c.MaxConnections)
+	}
+	if c.ReadTimeout <= 0 {
+		return fmt.Errorf("read timeout must be positive, got %v", c.ReadTimeout)
+	}
+	if c.WriteTimeout <= 0 {
+		return fmt.Errorf("write timeout must be positive, got %v", c.WriteTimeout)
+	}
+	if c.MaxWaitTimeout < c.WriteTimeout {
+		return fmt.Errorf("max wait timeout (%v) must be at least the write timeout (%v)", c.MaxWaitTimeout, c.WriteTimeout)
+	}
+	if c.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("max header bytes must be positive, got %d", c.MaxHeaderBytes)
+	}
+	if c.KeepAlivePeriod <= 0 {
+		return fmt.Errorf("keep-alive period must be positive, got %v", c.KeepAlivePeriod)
+	}
+	if (c.UnixSocket != "" || c.ResolveLoopback) && c.ProcRoot == "" {
+		return fmt.Errorf("proc root must be set to identify unix socket or loopback clients")
+	}
+	if err := c.Failure.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Server serves a handler at the listeners and unix socket in its options.
+type Server struct {
+	opts    Options
+	handler http.Handler
+}
+
+// NewServer returns a server for handler, usually a Handler made with the
+// same options.
+func NewServer(opts Options, handler http.Handler) *Server {
+	return &Server{opts: opts, handler: handler}
+}
+
+// Run listens and serves until ctx is done, when it closes the listeners and
+// gives requests in progress until the write timeout to finish.  It returns
+// the first error a listener fails with, or nil once ctx is done.
+func (s *Server) Run(ctx context.Context) error {
+	opts := s.opts
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	hs := &http.Server{
+		Handler:        s.handler,
+		ReadTimeout:    opts.ReadTimeout,
+		WriteTimeout:   opts.WriteTimeout,
+		MaxHeaderBytes: opts.MaxHeaderBytes,
+	}
+	if opts.UnencryptedHTTP2 {
+		hs.Protocols = &http.Protocols{}
+		hs.Protocols.SetHTTP1(true)
+		hs.Protocols.SetUnencryptedHTTP2(true)
+	}
+	transparent := opts.OriginalDsts != nil
+	hs.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if transparent {
+			ctx = withOriginalDst(ctx, c)
+		}
+		if opts.ResolveLoopback {
+			ctx = withSocketOwner(ctx, c, opts.ProcRoot)
+		}
+		return withPeer(ctx, c)
+	}
+	lns, err := listen(opts.Listeners, opts)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serve(hs, lns)
+	}()
+	select {
+	case err := <-errs:
+		hs.Close()
+		return err
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), opts.WriteTimeout)
+	defer cancel()
+	if err := hs.Shutdown(shutdown); err != nil {
+		hs.Close()
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/proxy"
+)
+
+// fakeMetadataServer serves a few metadata endpoints, and records the
+// requests it gets.
+type fakeMetadataServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newFakeMetadataServer() *fakeMetadataServer {
+	f := &fakeMetadataServer{}
+	values := map[string]string{
+		"/computeMetadata/v1/instance/id":                      "1234",
+		"/computeMetadata/v1/instance/attributes/":             "cluster-name\nkube-env\n",
+		"/computeMetadata/v1/instance/attributes/kube-env":     "SECRET: value",
+		"/computeMetadata/v1/instance/service-accounts/":       "default/\n",
+		"/computeMetadata/v1/instance/attributes/cluster-name": "test",
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, req)
+		f.mu.Unlock()
+		v, ok := values[req.URL.Path]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Metadata-Flavor", "Google")
+		rw.Header().Set("Content-Type", "application/text")
+		fmt.Fprint(rw, v)
+	}))
+	return f
+}
+
+// lastRequest returns the last request the server got, or nil, and forgets
+// the requests.
+func (f *fakeMetadataServer) lastRequest() *http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var last *http.Request
+	if len(f.requests) > 0 {
+		last = f.requests[len(f.requests)-1]
+	}
+	f.requests = nil
+	return last
+}
+
+func testOptions(upstream string) proxy.Options {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		panic(err)
+	}
+	return proxy.Options{
+		Upstream:        u,
+		Policy:          metadata.DefaultPolicy(),
+		Failure:         proxy.DefaultFailureModes,
+		MaxConnections:  10,
+		ReadTimeout:     time.Second,
+		WriteTimeout:    time.Second,
+		MaxWaitTimeout:  time.Minute,
+		MaxHeaderBytes:  1 << 10,
+		KeepAlivePeriod: time.Minute,
+		ProcRoot:        "/proc",
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	t.Parallel()
+	upstream := newFakeMetadataServer()
+	defer upstream.Close()
+	h, err := proxy.NewHandler(testOptions(upstream.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := httptest.NewServer(h)
+	defer p.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	flavor := http.Header{"Metadata-Flavor": {"Google"}}
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		host           string
+		header         http.Header
+		expectCode     int
+		expectBody     string
+		expectUpstream string
+	}{
+		{"allowed", "GET", "/computeMetadata/v1/instance/id", "", flavor, http.StatusOK, "1234", "/computeMetadata/v1/instance/id"},
+		{"IP host", "GET", "/computeMetadata/v1/instance/id", "169.254.169.254", flavor, http.StatusOK, "1234", "/computeMetadata/v1/instance/id"},
+		{"missing flavor", "GET", "/computeMetadata/v1/instance/id", "", nil, http.StatusForbidden, "", ""},
+		{"concealed", "GET", "/computeMetadata/v1/instance/attributes/kube-env", "", flavor, http.StatusForbidden, "", ""},
+		{"concealed in listing", "GET", "/computeMetadata/v1/instance/attributes/", "", flavor, http.StatusOK, "cluster-name\n", "/computeMetadata/v1/instance/attributes/"},
+		{"ambiguous path", "GET", "/computeMetadata/v1/instance/attributes/%6bube-env", "", flavor, http.StatusForbidden, "", ""},
+		{"recursive", "GET", "/computeMetadata/v1/instance/?recursive=true", "", flavor, http.StatusForbidden, "", ""},
+		{"method", "POST", "/computeMetadata/v1/instance/id", "", flavor, http.StatusMethodNotAllowed, "", ""},
+		{"rebinding", "GET", "/computeMetadata/v1/instance/id", "attacker.example", flavor, http.StatusForbidden, "", ""},
+		{"forwarded", "GET", "/computeMetadata/v1/instance/id", "", http.Header{"Metadata-Flavor": {"Google"}, "X-Forwarded-For": {"10.0.0.1"}}, http.StatusForbidden, "", ""},
+		{"unknown query parameter", "GET", "/computeMetadata/v1/instance/id?evil=1", "", flavor, http.StatusForbidden, "", ""},
+		{"not found", "GET", "/computeMetadata/v1/instance/hostname", "", flavor, http.StatusNotFound, "", "/computeMetadata/v1/instance/hostname"},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, p.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "metadata.google.internal"
+		if tc.host != "" {
+			req.Host = tc.host
+		}
+		for k, v := range tc.header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Authorization", "Bearer not-for-upstream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d: %s", tc.name, resp.StatusCode, tc.expectCode, body)
+		}
+		if tc.expectBody != "" && string(body) != tc.expectBody {
+			t.Errorf("%s: got body %q, expected %q", tc.name, body, tc.expectBody)
+		}
+
+		got := upstream.lastRequest()
+		switch {
+		case tc.expectUpstream == "" && got != nil:
+			t.Errorf("%s: got upstream request for %s, expected none", tc.name, got.URL)
+		case tc.expectUpstream != "" && got == nil:
+			t.Errorf("%s: got no upstream request, expected one for %s", tc.name, tc.expectUpstream)
+		case got != nil:
+			if got.URL.Path != tc.expectUpstream {
+				t.Errorf("%s: got upstream request for %s, expected %s", tc.name, got.URL.Path, tc.expectUpstream)
+			}
+			if got.Host != upstreamHost {
+				t.Errorf("%s: got upstream Host %q, expected %q", tc.name, got.Host, upstreamHost)
+			}
+			for _, name := range []string{"Authorization", "X-Forwarded-For"} {
+				if v := got.Header.Get(name); v != "" {
+					t.Errorf("%s: got upstream %s %q, expected it stripped", tc.name, name, v)
+				}
+			}
+			if v := got.Header.Get("Metadata-Flavor"); v != "Google" {
+				t.Errorf("%s: got upstream Metadata-Flavor %q, expected Google", tc.name, v)
+			}
+		}
+	}
+}
+
+func TestNewHandlerRejectsInvalidFailureModes(t *testing.T) {
+	t.Parallel()
+	opts := testOptions("http://169.254.169.254")
+	opts.Failure.Upstream = proxy.FailDefault
+	if _, err := proxy.NewHandler(opts); err == nil {
+		t.Errorf("Got nil error for the default upstream failure mode, expected an error")
+	}
+}
+
+func TestNewHandlerCompilesRules(t *testing.T) {
+	t.Parallel()
+	upstream := newFakeMetadataServer()
+	defer upstream.Close()
+	opts := testOptions(upstream.URL)
+	opts.Policy = metadata.DefaultPolicy()
+	opts.Policy.Rules = []metadata.Rule{{Name: "head-only", Expression: "request.method == 'HEAD'"}}
+	h, err := proxy.NewHandler(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/id", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Host = "metadata.google.internal"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if expect := "This metadata request is denied by rule \"head-only\" of the metadata proxy\n"; rec.Body.String() != expect {
+		t.Errorf("Got body %q, expected %q", rec.Body.String(), expect)
+	}
+
+	opts.Policy = metadata.DefaultPolicy()
+	opts.Policy.Rules = []metadata.Rule{{Name: "typo", Expression: "request.methd == 'GET'"}}
+	if _, err := proxy.NewHandler(opts); err == nil {
+		t.Errorf("Got nil error for a rule that doesn't compile, expected an error")
+	}
+}
+
+func TestServerRun(t *testing.T) {
+	t.Parallel()
+	upstream := newFakeMetadataServer()
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := testOptions(upstream.URL)
+	opts.UnixSocket, opts.UnixSocketMode = filepath.Join(dir, "proxy.sock"), 0600
+	h, err := proxy.NewHandler(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy.NewServer(opts, h).Run(ctx)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", opts.UnixSocket)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		req, _ := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/id", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		if resp, err = client.Do(req); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to reach the server: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "1234" {
+		t.Errorf("Got %d %q, expected %d %q", resp.StatusCode, body, http.StatusOK, "1234")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Got %v from Run, expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run didn't return after its context was done")
+	}
+
+	opts.MaxConnections = 0
+	if err := proxy.NewServer(opts, h).Run(context.Background()); err == nil {
+		t.Errorf("Got nil error running with no connections allowed, expected an error")
+	}
+}
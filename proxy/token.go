@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/tokens"
+)
+
+// tokenHeader carries the service account token required by endpoints with a
+// token rule.  It's never forwarded to the metadata server.
+const tokenHeader = "Metadata-Proxy-Token"
+
+// Reasons for rejecting requests to endpoints with a token rule.
+const (
+	reasonTokenMissing     = "token_missing"
+	reasonTokenInvalid     = "token_invalid"
+	reasonTokenNotAllowed  = "token_not_allowed"
+	reasonTokenUnavailable = "token_unavailable"
+)
+
+// tokenError is returned by checkToken when it rejects a request.
+type tokenError struct {
+	code   int
+	reason string
+	msg    string
+}
+
+func (e *tokenError) Error() string {
+	return e.msg
+}
+
+// checkToken removes the token from req, and checks it if the policy has a
+// token rule for the endpoint, returning whose token it is.  The identity is
+// nil for endpoints without a token rule.
+func (h *Handler) checkToken(req *http.Request, policy *metadata.Policy, cleanedPath string) (*tokens.Identity, error) {
+	values := req.Header[http.CanonicalHeaderKey(tokenHeader)]
+	req.Header.Del(tokenHeader)
+	rule := policy.TokenRule(cleanedPath)
+	if rule == nil {
+		return nil, nil
+	}
+	if h.verifier == nil {
+		return nil, &tokenError{http.StatusServiceUnavailable, reasonTokenUnavailable, "Metadata proxy can't verify service account tokens"}
+	}
+	if len(values) != 1 || values[0] == "" {
+		return nil, &tokenError{http.StatusForbidden, reasonTokenMissing, fmt.Sprintf("Missing service account token in %s header", tokenHeader)}
+	}
+	id, err := h.verifier.Verify(values[0])
+	if errors.Is(err, tokens.ErrInvalidToken) {
+		log.Printf("Rejecting token from %s: %v", clientAddr(req.RemoteAddr), err)
+		return nil, &tokenError{http.StatusForbidden, reasonTokenInvalid, "Invalid service account token"}
+	}
+	if err != nil {
+		log.Printf("Failed to verify token from %s: %v", clientAddr(req.RemoteAddr), err)
+		return nil, &tokenError{http.StatusServiceUnavailable, reasonTokenUnavailable, "Metadata proxy could not verify the service account token"}
+	}
+	if !rule.Allows(id.Namespace, id.ServiceAccount) {
+		return nil, &tokenError{http.StatusForbidden, reasonTokenNotAllowed, fmt.Sprintf("Service account %s may not access %s", id, cleanedPath)}
+	}
+	return id, nil
+}
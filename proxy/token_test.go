@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/tokens"
+)
+
+// fakeVerifier is a tokens.Verifier that knows a fixed set of tokens.
+type fakeVerifier map[string]*tokens.Identity
+
+func (f fakeVerifier) Verify(token string) (*tokens.Identity, error) {
+	if token == "unavailable" {
+		return nil, errors.New("API server is down")
+	}
+	if id, ok := f[token]; ok {
+		return id, nil
+	}
+	return nil, fmt.Errorf("%w: unknown token", tokens.ErrInvalidToken)
+}
+
+func TestTokenRules(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if v := req.Header.Get(tokenHeader); v != "" {
+			t.Errorf("Got %s header %q upstream, expected it stripped", tokenHeader, v)
+		}
+		fmt.Fprint(rw, "ok")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := metadata.ParsePolicy([]byte(`{
+		"allowedHeaders": ["Metadata-Flavor", "Metadata-Proxy-Token"],
+		"concealedInstanceAttributes": {"globs": []},
+		"tokenRules": [{"path": "/computeMetadata/v1/instance/attributes/kube-env", "serviceAccounts": ["kube-system/node-agent"]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := fakeVerifier{
+		"agent": {Namespace: "kube-system", ServiceAccount: "node-agent", PodName: "node-agent-1"},
+		"web":   {Namespace: "default", ServiceAccount: "web", PodName: "web-1"},
+	}
+	const kubeEnv = "/computeMetadata/v1/instance/attributes/kube-env"
+
+	tests := []struct {
+		name       string
+		verifier   tokens.Verifier
+		path       string
+		tokens     []string
+		expectCode int
+	}{
+		{"allowed", verifier, kubeEnv, []string{"agent"}, http.StatusOK},
+		{"other service account", verifier, kubeEnv, []string{"web"}, http.StatusForbidden},
+		{"invalid", verifier, kubeEnv, []string{"forged"}, http.StatusForbidden},
+		{"missing", verifier, kubeEnv, nil, http.StatusForbidden},
+		{"repeated", verifier, kubeEnv, []string{"agent", "agent"}, http.StatusForbidden},
+		{"verifier down", verifier, kubeEnv, []string{"unavailable"}, http.StatusServiceUnavailable},
+		{"no verifier", nil, kubeEnv, []string{"agent"}, http.StatusServiceUnavailable},
+		{"no rule", verifier, "/computeMetadata/v1/instance/id", nil, http.StatusOK},
+		{"no rule with token", verifier, "/computeMetadata/v1/instance/id", []string{"web"}, http.StatusOK},
+	}
+	for _, tc := range tests {
+		h := newUpstreamHandler(u, testOptions, policy)
+		h.verifier = tc.verifier
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		for _, token := range tc.tokens {
+			req.Header.Add(tokenHeader, token)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d: %s", tc.name, rw.Code, tc.expectCode, rw.Body.String())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// originalDstKey is the request context key for the destination a client
+// originally connected to, before its connection was redirected to the
+// proxy.  It's only set in transparent mode.
+type originalDstKey struct{}
+
+// OriginalDst returns the destination the client of a request originally
+// connected to, given the request's context, if the request arrived on a
+// transparent listener.  Middlewares can use it to tell which address a
+// redirected client meant to reach.
+func OriginalDst(ctx context.Context) (*net.TCPAddr, bool) {
+	addr, ok := ctx.Value(originalDstKey{}).(*net.TCPAddr)
+	return addr, ok
+}
+
+// withOriginalDst is used as http.Server.ConnContext in transparent mode.
+// Connections accepted there report their original destination as their
+// local address.
+func withOriginalDst(ctx context.Context, c net.Conn) context.Context {
+	if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		return context.WithValue(ctx, originalDstKey{}, addr)
+	}
+	return ctx
+}
+
+// transparentConn is a connection that was redirected to the proxy.  Its
+// local address is the one the client originally connected to, rather than
+// the proxy's.
+type transparentConn struct {
+	*net.TCPConn
+	originalDst *net.TCPAddr
+}
+
+func (c *transparentConn) LocalAddr() net.Addr {
+	return c.originalDst
+}
+
+// ParseDestinations parses a comma-separated list of IP addresses, with
+// optional ports, that redirected connections may originally have been bound
+// for.
+func ParseDestinations(s string) ([]*net.TCPAddr, error) {
+	var dsts []*net.TCPAddr
+	for _, d := range strings.Split(s, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		host, port := d, 0
+		if h, p, err := net.SplitHostPort(d); err == nil {
+			n, err := strconv.ParseUint(p, 10, 16)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("invalid port in destination %q", d)
+			}
+			host, port = h, int(n)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address in destination %q", d)
+		}
+		dsts = append(dsts, &net.TCPAddr{IP: ip, Port: port})
+	}
+	if len(dsts) == 0 {
+		return nil, fmt.Errorf("no destinations given")
+	}
+	return dsts, nil
+}
+
+// allowedDestination returns whether addr is one of dsts.  A destination
+// without a port matches any port.
+func allowedDestination(dsts []*net.TCPAddr, addr *net.TCPAddr) bool {
+	for _, d := range dsts {
+		if d.IP.Equal(addr.IP) && (d.Port == 0 || d.Port == addr.Port) {
+			return true
+		}
+	}
+	return false
+}
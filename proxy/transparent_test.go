@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDestinations(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in     string
+		expect []*net.TCPAddr
+	}{
+		{"169.254.169.254:80", []*net.TCPAddr{{IP: net.ParseIP("169.254.169.254"), Port: 80}}},
+		{"169.254.169.254", []*net.TCPAddr{{IP: net.ParseIP("169.254.169.254")}}},
+		{"169.254.169.254:80, [fd00:ec2::254]:80", []*net.TCPAddr{
+			{IP: net.ParseIP("169.254.169.254"), Port: 80},
+			{IP: net.ParseIP("fd00:ec2::254"), Port: 80},
+		}},
+		{"", nil},
+		{"metadata.google.internal:80", nil},
+		{"169.254.169.254:0", nil},
+		{"169.254.169.254:http", nil},
+	}
+	for _, tc := range tests {
+		dsts, err := ParseDestinations(tc.in)
+		if tc.expect == nil {
+			if err == nil {
+				t.Errorf("Got nil error parsing %q, expected an error", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", tc.in, err)
+		} else if !reflect.DeepEqual(dsts, tc.expect) {
+			t.Errorf("Got %v parsing %q, expected %v", dsts, tc.in, tc.expect)
+		}
+	}
+}
+
+func TestAllowedDestination(t *testing.T) {
+	t.Parallel()
+	dsts, err := ParseDestinations("169.254.169.254:80,10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr   *net.TCPAddr
+		expect bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("169.254.169.254"), Port: 80}, true},
+		{&net.TCPAddr{IP: net.IPv4(169, 254, 169, 254).To4(), Port: 80}, true},
+		{&net.TCPAddr{IP: net.ParseIP("169.254.169.254"), Port: 8080}, false},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, true},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 988}, false},
+	}
+	for _, tc := range tests {
+		if got := allowedDestination(dsts, tc.addr); got != tc.expect {
+			t.Errorf("Got %v for %v, expected %v", got, tc.addr, tc.expect)
+		}
+	}
+}
+
+// TestTransparentListener checks that connections are refused or served
+// according to their original destination, which is faked.
+func TestTransparentListener(t *testing.T) {
+	t.Parallel()
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsts, err := ParseDestinations("169.254.169.254:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Connections are dialed one at a time, so they're accepted in the
+	// order their original destinations are queued.
+	next := make(chan *net.TCPAddr, 1)
+	tln := tcpKeepAliveListener{
+		TCPListener:     ln,
+		keepAlivePeriod: time.Minute,
+		originalDst: func(*net.TCPConn) (*net.TCPAddr, error) {
+			if dst := <-next; dst != nil {
+				return dst, nil
+			}
+			return nil, fmt.Errorf("no conntrack entry")
+		},
+		originalDsts: dsts,
+	}
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			dst, ok := OriginalDst(req.Context())
+			if !ok {
+				t.Errorf("Request has no original destination")
+				return
+			}
+			fmt.Fprint(rw, dst)
+		}),
+		ConnContext: withOriginalDst,
+	}
+	go s.Serve(tln)
+	defer s.Close()
+
+	get := func(dst *net.TCPAddr) (string, error) {
+		next <- dst
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		fmt.Fprint(c, "GET / HTTP/1.1\r\nHost: metadata\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if body, err := get(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}); err == nil {
+		t.Errorf("Got %q for connection to disallowed destination, expected it to be refused", body)
+	}
+	if body, err := get(nil); err == nil {
+		t.Errorf("Got %q for connection without an original destination, expected it to be refused", body)
+	}
+	body, err := get(&net.TCPAddr{IP: net.ParseIP("169.254.169.254"), Port: 80})
+	if err != nil {
+		t.Fatalf("Unexpected error for connection to allowed destination: %v", err)
+	}
+	if body != "169.254.169.254:80" {
+		t.Errorf("Got original destination %q, expected %q", body, "169.254.169.254:80")
+	}
+}
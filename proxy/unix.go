@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metrics"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+)
+
+// peerKey is the request context key for the process at the other end of a
+// unix socket connection.
+type peerKey struct{}
+
+// peerCred identifies the process that connected to the unix socket
+// listener.  It's a net.Addr, since it stands in for the connection's remote
+// address.
+type peerCred struct {
+	pid      int
+	uid, gid uint32
+	// cgroup is the process's cgroup when it connected, if err is nil.
+	// err says why the process or its cgroup couldn't be found.
+	cgroup pods.Cgroup
+	err    error
+}
+
+func (p *peerCred) Network() string {
+	return "unix"
+}
+
+func (p *peerCred) String() string {
+	return fmt.Sprintf("pid=%d,uid=%d", p.pid, p.uid)
+}
+
+// peer returns the process that sent a request, if it arrived on the unix
+// socket listener.
+func peer(ctx context.Context) (*peerCred, bool) {
+	p, ok := ctx.Value(peerKey{}).(*peerCred)
+	return p, ok
+}
+
+// withPeer is used in http.Server.ConnContext.  Connections accepted on the
+// unix socket listener report their peer as their remote address.
+func withPeer(ctx context.Context, c net.Conn) context.Context {
+	if p, ok := c.RemoteAddr().(*peerCred); ok {
+		return context.WithValue(ctx, peerKey{}, p)
+	}
+	return ctx
+}
+
+// peerConn is a unix socket connection whose remote address is its peer.
+type peerConn struct {
+	*net.UnixConn
+	peer *peerCred
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+// unixListener accepts connections on a unix socket, and identifies their
+// peers.  Connections whose peer can't be identified are refused.
+type unixListener struct {
+	*net.UnixListener
+	procRoot string
+}
+
+func (ln unixListener) Accept() (net.Conn, error) {
+	for {
+		uc, err := ln.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		pid, uid, gid, err := getPeerCred(uc)
+		if err != nil {
+			log.Printf("Refusing unix socket connection: %v", err)
+			metrics.PeerCredRejectCounter.Inc()
+			uc.Close()
+			continue
+		}
+		p := &peerCred{pid: pid, uid: uid, gid: gid}
+		// The cgroup is read now, before the pid can be reused.
+		p.cgroup, p.err = readCgroup(ln.procRoot, pid)
+		return &peerConn{uc, p}, nil
+	}
+}
+
+// listenUnix listens on a unix socket at path, with the given permissions.
+// A socket left behind at path by an earlier run is removed first.
+func listenUnix(path string, mode os.FileMode, procRoot string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return unixListener{UnixListener: ln, procRoot: procRoot}, nil
+}
+
+// readCgroup reads the cgroup of the process pid.
+func readCgroup(procRoot string, pid int) (pods.Cgroup, error) {
+	c, err := pods.ReadCgroup(procRoot, pid)
+	if err != nil {
+		return c, fmt.Errorf("failed to read cgroup of pid %d: %v", pid, err)
+	}
+	return c, nil
+}
+
+// caller returns what's known of the process p: its uid, cgroup and, if it
+// runs in a pod and there's a resolver, the pod.  It fails if the
+// cgroup couldn't be read or the resolver isn't synced.
+func (h *Handler) caller(p *peerCred) (metadata.Caller, error) {
+	c := metadata.Caller{UID: p.uid, HasUID: true}
+	if p.err != nil {
+		return c, p.err
+	}
+	c.Cgroup = p.cgroup.Path
+	if h.resolver == nil || p.cgroup.PodUID == "" {
+		return c, nil
+	}
+	pod, err := h.resolver.LookupUID(p.cgroup.PodUID)
+	if err != nil {
+		return c, err
+	}
+	return podCaller(c, pod), nil
+}
+
+// peerPolicy returns the policy for requests from the process p, and what's
+// known of it, applying the identity failure mode if it can't be identified.
+func (h *Handler) peerPolicy(policy *metadata.Policy, p *peerCred) (*metadata.Policy, metadata.Caller, error) {
+	c, err := h.caller(p)
+	if err != nil {
+		log.Printf("Failed to identify %s, failure mode %s applies: %v", p, h.failure.Identity, err)
+		fallBack(failureIdentity, h.failure.Identity)
+		switch h.failure.Identity {
+		case FailDefault:
+			return policy, metadata.Caller{}, nil
+		case FailCache:
+			var pod *pods.Pod
+			if p.err == nil && h.resolver != nil {
+				pod = h.resolver.CachedUID(p.cgroup.PodUID)
+			}
+			if pod == nil {
+				return nil, metadata.Caller{}, errIdentityUnavailable
+			}
+			c = podCaller(c, pod)
+		default:
+			return nil, metadata.Caller{}, errIdentityUnavailable
+		}
+	}
+	return policy.ForCaller(c), c, nil
+}
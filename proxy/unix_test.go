@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/metadata"
+	"github.com/GoogleCloudPlatform/k8s-metadata-proxy/pods"
+)
+
+func TestUnixListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is only available on Linux")
+	}
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+	// A stale socket from an earlier run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	opts := testOptions
+	opts.UnixSocket, opts.UnixSocketMode = path, 0600
+	lns, err := listen(nil, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error listening: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Got socket %v, %v, expected mode 0600", fi, err)
+	}
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			p, ok := peer(req.Context())
+			if !ok {
+				http.Error(rw, "no peer", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(rw, "%d %d %d %v", p.pid, p.uid, p.gid, p.err)
+		}),
+		ConnContext: withPeer,
+	}
+	go serve(s, lns)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://metadata.google.internal/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := fmt.Sprintf("%d %d %d <nil>", os.Getpid(), os.Getuid(), os.Getgid())
+	if string(body) != expect {
+		t.Errorf("Got peer %q, expected %q", body, expect)
+	}
+}
+
+func TestPeerPolicy(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, "ok")
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kube-env is only revealed to kube-system, the node agent and root.
+	policy, err := metadata.ParsePolicy([]byte(`{
+		"namespaces": {"kube-system": {"concealedInstanceAttributes": {"globs": []}}},
+		"cgroups": {"/system.slice/node-agent.service": {"concealedInstanceAttributes": {"globs": []}}},
+		"uids": {"0": {"concealedInstanceAttributes": {"globs": []}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const podUID = "1b2c3d4e-0000-1111-2222-333344445555"
+	inPod := pods.Cgroup{Path: "/kubepods/pod" + podUID + "/c", PodUID: podUID}
+	agent := pods.Cgroup{Path: "/system.slice/node-agent.service"}
+	user := pods.Cgroup{Path: "/user.slice"}
+	system := &pods.Pod{Namespace: "kube-system", Name: "agent", UID: podUID}
+
+	tests := []struct {
+		name       string
+		peer       *peerCred
+		resolver   PodResolver
+		mode       FailureMode
+		expectCode int
+	}{
+		{"root", &peerCred{uid: 0, cgroup: user}, nil, FailDeny, http.StatusOK},
+		{"user", &peerCred{uid: 1000, cgroup: user}, nil, FailDeny, http.StatusForbidden},
+		{"agent", &peerCred{uid: 1000, cgroup: agent}, nil, FailDeny, http.StatusOK},
+		{"pod without resolver", &peerCred{uid: 1000, cgroup: inPod}, nil, FailDeny, http.StatusForbidden},
+		{"pod", &peerCred{uid: 1000, cgroup: inPod}, fakeResolver{pod: system}, FailDeny, http.StatusOK},
+		{"pod not synced deny", &peerCred{uid: 1000, cgroup: inPod}, fakeResolver{err: pods.ErrNotSynced}, FailDeny, http.StatusServiceUnavailable},
+		{"pod not synced default", &peerCred{uid: 1000, cgroup: inPod}, fakeResolver{err: pods.ErrNotSynced, cached: system}, FailDefault, http.StatusForbidden},
+		{"pod not synced cache", &peerCred{uid: 1000, cgroup: inPod}, fakeResolver{err: pods.ErrNotSynced, cached: system}, FailCache, http.StatusOK},
+		{"no cgroup deny", &peerCred{uid: 0, err: os.ErrNotExist}, nil, FailDeny, http.StatusServiceUnavailable},
+		{"no cgroup default", &peerCred{uid: 0, err: os.ErrNotExist}, nil, FailDefault, http.StatusForbidden},
+		{"no cgroup cache", &peerCred{uid: 0, err: os.ErrNotExist}, fakeResolver{cached: system}, FailCache, http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		opts := testOptions
+		opts.Failure.Identity = tc.mode
+		h := newUpstreamHandler(u, opts, policy)
+		h.resolver = tc.resolver
+		req := httptest.NewRequest("GET", "/computeMetadata/v1/instance/attributes/kube-env", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		req.Host = "metadata.google.internal"
+		req.RemoteAddr = tc.peer.String()
+		req = req.WithContext(context.WithValue(req.Context(), peerKey{}, tc.peer))
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tc.expectCode {
+			t.Errorf("%s: got code %d, expected %d", tc.name, rw.Code, tc.expectCode)
+		}
+	}
+}
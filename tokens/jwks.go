@@ -0,0 +1,216 @@
+package tokens
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// JWKSVerifier verifies tokens locally, against the API server's public
+// signing keys.  Unlike TokenReviewer, it can't tell whether the pod a token
+// is bound to still exists, so tokens are trusted until they expire.
+type JWKSVerifier struct {
+	keys      map[string]crypto.PublicKey
+	issuer    string
+	audiences []string
+	now       func() time.Time
+}
+
+// jwks is a JSON Web Key Set, as served by the API server at
+// /openid/v1/jwks.
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"keys"`
+}
+
+// NewJWKSVerifier returns a verifier that accepts tokens signed by the RSA or
+// P-256 keys in the JSON Web Key Set keySet, issued by issuer, if set, for any
+// of the audiences.
+func NewJWKSVerifier(keySet []byte, issuer string, audiences []string) (*JWKSVerifier, error) {
+	if len(audiences) == 0 {
+		return nil, fmt.Errorf("no audiences given")
+	}
+	var set jwks
+	if err := json.Unmarshal(keySet, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse key set: %v", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := decodeInt(k.N)
+			e, err2 := decodeInt(k.E)
+			if err1 != nil || err2 != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := decodeInt(k.X)
+			y, err2 := decodeInt(k.Y)
+			if err1 != nil || err2 != nil || !elliptic.P256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		default:
+			return nil, fmt.Errorf("unsupported key %q of type %s", k.Kid, k.Kty)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys in key set")
+	}
+	return &JWKSVerifier{keys: keys, issuer: issuer, audiences: audiences, now: time.Now}, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// claims are the claims of a projected service account token the verifier
+// checks.
+type claims struct {
+	Issuer     string   `json:"iss"`
+	Audience   audience `json:"aud"`
+	Expiry     *int64   `json:"exp"`
+	NotBefore  *int64   `json:"nbf"`
+	Kubernetes *struct {
+		Namespace      string `json:"namespace"`
+		ServiceAccount struct {
+			Name string `json:"name"`
+		} `json:"serviceaccount"`
+		Pod *struct {
+			Name string `json:"name"`
+			UID  string `json:"uid"`
+		} `json:"pod"`
+	} `json:"kubernetes.io"`
+}
+
+// audience is the aud claim, which is either a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Verify checks the token's signature and claims.
+func (v *JWKSVerifier) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: bad header: %v", ErrInvalidToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature: %v", ErrInvalidToken, err)
+	}
+	if err := v.checkSignature(header.Alg, header.Kid, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("%w: bad claims: %v", ErrInvalidToken, err)
+	}
+	now := v.now().Unix()
+	switch {
+	case v.issuer != "" && c.Issuer != v.issuer:
+		return nil, fmt.Errorf("%w: issued by %q", ErrInvalidToken, c.Issuer)
+	case !v.forAudience(c.Audience):
+		return nil, fmt.Errorf("%w: for audiences %q", ErrInvalidToken, c.Audience)
+	case c.Expiry == nil || now >= *c.Expiry:
+		return nil, fmt.Errorf("%w: expired or doesn't expire", ErrInvalidToken)
+	case c.NotBefore != nil && now < *c.NotBefore:
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	case c.Kubernetes == nil || c.Kubernetes.Namespace == "" || c.Kubernetes.ServiceAccount.Name == "":
+		return nil, fmt.Errorf("%w: not a service account token", ErrInvalidToken)
+	case c.Kubernetes.Pod == nil || c.Kubernetes.Pod.Name == "":
+		return nil, fmt.Errorf("%w: not bound to a pod", ErrInvalidToken)
+	}
+	k := c.Kubernetes
+	return &Identity{
+		Namespace:      k.Namespace,
+		ServiceAccount: k.ServiceAccount.Name,
+		PodName:        k.Pod.Name,
+		PodUID:         k.Pod.UID,
+	}, nil
+}
+
+func (v *JWKSVerifier) checkSignature(alg, kid, signed string, sig []byte) error {
+	key, ok := v.keys[kid]
+	if !ok {
+		return fmt.Errorf("unknown key %q", kid)
+	}
+	digest := sha256.Sum256([]byte(signed))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			break
+		}
+		// ES256 signatures are r and s, 32 bytes each.
+		if len(sig) != 64 {
+			return fmt.Errorf("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q doesn't match key %q", alg, kid)
+}
+
+func (v *JWKSVerifier) forAudience(aud audience) bool {
+	for _, a := range aud {
+		for _, want := range v.audiences {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
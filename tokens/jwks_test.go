@@ -0,0 +1,152 @@
+package tokens
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// signToken returns a JWT with the claims, signed with key.
+func signToken(t *testing.T, key crypto.Signer, kid string, claims interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	segment := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := segment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// projectedClaims returns the claims of a token projected into pod web-1.
+func projectedClaims(aud interface{}, exp int64) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": "https://kubernetes.default.svc",
+		"aud": aud,
+		"exp": exp,
+		"nbf": exp - 3600,
+		"sub": "system:serviceaccount:default:web",
+		"kubernetes.io": map[string]interface{}{
+			"namespace":      "default",
+			"serviceaccount": map[string]string{"name": "web", "uid": "sa-uid"},
+			"pod":            map[string]string{"name": "web-1", "uid": "pod-uid"},
+		},
+	}
+}
+
+func TestJWKSVerifier(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.Bytes())
+	}
+	keySet := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": %q, "e": %q},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": %q, "y": %q}
+	]}`, b64(rsaKey.N), b64(big.NewInt(int64(rsaKey.E))), b64(ecKey.X), b64(ecKey.Y))
+	v, err := NewJWKSVerifier([]byte(keySet), "https://kubernetes.default.svc", []string{"metadata-proxy"})
+	if err != nil {
+		t.Fatalf("Unexpected error parsing key set: %v", err)
+	}
+	now := time.Unix(100000, 0)
+	v.now = func() time.Time { return now }
+	exp := now.Add(time.Hour).Unix()
+
+	valid := projectedClaims("metadata-proxy", exp)
+	modified := func(f func(c map[string]interface{})) map[string]interface{} {
+		c := projectedClaims("metadata-proxy", exp)
+		f(c)
+		return c
+	}
+	tests := []struct {
+		name      string
+		token     string
+		expectErr bool
+	}{
+		{"RSA", signToken(t, rsaKey, "rsa", valid), false},
+		{"EC", signToken(t, ecKey, "ec", valid), false},
+		{"audience list", signToken(t, rsaKey, "rsa", projectedClaims([]string{"api", "metadata-proxy"}, exp)), false},
+		{"other audience", signToken(t, rsaKey, "rsa", projectedClaims("api", exp)), true},
+		{"expired", signToken(t, rsaKey, "rsa", projectedClaims("metadata-proxy", now.Unix())), true},
+		{"not yet valid", signToken(t, rsaKey, "rsa", modified(func(c map[string]interface{}) { c["nbf"] = exp })), true},
+		{"no expiry", signToken(t, rsaKey, "rsa", modified(func(c map[string]interface{}) { delete(c, "exp") })), true},
+		{"other issuer", signToken(t, rsaKey, "rsa", modified(func(c map[string]interface{}) { c["iss"] = "https://evil" })), true},
+		{"not bound to a pod", signToken(t, rsaKey, "rsa", modified(func(c map[string]interface{}) {
+			delete(c["kubernetes.io"].(map[string]interface{}), "pod")
+		})), true},
+		{"legacy token", signToken(t, rsaKey, "rsa", modified(func(c map[string]interface{}) { delete(c, "kubernetes.io") })), true},
+		{"unknown key", signToken(t, rsaKey, "other", valid), true},
+		{"wrong key", signToken(t, otherKey, "rsa", valid), true},
+		{"key of the other type", signToken(t, ecKey, "rsa", valid), true},
+		{"malformed", "not.a-token", true},
+	}
+	for _, tc := range tests {
+		id, err := v.Verify(tc.token)
+		if tc.expectErr {
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("%s: got %v, %v, expected %v", tc.name, id, err, ErrInvalidToken)
+			}
+			continue
+		}
+		expect := Identity{Namespace: "default", ServiceAccount: "web", PodName: "web-1", PodUID: "pod-uid"}
+		if err != nil || *id != expect {
+			t.Errorf("%s: got %+v, %v, expected %+v", tc.name, id, err, expect)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"keys": []}`,
+		`{"keys": [{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"}]}`,
+		`{"keys": [{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+	} {
+		if _, err := NewJWKSVerifier([]byte(bad), "", []string{"metadata-proxy"}); err == nil {
+			t.Errorf("Got nil error for key set %s, expected an error", bad)
+		}
+	}
+	if _, err := NewJWKSVerifier([]byte(keySet), "", nil); err == nil {
+		t.Errorf("Got nil error without audiences, expected an error")
+	}
+}
@@ -0,0 +1,159 @@
+package tokens
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedReviews bounds the number of reviews kept by TokenReviewer.
+const maxCachedReviews = 1024
+
+// TokenReviewer verifies tokens by asking the API server to review them.
+// Successful reviews are cached for a while, so that clients repeating a
+// request don't each cost a review.
+type TokenReviewer struct {
+	url       string
+	client    *http.Client
+	audiences []string
+	ttl       time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]review
+}
+
+// review is a cached successful review.
+type review struct {
+	id      *Identity
+	expires time.Time
+}
+
+// NewTokenReviewer returns a verifier that posts TokenReviews to the API
+// server at apiServerURL, with the given client, and accepts tokens for any
+// of the audiences, or the API server's own if there are none.  Reviews are
+// cached for ttl.
+func NewTokenReviewer(apiServerURL string, client *http.Client, audiences []string, ttl time.Duration) *TokenReviewer {
+	return &TokenReviewer{
+		url:       strings.TrimSuffix(apiServerURL, "/") + "/apis/authentication.k8s.io/v1/tokenreviews",
+		client:    client,
+		audiences: audiences,
+		ttl:       ttl,
+		now:       time.Now,
+		cache:     map[[sha256.Size]byte]review{},
+	}
+}
+
+// tokenReview is the subset of an authentication.k8s.io/v1 TokenReview the
+// reviewer uses.
+type tokenReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token     string   `json:"token"`
+		Audiences []string `json:"audiences,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Authenticated bool `json:"authenticated"`
+		User          struct {
+			Username string              `json:"username"`
+			Extra    map[string][]string `json:"extra"`
+		} `json:"user"`
+		Error string `json:"error"`
+	} `json:"status"`
+}
+
+// Extra user info keys set for tokens bound to a pod.
+const (
+	extraPodName = "authentication.kubernetes.io/pod-name"
+	extraPodUID  = "authentication.kubernetes.io/pod-uid"
+)
+
+// Verify reviews token, unless it was reviewed recently.  Reviews are cached
+// for the reviewer's ttl, or until the token expires if that's sooner.
+func (r *TokenReviewer) Verify(token string) (*Identity, error) {
+	key := sha256.Sum256([]byte(token))
+	r.mu.Lock()
+	cached, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && r.now().Before(cached.expires) {
+		return cached.id, nil
+	}
+
+	id, err := r.review(token)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= maxCachedReviews {
+		r.cache = map[[sha256.Size]byte]review{}
+	}
+	expires := r.now().Add(r.ttl)
+	if exp, ok := tokenExpiry(token); ok && exp.Before(expires) {
+		expires = exp
+	}
+	r.cache[key] = review{id, expires}
+	return id, nil
+}
+
+// tokenExpiry returns the exp claim of token, if it's a JWT with one.  The
+// signature isn't checked, which is left to the API server.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil || c.Expiry == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(*c.Expiry, 0), true
+}
+
+func (r *TokenReviewer) review(token string) (*Identity, error) {
+	req := tokenReview{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"}
+	req.Spec.Token = token
+	req.Spec.Audiences = r.audiences
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to review token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("failed to review token: %s", resp.Status)
+	}
+	var result tokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse token review: %v", err)
+	}
+
+	status := result.Status
+	if !status.Authenticated {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, status.Error)
+	}
+	namespace, name, ok := parseUsername(status.User.Username)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q isn't a service account", ErrInvalidToken, status.User.Username)
+	}
+	id := &Identity{Namespace: namespace, ServiceAccount: name}
+	if v := status.User.Extra[extraPodName]; len(v) == 1 {
+		id.PodName = v[0]
+	}
+	if v := status.User.Extra[extraPodUID]; len(v) == 1 {
+		id.PodUID = v[0]
+	}
+	if id.PodName == "" {
+		return nil, fmt.Errorf("%w: token for %s isn't bound to a pod", ErrInvalidToken, id)
+	}
+	return id, nil
+}
@@ -0,0 +1,104 @@
+package tokens
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenReviewer(t *testing.T) {
+	t.Parallel()
+	// expiring is a bound token that expires 30s into the test.
+	expiring := "e30." + base64.RawURLEncoding.EncodeToString([]byte(`{"exp": 1030}`)) + ".c2ln"
+	var mu sync.Mutex
+	reviews := 0
+	apiServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" {
+			http.NotFound(rw, req)
+			return
+		}
+		var review tokenReview
+		if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		reviews++
+		mu.Unlock()
+		if !reflect.DeepEqual(review.Spec.Audiences, []string{"metadata-proxy"}) {
+			t.Errorf("Got audiences %q, expected [metadata-proxy]", review.Spec.Audiences)
+		}
+		status := `{"authenticated": false, "error": "token expired"}`
+		switch review.Spec.Token {
+		case "bound", expiring:
+			status = `{"authenticated": true, "user": {"username": "system:serviceaccount:default:web",
+				"extra": {"authentication.kubernetes.io/pod-name": ["web-1"], "authentication.kubernetes.io/pod-uid": ["pod-uid"]}}}`
+		case "legacy":
+			status = `{"authenticated": true, "user": {"username": "system:serviceaccount:default:web"}}`
+		case "user":
+			status = `{"authenticated": true, "user": {"username": "alice"}}`
+		case "down":
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(rw, `{"apiVersion": "authentication.k8s.io/v1", "kind": "TokenReview", "status": %s}`, status)
+	}))
+	defer apiServer.Close()
+
+	r := NewTokenReviewer(apiServer.URL+"/", apiServer.Client(), []string{"metadata-proxy"}, time.Minute)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+
+	id, err := r.Verify("bound")
+	expect := Identity{Namespace: "default", ServiceAccount: "web", PodName: "web-1", PodUID: "pod-uid"}
+	if err != nil || *id != expect {
+		t.Errorf("Got %+v, %v, expected %+v", id, err, expect)
+	}
+	for _, token := range []string{"legacy", "user", "expired"} {
+		if id, err := r.Verify(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Got %v, %v for %s token, expected %v", id, err, token, ErrInvalidToken)
+		}
+	}
+	if _, err := r.Verify("down"); err == nil || errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Got %v with the API server down, expected an error other than %v", err, ErrInvalidToken)
+	}
+
+	// Successful reviews are cached for a minute.
+	reviewsFor := func(token string) int {
+		mu.Lock()
+		before := reviews
+		mu.Unlock()
+		r.Verify(token)
+		mu.Lock()
+		defer mu.Unlock()
+		return reviews - before
+	}
+	if n := reviewsFor("bound"); n != 0 {
+		t.Errorf("Got %d reviews for a cached token, expected 0", n)
+	}
+	if n := reviewsFor("expired"); n != 1 {
+		t.Errorf("Got %d reviews for an invalid token, expected 1", n)
+	}
+	// Or until the token expires, if that's sooner.
+	if n := reviewsFor(expiring); n != 1 {
+		t.Errorf("Got %d reviews for an expiring token, expected 1", n)
+	}
+	if n := reviewsFor(expiring); n != 0 {
+		t.Errorf("Got %d reviews for a cached expiring token, expected 0", n)
+	}
+	now = now.Add(30 * time.Second)
+	if n := reviewsFor(expiring); n != 1 {
+		t.Errorf("Got %d reviews after the token expired, expected 1", n)
+	}
+	now = now.Add(2 * time.Minute)
+	if n := reviewsFor("bound"); n != 1 {
+		t.Errorf("Got %d reviews after the cache expired, expected 1", n)
+	}
+}
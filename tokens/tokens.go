@@ -0,0 +1,45 @@
+// Package tokens verifies projected Kubernetes service account tokens.
+package tokens
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalidToken is wrapped by the errors verifiers return for tokens that
+// aren't valid, as opposed to tokens they failed to check.
+var ErrInvalidToken = errors.New("invalid service account token")
+
+// Identity is the pod and service account a token was issued to.
+type Identity struct {
+	Namespace      string
+	ServiceAccount string
+	PodName        string
+	PodUID         string
+}
+
+func (i *Identity) String() string {
+	return i.Namespace + "/" + i.ServiceAccount
+}
+
+// Verifier verifies service account tokens.  Only tokens bound to a pod, as
+// projected into pods by the kubelet, are accepted.
+type Verifier interface {
+	Verify(token string) (*Identity, error)
+}
+
+// serviceAccountPrefix prefixes the usernames of service accounts.
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// parseUsername returns the namespace and name of the service account a
+// username belongs to.
+func parseUsername(username string) (namespace, name string, ok bool) {
+	if !strings.HasPrefix(username, serviceAccountPrefix) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(username, serviceAccountPrefix), ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}